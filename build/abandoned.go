@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+)
+
+// How far a buyer got through checkout. A session only ever moves forward
+// through these.
+const (
+	checkoutViewed       = "viewed"
+	checkoutPlanSelected = "plan-selected"
+	checkoutRedirected   = "redirected"
+	checkoutApproved     = "approved"
+)
+
+var checkoutStates = []string{checkoutViewed, checkoutPlanSelected, checkoutRedirected, checkoutApproved}
+
+// resumeDelay is how long a checkout has to sit untouched before the buyer is
+// emailed a link to finish it. Checkouts older than resumeCutoff are left
+// alone. Set ABANDONED_CHECKOUT_DELAY_HOURS to change the delay.
+var (
+	resumeDelay  = 3 * time.Hour
+	resumeCutoff = 7 * 24 * time.Hour
+)
+
+// metricsWindow is how far back the admin's conversion figures look.
+const metricsWindow = 30 * 24 * time.Hour
+
+var resumeTemplate = template.Must(template.New("resume").Parse(`Hi,
+
+You didn't quite finish checking out {{.Session.Event}}{{if .Session.Variant}} - {{.Session.Variant}}{{end}}.
+
+Your tickets aren't booked until payment is approved. You can pick up where you left off at:
+{{.ResumeURL}}
+
+Thanks,
+{{.Session.Vendor}}
+`))
+
+func init() {
+	if hours := os.Getenv("ABANDONED_CHECKOUT_DELAY_HOURS"); hours != "" {
+		n, err := strconv.Atoi(hours)
+		if err != nil || n <= 0 {
+			panic("Invalid ABANDONED_CHECKOUT_DELAY_HOURS")
+		}
+		resumeDelay = time.Duration(n) * time.Hour
+	}
+}
+
+func checkoutStateRank(state string) int {
+	for i, s := range checkoutStates {
+		if s == state {
+			return i
+		}
+	}
+	return -1
+}
+
+// advance moves the session on to state unless it is already further along.
+func (s *CheckoutSession) advance(state string) {
+	if checkoutStateRank(state) > checkoutStateRank(s.State) {
+		s.State = state
+	}
+	s.Updated = time.Now()
+}
+
+// advanceCheckoutSession records that the buyer reached state.
+func advanceCheckoutSession(ctx context.Context, id string, state string) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		s, err := getCheckoutSession(tc, id)
+		if err != nil {
+			return err
+		}
+		s.advance(state)
+		return putCheckoutSession(tc, id, s)
+	}, nil)
+}
+
+// approveCheckoutForSubscription marks the session a subscription was created
+// from as approved.
+func approveCheckoutForSubscription(ctx context.Context, subscriptionID string) error {
+	keys, err := datastore.NewQuery("CheckoutSession").Filter("SubscriptionID =", subscriptionID).KeysOnly().Limit(1).GetAll(ctx, nil)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	return advanceCheckoutSession(ctx, keys[0].StringID(), checkoutApproved)
+}
+
+// resumeURL is a freshly signed link back to the checkout page for the same
+// cart, so it works however long ago the original link was signed. It names
+// the session id it resumes, so a checkout finished from it counts as
+// recovered.
+func (s *CheckoutSession) resumeURL(ctx context.Context, id string) (string, error) {
+	vendor := vendorSlug(ctx, s.Shop)
+	q := url.Values{}
+	q.Set("product", strconv.FormatInt(s.ProductID, 10))
+	q.Set("variant", strconv.FormatInt(s.VariantID, 10))
+	q.Set("qty", s.Qty)
+	q.Set("resumed", id)
+	segment, err := signLink(ctx, linkCheckout, vendor, q)
+	if err != nil {
+		return "", err
+	}
+	return appURL + "/checkout/" + vendor + "/" + segment, nil
+}
+
+// serveAbandonedCheckouts is run by cron. It emails buyers who gave their
+// address but stopped before approving payment a link to finish checking out.
+// Each checkout gets at most one email.
+func serveAbandonedCheckouts(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	now := time.Now()
+	var sessions []CheckoutSession
+	keys, err := datastore.NewQuery("CheckoutSession").
+		Filter("ResumeSent =", time.Time{}).
+		Filter("Updated <", now.Add(-resumeDelay)).
+		Filter("Updated >", now.Add(-resumeCutoff)).
+		GetAll(ctx, &sessions)
+	if err != nil {
+		log.Errorf(ctx, "Abandoned Checkout Query Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sent := 0
+	for i := range sessions {
+		s := &sessions[i]
+		id := keys[i].StringID()
+		if s.Email == "" || s.State == checkoutApproved || s.ProductID == 0 || s.VariantID == 0 {
+			continue
+		}
+		// The buyer may have approved without coming back to the thank-you
+		// page.
+		if s.SubscriptionID != "" {
+			if _, err := getOrder(ctx, s.SubscriptionID); err == nil {
+				if err := advanceCheckoutSession(ctx, id, checkoutApproved); err != nil {
+					log.Errorf(ctx, "Advance Checkout Session Error: %s", err)
+				}
+				continue
+			}
+		}
+		// Or finished the same cart in another checkout.
+		done, err := datastore.NewQuery("CheckoutSession").
+			Filter("Email =", s.Email).
+			Filter("VariantID =", s.VariantID).
+			Filter("State =", checkoutApproved).
+			KeysOnly().Limit(1).GetAll(ctx, nil)
+		if err != nil {
+			log.Errorf(ctx, "Completed Checkout Query Error: %s", err)
+			continue
+		}
+		if len(done) > 0 {
+			continue
+		}
+		if err := sendResumeEmail(ctx, id, s); err != nil {
+			log.Errorf(ctx, "Resume checkout %s: %s", id, err)
+			continue
+		}
+		sent++
+	}
+	log.Debugf(ctx, "Sent %d resume emails", sent)
+	w.WriteHeader(http.StatusOK)
+}
+
+// sendResumeEmail claims the session's one resume email and sends it.
+func sendResumeEmail(ctx context.Context, id string, s *CheckoutSession) error {
+	claimed := false
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		current, err := getCheckoutSession(tc, id)
+		if err != nil {
+			return err
+		}
+		if !current.ResumeSent.IsZero() || current.State == checkoutApproved {
+			return nil
+		}
+		current.ResumeSent = time.Now()
+		claimed = true
+		return putCheckoutSession(tc, id, current)
+	}, nil)
+	if err != nil || !claimed {
+		return err
+	}
+
+	resume, err := s.resumeURL(ctx, id)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	err = resumeTemplate.Execute(&body, struct {
+		Session   *CheckoutSession
+		ResumeURL string
+	}{
+		Session:   s,
+		ResumeURL: resume,
+	})
+	if err != nil {
+		return err
+	}
+	return mail.Send(ctx, &mail.Message{
+		Sender:  mailSender,
+		To:      []string{s.Email},
+		Subject: "Finish checking out " + s.Event,
+		Body:    body.String(),
+	})
+}
+
+// CheckoutFunnel counts how many checkouts for a vendor reached each state.
+// Each count includes the checkouts that went on to later states.
+type CheckoutFunnel struct {
+	Vendor       string
+	Viewed       int
+	PlanSelected int
+	Redirected   int
+	Approved     int
+	Reminded     int
+	Recovered    int
+}
+
+// Conversion is the share of viewed checkouts that were approved, as a
+// percentage.
+func (f CheckoutFunnel) Conversion() string {
+	if f.Viewed == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(100*float64(f.Approved)/float64(f.Viewed), 'f', 1, 64) + "%"
+}
+
+// checkoutFunnels summarises the tenant's checkouts since since, one funnel
+// per vendor.
+func checkoutFunnels(ctx context.Context, t Tenant, since time.Time) ([]CheckoutFunnel, error) {
+	var sessions []CheckoutSession
+	q := t.query("CheckoutSession").Filter("Created >", since)
+	keys, err := q.GetAll(ctx, &sessions)
+	if err != nil {
+		return nil, err
+	}
+	// A buyer who follows a resume email finishes in a new session, which
+	// names the one they were reminded about.
+	resumed := map[string]bool{}
+	for _, s := range sessions {
+		if s.ResumedFrom != "" && checkoutStateRank(s.State) >= 3 {
+			resumed[s.ResumedFrom] = true
+		}
+	}
+	byVendor := map[string]*CheckoutFunnel{}
+	for i, s := range sessions {
+		f, ok := byVendor[s.Vendor]
+		if !ok {
+			f = &CheckoutFunnel{Vendor: s.Vendor}
+			byVendor[s.Vendor] = f
+		}
+		rank := checkoutStateRank(s.State)
+		// Sessions from before states were tracked were at least viewed.
+		f.Viewed++
+		if rank >= 1 {
+			f.PlanSelected++
+		}
+		if rank >= 2 {
+			f.Redirected++
+		}
+		if rank >= 3 {
+			f.Approved++
+		}
+		if !s.ResumeSent.IsZero() {
+			f.Reminded++
+			if rank >= 3 || resumed[keys[i].StringID()] {
+				f.Recovered++
+			}
+		}
+	}
+	funnels := make([]CheckoutFunnel, 0, len(byVendor))
+	for _, f := range byVendor {
+		funnels = append(funnels, *f)
+	}
+	sort.Slice(funnels, func(i, j int) bool { return funnels[i].Vendor < funnels[j].Vendor })
+	return funnels, nil
+}
+
+// checkoutEmail checks the address a buyer gave at checkout.
+func checkoutEmail(v string) (string, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return "", nil
+	}
+	addr, err := netmail.ParseAddress(v)
+	if err != nil {
+		return "", err
+	}
+	return addr.Address, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+)
+
+func TestResumedCheckoutRecovered(t *testing.T) {
+	fake, stopPayPal := usePayPalFake()
+	defer stopPayPal()
+	_, stopShopify := useShopifyFake(roundTripShop)
+	defer stopShopify()
+	inst, done := newTestInstance(t)
+	defer done()
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+
+	// The buyer gives their address and leaves.
+	token, _ := openCheckout(t, inst)
+	id := strings.SplitN(token, ".", 2)[0]
+	abandoned, err := getCheckoutSession(ctx, id)
+	if err != nil {
+		t.Fatalf("getCheckoutSession: %s", err)
+	}
+	abandoned.Email = fixtureBuyer
+	abandoned.advance(checkoutPlanSelected)
+	abandoned.Updated = time.Now().Add(-resumeDelay - time.Minute)
+	if err := putCheckoutSession(ctx, id, abandoned); err != nil {
+		t.Fatalf("putCheckoutSession: %s", err)
+	}
+	req := newTestRequest(t, inst, "GET", "/tasks/abandoned-checkouts", nil)
+	req.Header.Set("X-Appengine-Cron", "true")
+	w := httptest.NewRecorder()
+	if serveAbandonedCheckouts(w, req); w.Code != http.StatusOK {
+		t.Fatalf("abandoned checkouts returned %d", w.Code)
+	}
+	if abandoned, _ = getCheckoutSession(ctx, id); abandoned.ResumeSent.IsZero() {
+		t.Fatal("no resume email sent")
+	}
+
+	// They come back through the email and finish in a new session.
+	link, err := abandoned.resumeURL(ctx, id)
+	if err != nil {
+		t.Fatalf("resumeURL: %s", err)
+	}
+	resumed, plans := openCheckoutLink(t, inst, link)
+	if resumed == token {
+		t.Fatal("resume link reopened the abandoned session")
+	}
+	if w := serve(t, inst, order, "POST", "/order", url.Values{"checkout-session": {resumed}, "payment-plan": {plans[0]}}); w.Code != http.StatusFound {
+		t.Fatalf("order returned %d: %s", w.Code, w.Body)
+	}
+	for subscriptionID := range fake.Subscriptions {
+		back := approve(t, fake.URL+"/checkoutnow?token="+subscriptionID)
+		if w := serve(t, inst, thankyou, "GET", back, nil); w.Code != http.StatusOK {
+			t.Fatalf("thank-you returned %d: %s", w.Code, w.Body)
+		}
+	}
+
+	funnels, err := checkoutFunnels(ctx, Tenant{Shop: roundTripShop}, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("checkoutFunnels: %s", err)
+	}
+	if len(funnels) != 1 {
+		t.Fatalf("funnels = %+v, want one vendor", funnels)
+	}
+	if f := funnels[0]; f.Viewed != 2 || f.Approved != 1 || f.Reminded != 1 || f.Recovered != 1 {
+		t.Errorf("funnel = %+v, want 2 viewed, 1 approved, 1 reminded and recovered", f)
+	}
+}
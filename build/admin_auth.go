@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+var errNoMainTheme = errors.New("the shop has no published theme")
+
+// AdminShop is the shop an admin request was authenticated for, with a
+// Shopify client for it that belongs to this request alone.
+type AdminShop struct {
+	Domain string
+	API    *shopifyClient
+}
+
+type adminShopKey struct{}
+
+// currentShop returns the shop withShop or withSessionToken authenticated the
+// request for.
+func currentShop(r *http.Request) *AdminShop {
+	shop, _ := r.Context().Value(adminShopKey{}).(*AdminShop)
+	return shop
+}
+
+// withShop authenticates an admin page before passing it on to h. The shop is
+// taken from a request signed by Shopify, from the session token App Bridge
+// passes as id_token when it loads the app, or else from the session that an
+// earlier signed request or install logged in. A shop parameter that doesn't
+// match is rejected rather than trusted. Shops that haven't installed the app,
+// or haven't granted all the scopes it now needs, are sent to authorize it.
+func withShop(sessions SessionStore, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		params := r.URL.Query()
+		requested := params.Get("shop")
+
+		// A session that can't be loaded is treated as logged out.
+		session, err := sessions.Get(r)
+		if err != nil {
+			log.Errorf(ctx, "Get Session Error: %s", err)
+			session = newSession()
+		}
+
+		var domain string
+		if requested != "" && validShopDomain(requested) && app.AdminSignatureOk(r.URL, params.Get("state")) {
+			domain = requested
+			session.Values["current_shop"] = domain
+			if err := sessions.Save(w, r, session); err != nil {
+				log.Errorf(ctx, "Save Session Error: %s", err)
+			}
+		} else if token := params.Get("id_token"); token != "" {
+			claims, err := verifySessionToken(token, app.APIKey, app.APISecret, time.Now())
+			if err != nil {
+				log.Warningf(ctx, "Session Token Error: %s", err)
+				http.Error(w, "Unauthorized", 401)
+				return
+			}
+			domain = claims.shop()
+		} else if loggedIn := session.Values["current_shop"]; loggedIn != "" {
+			domain = loggedIn
+		} else {
+			log.Debugf(ctx, "no current_shop")
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		if requested != "" && requested != domain {
+			log.Warningf(ctx, "Request for %s authenticated as %s", requested, domain)
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		installed, err := shops.Get(ctx, domain)
+		if err != nil {
+			log.Debugf(ctx, "No access token: %s", err)
+			redirectToAuthorize(ctx, w, r, domain)
+			return
+		}
+		missing, err := checkScopes(ctx, installed)
+		if err != nil {
+			log.Errorf(ctx, "Check Scopes Error: %s", err)
+			http.Error(w, "Could not check the app's permissions", http.StatusBadGateway)
+			return
+		}
+		if len(missing) > 0 {
+			log.Infof(ctx, "%s is missing scopes %s, authorizing again", domain, strings.Join(missing, ","))
+			redirectToAuthorize(ctx, w, r, domain)
+			return
+		}
+		serveForShop(ctx, w, r, installed, h)
+	}
+}
+
+// withSessionToken authenticates a call from the embedded admin by the App
+// Bridge session token in its Authorization header, which keeps working in
+// the admin's iframe where cookies are often blocked. Calls for shops that
+// haven't installed the app are refused, as there is no page to redirect.
+func withSessionToken(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		token := bearerToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		claims, err := verifySessionToken(token, app.APIKey, app.APISecret, time.Now())
+		if err != nil {
+			log.Warningf(ctx, "Session Token Error: %s", err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		domain := claims.shop()
+		if requested := r.URL.Query().Get("shop"); requested != "" && requested != domain {
+			log.Warningf(ctx, "Request for %s authenticated as %s", requested, domain)
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		installed, err := shops.Get(ctx, domain)
+		if err != nil {
+			log.Debugf(ctx, "No access token: %s", err)
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+		serveForShop(ctx, w, r, installed, h)
+	}
+}
+
+// serveForShop passes r on to h with an AdminShop for the installed shop.
+func serveForShop(ctx context.Context, w http.ResponseWriter, r *http.Request, installed *ShopRecord, h http.HandlerFunc) {
+	shop := &AdminShop{
+		Domain: installed.Domain,
+		API:    newShopifyClient(ctx, installed.Domain, installed.Token),
+	}
+	h(w, r.WithContext(context.WithValue(r.Context(), adminShopKey{}, shop)))
+}
+
+// tenant scopes data access to the authenticated shop.
+func (s *AdminShop) tenant() Tenant {
+	return Tenant{Shop: s.Domain}
+}
+
+// mainTheme returns the ID of the shop's published theme.
+func (s *AdminShop) mainTheme() (int64, error) {
+	themes, err := s.API.themes()
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range themes {
+		if t.Role == "main" {
+			return t.ID, nil
+		}
+	}
+	return 0, errNoMainTheme
+}
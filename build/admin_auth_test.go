@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/aetest"
+)
+
+const (
+	adminShop      = "admin.myshopify.com"
+	adminOtherShop = "admin-other.myshopify.com"
+)
+
+// signAdminQuery signs params the way Shopify signs the admin's requests to
+// the app.
+func signAdminQuery(params url.Values) string {
+	mac := hmac.New(sha256.New, []byte(app.APISecret))
+	mac.Write([]byte(params.Encode()))
+	signed := url.Values{}
+	for k, v := range params {
+		signed[k] = v
+	}
+	signed.Set("hmac", hex.EncodeToString(mac.Sum(nil)))
+	return signed.Encode()
+}
+
+// installAdminShops installs both test shops with every scope the app needs
+// and returns a function that uninstalls them.
+func installAdminShops() func() {
+	for _, shop := range []string{adminShop, adminOtherShop} {
+		shops.Put(context.Background(), &ShopRecord{Domain: shop, Token: "test-token", Scopes: requiredScopes})
+	}
+	return func() {
+		for _, shop := range []string{adminShop, adminOtherShop} {
+			shops.Delete(context.Background(), shop)
+		}
+	}
+}
+
+// serveAdminRequest runs req through wrap and returns the response and the
+// shop the page was served for, or "" if it wasn't.
+func serveAdminRequest(req *http.Request, wrap func(http.HandlerFunc) http.HandlerFunc) (*httptest.ResponseRecorder, string) {
+	var served string
+	w := httptest.NewRecorder()
+	wrap(func(w http.ResponseWriter, r *http.Request) {
+		served = currentShop(r).Domain
+	})(w, req)
+	return w, served
+}
+
+func TestWithShop(t *testing.T) {
+	inst, done := newTestInstance(t)
+	defer done()
+	defer installAdminShops()()
+	store, err := newSessionStore("memory", [][]byte{[]byte("test-secret")})
+	if err != nil {
+		t.Fatalf("newSessionStore: %s", err)
+	}
+	withStore := func(h http.HandlerFunc) http.HandlerFunc { return withShop(store, h) }
+	loggedIn := saveTestSession(t, inst, store, adminShop)
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		query  string
+		cookie *http.Cookie
+		code   int
+		shop   string
+	}{
+		{"signed request", signAdminQuery(url.Values{"shop": {adminShop}, "timestamp": {"1700000000"}}), nil, http.StatusOK, adminShop},
+		{"forged signature", "shop=" + adminShop + "&timestamp=1700000000&hmac=" + hex.EncodeToString(make([]byte, 32)), nil, http.StatusUnauthorized, ""},
+		{"signature for other parameters", func() string {
+			q, _ := url.ParseQuery(signAdminQuery(url.Values{"shop": {adminShop}, "timestamp": {"1700000000"}}))
+			q.Set("shop", adminOtherShop)
+			return q.Encode()
+		}(), loggedIn, http.StatusUnauthorized, ""},
+		{"session", "", loggedIn, http.StatusOK, adminShop},
+		{"session for the requested shop", "shop=" + adminShop, loggedIn, http.StatusOK, adminShop},
+		{"session for another shop", "shop=" + adminOtherShop, loggedIn, http.StatusUnauthorized, ""},
+		{"no session", "", nil, http.StatusUnauthorized, ""},
+		{"no session for the requested shop", "shop=" + adminShop, nil, http.StatusUnauthorized, ""},
+		{"session token", "id_token=" + signSessionToken(t, "HS256", testSessionClaims(adminShop, now), app.APISecret), nil, http.StatusOK, adminShop},
+		{"session token for another shop", "shop=" + adminOtherShop + "&id_token=" + signSessionToken(t, "HS256", testSessionClaims(adminShop, now), app.APISecret), loggedIn, http.StatusUnauthorized, ""},
+		{"forged session token", "id_token=" + signSessionToken(t, "HS256", testSessionClaims(adminShop, now), "forged"), loggedIn, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		req := newTestRequest(t, inst, "GET", "/admin?"+tt.query, nil)
+		if tt.cookie != nil {
+			req.AddCookie(tt.cookie)
+		}
+		w, served := serveAdminRequest(req, withStore)
+		if w.Code != tt.code || served != tt.shop {
+			t.Errorf("%s: returned %d for %q, want %d for %q", tt.name, w.Code, served, tt.code, tt.shop)
+		}
+	}
+
+	// A signed request logs the shop in for the requests that follow it.
+	req := newTestRequest(t, inst, "GET", "/admin?"+signAdminQuery(url.Values{"shop": {adminOtherShop}}), nil)
+	w, _ := serveAdminRequest(req, withStore)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || loadTestSession(t, inst, store, cookies[0]) != adminOtherShop {
+		t.Errorf("signed request set cookies %v, want a session for %s", cookies, adminOtherShop)
+	}
+}
+
+func TestWithShopAuthorizes(t *testing.T) {
+	inst, done := newTestInstance(t)
+	defer done()
+	store, _ := newSessionStore("memory", [][]byte{[]byte("test-secret")})
+	withStore := func(h http.HandlerFunc) http.HandlerFunc { return withShop(store, h) }
+	shops.Put(context.Background(), &ShopRecord{Domain: adminShop, Token: "test-token", Scopes: []string{"read_themes", "read_products"}})
+	defer shops.Delete(context.Background(), adminShop)
+
+	for _, shop := range []string{adminShop, "not-installed.myshopify.com"} {
+		req := newTestRequest(t, inst, "GET", "/admin?"+signAdminQuery(url.Values{"shop": {shop}}), nil)
+		w, served := serveAdminRequest(req, withStore)
+		if w.Code != http.StatusFound || served != "" {
+			t.Errorf("%s: returned %d for %q, want a redirect to authorize", shop, w.Code, served)
+		}
+	}
+}
+
+func sessionTokenRequest(t *testing.T, inst aetest.Instance, query string, token string) *http.Request {
+	req := newTestRequest(t, inst, "GET", "/vendorConfig?"+query, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+func TestWithSessionToken(t *testing.T) {
+	inst, done := newTestInstance(t)
+	defer done()
+	defer installAdminShops()()
+	now := time.Now()
+	valid := signSessionToken(t, "HS256", testSessionClaims(adminShop, now), app.APISecret)
+
+	tests := []struct {
+		name  string
+		query string
+		token string
+		code  int
+		shop  string
+		// challenge is whether App Bridge is asked for a new token.
+		challenge bool
+	}{
+		{"valid", "", valid, http.StatusOK, adminShop, false},
+		{"valid for the requested shop", "shop=" + adminShop, valid, http.StatusOK, adminShop, false},
+		{"for another shop", "shop=" + adminOtherShop, valid, http.StatusUnauthorized, "", false},
+		{"no token", "", "", http.StatusUnauthorized, "", true},
+		{"forged", "", signSessionToken(t, "HS256", testSessionClaims(adminShop, now), "forged"), http.StatusUnauthorized, "", true},
+		{"expired", "", signSessionToken(t, "HS256", testSessionClaims(adminShop, now.Add(-time.Hour)), app.APISecret), http.StatusUnauthorized, "", true},
+		{"not installed", "", signSessionToken(t, "HS256", testSessionClaims("not-installed.myshopify.com", now), app.APISecret), http.StatusUnauthorized, "", false},
+	}
+	for _, tt := range tests {
+		w, served := serveAdminRequest(sessionTokenRequest(t, inst, tt.query, tt.token), withSessionToken)
+		if w.Code != tt.code || served != tt.shop {
+			t.Errorf("%s: returned %d for %q, want %d for %q", tt.name, w.Code, served, tt.code, tt.shop)
+		}
+		if got := w.Header().Get("WWW-Authenticate") != ""; got != tt.challenge {
+			t.Errorf("%s: WWW-Authenticate challenge %v, want %v", tt.name, got, tt.challenge)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// eventDateNamespace and eventDateKey name the product metafield that holds
+// the date of the event a ticket is for.
+const (
+	eventDateNamespace = "tixpire"
+	eventDateKey       = "event_date"
+)
+
+var errCartUnavailable = errors.New("This item is no longer available.")
+
+type shopifyVariant struct {
+	ID        int64  `json:"id"`
+	ProductID int64  `json:"product_id"`
+	Title     string `json:"title"`
+	Price     string `json:"price"`
+}
+
+type shopifyProduct struct {
+	ID     int64  `json:"id"`
+	Title  string `json:"title"`
+	Vendor string `json:"vendor"`
+}
+
+type shopifyMetafield struct {
+	Namespace string      `json:"namespace"`
+	Key       string      `json:"key"`
+	Value     interface{} `json:"value"`
+}
+
+// resolveCart looks up the product, variant and event date in the shop's
+// catalogue and returns the checkout request for qty of the variant. Only
+// the IDs come from the buyer; titles and prices are always Shopify's.
+func resolveCart(ctx context.Context, t Tenant, productID int64, variantID int64, qty int) (*CheckoutRequest, error) {
+	var variant struct {
+		Variant shopifyVariant `json:"variant"`
+	}
+	if err := t.shopifyGet(ctx, "/variants/"+strconv.FormatInt(variantID, 10)+".json", &variant); err != nil {
+		return nil, err
+	}
+	if variant.Variant.ProductID != productID {
+		return nil, errCartUnavailable
+	}
+
+	var product struct {
+		Product shopifyProduct `json:"product"`
+	}
+	if err := t.shopifyGet(ctx, "/products/"+strconv.FormatInt(productID, 10)+".json", &product); err != nil {
+		return nil, err
+	}
+
+	var metafields struct {
+		Metafields []shopifyMetafield `json:"metafields"`
+	}
+	path := "/products/" + strconv.FormatInt(productID, 10) + "/metafields.json?namespace=" + eventDateNamespace + "&key=" + eventDateKey
+	if err := t.shopifyGet(ctx, path, &metafields); err != nil {
+		return nil, err
+	}
+	var date string
+	for _, m := range metafields.Metafields {
+		if m.Namespace == eventDateNamespace && m.Key == eventDateKey {
+			date = fmt.Sprint(m.Value)
+		}
+	}
+
+	var store struct {
+		Shop struct {
+			Currency string `json:"currency"`
+		} `json:"shop"`
+	}
+	if err := t.shopifyGet(ctx, "/shop.json", &store); err != nil {
+		return nil, err
+	}
+
+	price, err := strconv.ParseFloat(variant.Variant.Price, 64)
+	if err != nil {
+		return nil, errCartUnavailable
+	}
+	q := url.Values{}
+	q.Set("vendor", product.Product.Vendor)
+	q.Set("event", product.Product.Title)
+	q.Set("variant", variant.Variant.Title)
+	q.Set("date", date)
+	q.Set("qty", strconv.Itoa(qty))
+	q.Set("total", strconv.FormatFloat(price*float64(qty), 'f', -1, 64))
+	q.Set("currency", store.Shop.Currency)
+	q.Set("product-id", strconv.FormatInt(productID, 10))
+	q.Set("variant-id", strconv.FormatInt(variantID, 10))
+	return parseCheckoutRequest(q, time.Now())
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxCheckoutQty is the most tickets a single checkout may be for.
+	maxCheckoutQty = 50
+	// maxCheckoutField is the longest vendor, event or variant name accepted.
+	maxCheckoutField = 255
+	// checkoutDateLayout is how event dates are written back into links and
+	// stored on sessions and orders.
+	checkoutDateLayout = "2006-01-02"
+)
+
+// CheckoutRequest is what a buyer is checking out: one variant of an event,
+// a quantity and the total for them. It is only ever built by
+// parseCheckoutRequest, so every field has been validated.
+type CheckoutRequest struct {
+	Vendor    string
+	Event     string
+	Variant   string
+	Date      time.Time // zero when the event has no date
+	Qty       int
+	Total     float64
+	Currency  Currency
+	ProductID int64
+	VariantID int64
+}
+
+// checkoutFieldError says which field of a checkout request was rejected.
+type checkoutFieldError struct {
+	Field   string
+	Problem string
+}
+
+func (e *checkoutFieldError) Error() string {
+	return "checkout: invalid " + e.Field + ": " + e.Problem
+}
+
+// parseCheckoutRequest decodes and validates a checkout from its query
+// parameters. now is used to resolve dates written without a year and to
+// reject events that have already happened.
+func parseCheckoutRequest(q url.Values, now time.Time) (*CheckoutRequest, error) {
+	req := &CheckoutRequest{}
+	var err error
+
+	if req.Vendor, err = checkoutName(q, "vendor", true); err != nil {
+		return nil, err
+	}
+	if req.Event, err = checkoutName(q, "event", true); err != nil {
+		return nil, err
+	}
+	if req.Variant, err = checkoutName(q, "variant", false); err != nil {
+		return nil, err
+	}
+	// Shopify names the only variant of a product "Default Title".
+	if req.Variant == "Default Title" {
+		req.Variant = ""
+	}
+
+	if req.Date, err = parseCheckoutDate(q.Get("date"), now); err != nil {
+		return nil, err
+	}
+
+	qty, err := strconv.Atoi(q.Get("qty"))
+	if err != nil {
+		return nil, &checkoutFieldError{"qty", "not a whole number"}
+	}
+	if qty < 1 || qty > maxCheckoutQty {
+		return nil, &checkoutFieldError{"qty", "must be between 1 and " + strconv.Itoa(maxCheckoutQty)}
+	}
+	req.Qty = qty
+
+	code := strings.ToUpper(strings.TrimSpace(q.Get("currency")))
+	cur, err := lookupCurrency(code)
+	if err != nil {
+		return nil, &checkoutFieldError{"currency", code + " is not supported"}
+	}
+	req.Currency = cur
+
+	total, err := strconv.ParseFloat(q.Get("total"), 64)
+	if err != nil || math.IsNaN(total) || math.IsInf(total, 0) {
+		return nil, &checkoutFieldError{"total", "not a number"}
+	}
+	if total = cur.round(total); total <= 0 {
+		return nil, &checkoutFieldError{"total", "must be more than zero"}
+	}
+	req.Total = total
+
+	if req.ProductID, err = checkoutID(q, "product-id"); err != nil {
+		return nil, err
+	}
+	if req.VariantID, err = checkoutID(q, "variant-id"); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func checkoutName(q url.Values, field string, required bool) (string, error) {
+	v := strings.TrimSpace(q.Get(field))
+	if v == "" && required {
+		return "", &checkoutFieldError{field, "missing"}
+	}
+	if len(v) > maxCheckoutField {
+		return "", &checkoutFieldError{field, "too long"}
+	}
+	if strings.ContainsRune(v, '�') || strings.ContainsAny(v, "\x00\r\n") {
+		return "", &checkoutFieldError{field, "contains invalid characters"}
+	}
+	return v, nil
+}
+
+func checkoutID(q url.Values, field string) (int64, error) {
+	v := q.Get(field)
+	if v == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, &checkoutFieldError{field, "not a valid ID"}
+	}
+	return id, nil
+}
+
+// parseCheckoutDate accepts the date formats vendors use for events. Dates
+// without a year are taken to be the next time that day comes round.
+func parseCheckoutDate(v string, now time.Time) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	if v == "" || strings.EqualFold(v, "none") {
+		return time.Time{}, nil
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	for _, layout := range []string{checkoutDateLayout, "January 2, 2006", "2006 January 2"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			if t.Before(today) {
+				return time.Time{}, &checkoutFieldError{"date", "the event has already happened"}
+			}
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"January 2", "Jan 2"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			t = t.AddDate(today.Year(), 0, 0)
+			if t.Before(today) {
+				t = t.AddDate(1, 0, 0)
+			}
+			return t, nil
+		}
+	}
+	return time.Time{}, &checkoutFieldError{"date", "unrecognised date " + strconv.Quote(v)}
+}
+
+// dateString is the event date as it is written into links and stored, or ""
+// when the event has no date.
+func (req *CheckoutRequest) dateString() string {
+	if req.Date.IsZero() {
+		return ""
+	}
+	return req.Date.Format(checkoutDateLayout)
+}
+
+// values encodes req so that parseCheckoutRequest reads it back unchanged.
+func (req *CheckoutRequest) values() url.Values {
+	q := url.Values{}
+	q.Set("vendor", req.Vendor)
+	q.Set("event", req.Event)
+	q.Set("variant", req.Variant)
+	q.Set("date", req.dateString())
+	q.Set("qty", strconv.Itoa(req.Qty))
+	q.Set("total", req.Currency.value(req.Total))
+	q.Set("currency", req.Currency.Code)
+	if req.ProductID != 0 {
+		q.Set("product-id", strconv.FormatInt(req.ProductID, 10))
+	}
+	if req.VariantID != 0 {
+		q.Set("variant-id", strconv.FormatInt(req.VariantID, 10))
+	}
+	return q
+}
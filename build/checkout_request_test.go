@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCheckoutRequest(t *testing.T) {
+	now := time.Date(2026, 10, 19, 15, 0, 0, 0, time.UTC)
+	valid := func() url.Values {
+		return url.Values{
+			"vendor":     {"Vendor"},
+			"event":      {"Event"},
+			"variant":    {"General"},
+			"date":       {"2026-12-31"},
+			"qty":        {"2"},
+			"total":      {"125.00"},
+			"currency":   {"USD"},
+			"product-id": {"100"},
+			"variant-id": {"200"},
+		}
+	}
+
+	tests := []struct {
+		name  string
+		set   map[string]string
+		field string // the field rejected, or "" if the request is valid
+		check func(t *testing.T, req *CheckoutRequest)
+	}{
+		{name: "valid", check: func(t *testing.T, req *CheckoutRequest) {
+			want := &CheckoutRequest{
+				Vendor:    "Vendor",
+				Event:     "Event",
+				Variant:   "General",
+				Date:      time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC),
+				Qty:       2,
+				Total:     125,
+				Currency:  currencies["USD"],
+				ProductID: 100,
+				VariantID: 200,
+			}
+			if !reflect.DeepEqual(req, want) {
+				t.Errorf("got %+v, want %+v", req, want)
+			}
+		}},
+
+		{name: "vendor missing", set: map[string]string{"vendor": ""}, field: "vendor"},
+		{name: "vendor blank", set: map[string]string{"vendor": "   "}, field: "vendor"},
+		{name: "vendor too long", set: map[string]string{"vendor": strings.Repeat("v", maxCheckoutField+1)}, field: "vendor"},
+		{name: "vendor with newline", set: map[string]string{"vendor": "Ven\ndor"}, field: "vendor"},
+		{name: "vendor trimmed", set: map[string]string{"vendor": "  Vendor  "}, check: func(t *testing.T, req *CheckoutRequest) {
+			if req.Vendor != "Vendor" {
+				t.Errorf("vendor = %q", req.Vendor)
+			}
+		}},
+
+		{name: "event missing", set: map[string]string{"event": ""}, field: "event"},
+		{name: "event too long", set: map[string]string{"event": strings.Repeat("e", maxCheckoutField+1)}, field: "event"},
+		{name: "event with NUL", set: map[string]string{"event": "Ev\x00ent"}, field: "event"},
+		{name: "event with replacement character", set: map[string]string{"event": "Ev�ent"}, field: "event"},
+		{name: "event at the length limit", set: map[string]string{"event": strings.Repeat("e", maxCheckoutField)}},
+
+		{name: "variant optional", set: map[string]string{"variant": ""}},
+		{name: "variant Default Title", set: map[string]string{"variant": "Default Title"}, check: func(t *testing.T, req *CheckoutRequest) {
+			if req.Variant != "" {
+				t.Errorf("variant = %q, want none", req.Variant)
+			}
+		}},
+		{name: "variant with carriage return", set: map[string]string{"variant": "V\rIP"}, field: "variant"},
+		{name: "variant too long", set: map[string]string{"variant": strings.Repeat("x", maxCheckoutField+1)}, field: "variant"},
+
+		{name: "date none", set: map[string]string{"date": "None"}, check: func(t *testing.T, req *CheckoutRequest) {
+			if !req.Date.IsZero() || req.dateString() != "" {
+				t.Errorf("date = %s, want none", req.Date)
+			}
+		}},
+		{name: "date empty", set: map[string]string{"date": ""}},
+		{name: "date long form", set: map[string]string{"date": "December 31, 2026"}},
+		{name: "date year first", set: map[string]string{"date": "2026 December 31"}},
+		{name: "date today", set: map[string]string{"date": "2026-10-19"}},
+		{name: "date past", set: map[string]string{"date": "2026-10-18"}, field: "date"},
+		{name: "date without year later this year", set: map[string]string{"date": "Dec 31"}, check: func(t *testing.T, req *CheckoutRequest) {
+			if got := req.dateString(); got != "2026-12-31" {
+				t.Errorf("date = %s, want 2026-12-31", got)
+			}
+		}},
+		{name: "date without year rolls over", set: map[string]string{"date": "January 5"}, check: func(t *testing.T, req *CheckoutRequest) {
+			if got := req.dateString(); got != "2027-01-05" {
+				t.Errorf("date = %s, want 2027-01-05", got)
+			}
+		}},
+		{name: "date unrecognised", set: map[string]string{"date": "31/12/2026"}, field: "date"},
+
+		{name: "qty missing", set: map[string]string{"qty": ""}, field: "qty"},
+		{name: "qty fraction", set: map[string]string{"qty": "1.5"}, field: "qty"},
+		{name: "qty zero", set: map[string]string{"qty": "0"}, field: "qty"},
+		{name: "qty negative", set: map[string]string{"qty": "-1"}, field: "qty"},
+		{name: "qty at the limit", set: map[string]string{"qty": "50"}},
+		{name: "qty over the limit", set: map[string]string{"qty": "51"}, field: "qty"},
+
+		{name: "currency defaults to USD", set: map[string]string{"currency": ""}, check: func(t *testing.T, req *CheckoutRequest) {
+			if req.Currency.Code != "USD" {
+				t.Errorf("currency = %s", req.Currency.Code)
+			}
+		}},
+		{name: "currency lower case", set: map[string]string{"currency": " eur "}, check: func(t *testing.T, req *CheckoutRequest) {
+			if req.Currency.Code != "EUR" {
+				t.Errorf("currency = %s", req.Currency.Code)
+			}
+		}},
+		{name: "currency unknown", set: map[string]string{"currency": "XYZ"}, field: "currency"},
+
+		{name: "total missing", set: map[string]string{"total": ""}, field: "total"},
+		{name: "total not a number", set: map[string]string{"total": "ten"}, field: "total"},
+		{name: "total NaN", set: map[string]string{"total": "NaN"}, field: "total"},
+		{name: "total infinite", set: map[string]string{"total": "Inf"}, field: "total"},
+		{name: "total zero", set: map[string]string{"total": "0"}, field: "total"},
+		{name: "total negative", set: map[string]string{"total": "-5"}, field: "total"},
+		{name: "total rounds to zero", set: map[string]string{"total": "0.004"}, field: "total"},
+		{name: "total rounded to cents", set: map[string]string{"total": "10.005"}, check: func(t *testing.T, req *CheckoutRequest) {
+			if req.Total != 10.01 {
+				t.Errorf("total = %v, want 10.01", req.Total)
+			}
+		}},
+		{name: "total rounded to whole yen", set: map[string]string{"total": "1250.4", "currency": "JPY"}, check: func(t *testing.T, req *CheckoutRequest) {
+			if req.Total != 1250 {
+				t.Errorf("total = %v, want 1250", req.Total)
+			}
+		}},
+
+		{name: "product ID optional", set: map[string]string{"product-id": ""}},
+		{name: "product ID not a number", set: map[string]string{"product-id": "abc"}, field: "product-id"},
+		{name: "product ID zero", set: map[string]string{"product-id": "0"}, field: "product-id"},
+		{name: "product ID negative", set: map[string]string{"product-id": "-100"}, field: "product-id"},
+		{name: "variant ID optional", set: map[string]string{"variant-id": ""}},
+		{name: "variant ID not a number", set: map[string]string{"variant-id": "1e3"}, field: "variant-id"},
+		{name: "variant ID zero", set: map[string]string{"variant-id": "0"}, field: "variant-id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := valid()
+			for k, v := range tt.set {
+				q.Set(k, v)
+			}
+			req, err := parseCheckoutRequest(q, now)
+			if tt.field != "" {
+				fe, ok := err.(*checkoutFieldError)
+				if !ok || fe.Field != tt.field {
+					t.Fatalf("error = %v, want one for %s", err, tt.field)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCheckoutRequest: %s", err)
+			}
+			if tt.check != nil {
+				tt.check(t, req)
+			}
+			// Links and sessions carry the request as values, which must
+			// read back the same.
+			again, err := parseCheckoutRequest(req.values(), now)
+			if err != nil || !reflect.DeepEqual(again, req) {
+				t.Errorf("values() read back as %+v, %v; want %+v", again, err, req)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+const checkoutSessionTTL = 2 * time.Hour
+
+var (
+	errSessionInvalid  = errors.New("This checkout could not be verified. Please start again from the store.")
+	errSessionExpired  = errors.New("This checkout has expired. Please start again from the store.")
+	errPlanMismatch    = errors.New("The selected payment plan does not belong to this checkout.")
+	errPaymentMismatch = errors.New("Your payment does not match this checkout. Please contact the store.")
+)
+
+// CheckoutSession is the server's copy of what a buyer was offered on the
+// checkout page. The order form only carries a signed reference to it, so the
+// plan that gets charged is always one we created for this cart. ResumedFrom
+// is the session whose resume email the buyer followed to start this one.
+type CheckoutSession struct {
+	Shop           string
+	Vendor         string
+	Event          string
+	Variant        string
+	Date           string
+	TotalDue       string
+	Qty            string
+	Currency       string
+	ProductID      int64
+	VariantID      int64
+	Plans          []byte `datastore:",noindex"`
+	CheckoutURL    string `datastore:",noindex"`
+	PlanID         string
+	SubscriptionID string
+	PaymentID      string
+	State          string
+	Email          string
+	ResumeSent     time.Time
+	ResumedFrom    string
+	Created        time.Time
+	Updated        time.Time
+	Expires        time.Time
+}
+
+func newCheckoutSession(shop string, req *CheckoutRequest, plans []PaymentSchedule) (*CheckoutSession, error) {
+	encoded, err := json.Marshal(plans)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &CheckoutSession{
+		Shop:      shop,
+		Vendor:    req.Vendor,
+		Event:     req.Event,
+		Variant:   req.Variant,
+		Date:      req.dateString(),
+		TotalDue:  req.Currency.value(req.Total),
+		Qty:       strconv.Itoa(req.Qty),
+		Currency:  req.Currency.Code,
+		ProductID: req.ProductID,
+		VariantID: req.VariantID,
+		Plans:     encoded,
+		State:     checkoutViewed,
+		Created:   now,
+		Updated:   now,
+		Expires:   now.Add(checkoutSessionTTL),
+	}, nil
+}
+
+// request rebuilds the checkout request the session was created from.
+func (s *CheckoutSession) request() (*CheckoutRequest, error) {
+	q := url.Values{}
+	q.Set("vendor", s.Vendor)
+	q.Set("event", s.Event)
+	q.Set("variant", s.Variant)
+	q.Set("date", s.Date)
+	q.Set("qty", s.Qty)
+	q.Set("total", s.TotalDue)
+	q.Set("currency", s.Currency)
+	if s.ProductID != 0 {
+		q.Set("product-id", strconv.FormatInt(s.ProductID, 10))
+	}
+	if s.VariantID != 0 {
+		q.Set("variant-id", strconv.FormatInt(s.VariantID, 10))
+	}
+	return parseCheckoutRequest(q, s.Created)
+}
+
+// checkPayment makes sure p is the payment this checkout started and that it
+// paid the amount due in the checkout's currency.
+func (s *CheckoutSession) checkPayment(p payInFullPayment) error {
+	if s.PaymentID == "" || p.ID != s.PaymentID {
+		return fmt.Errorf("checkout started payment %q", s.PaymentID)
+	}
+	want, err := lookupCurrency(s.Currency)
+	if err != nil {
+		return err
+	}
+	got, err := lookupCurrency(p.Currency)
+	if err != nil {
+		return err
+	}
+	if got.Code != want.Code {
+		return fmt.Errorf("paid in %s, want %s", got.Code, want.Code)
+	}
+	paid, err := strconv.ParseFloat(p.Amount, 64)
+	if err != nil {
+		return fmt.Errorf("paid amount %q: %s", p.Amount, err)
+	}
+	due, err := strconv.ParseFloat(s.TotalDue, 64)
+	if err != nil {
+		return err
+	}
+	if want.value(paid) != want.value(due) {
+		return fmt.Errorf("paid %s, want %s", want.value(paid), want.value(due))
+	}
+	return nil
+}
+
+// payInFull is the plan value the checkout form posts for a single payment.
+const payInFull = "pay-in-full"
+
+// plan returns the offered plan with the given PayPal plan ID.
+func (s *CheckoutSession) plan(id string) (*PaymentSchedule, error) {
+	var plans []PaymentSchedule
+	if err := json.Unmarshal(s.Plans, &plans); err != nil {
+		return nil, err
+	}
+	for i := range plans {
+		if id != "" && plans[i].ID == id {
+			return &plans[i], nil
+		}
+	}
+	return nil, errPlanMismatch
+}
+
+func checkoutSessionKey(ctx context.Context, id string) *datastore.Key {
+	return datastore.NewKey(ctx, "CheckoutSession", id, 0, nil)
+}
+
+// saveCheckoutSession stores s under a new random ID and returns the signed
+// token to embed in the order form.
+func saveCheckoutSession(ctx context.Context, s *CheckoutSession) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	secrets := sessionSecrets()
+	if len(secrets) == 0 {
+		return "", errNoSessionSecret
+	}
+	if _, err := datastore.Put(ctx, checkoutSessionKey(ctx, id), s); err != nil {
+		return "", err
+	}
+	return id + "." + signCheckoutSession(secrets[0], id), nil
+}
+
+// loadCheckoutSession verifies token and returns the session it refers to.
+func loadCheckoutSession(ctx context.Context, token string) (string, *CheckoutSession, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return "", nil, errSessionInvalid
+	}
+	signed := false
+	for _, secret := range sessionSecrets() {
+		if hmac.Equal([]byte(parts[1]), []byte(signCheckoutSession(secret, parts[0]))) {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return "", nil, errSessionInvalid
+	}
+	s, err := getCheckoutSession(ctx, parts[0])
+	if err == datastore.ErrNoSuchEntity {
+		return "", nil, errSessionInvalid
+	} else if err != nil {
+		return "", nil, err
+	}
+	if time.Now().After(s.Expires) {
+		return "", nil, errSessionExpired
+	}
+	return parts[0], s, nil
+}
+
+func getCheckoutSession(ctx context.Context, id string) (*CheckoutSession, error) {
+	var s CheckoutSession
+	if err := datastore.Get(ctx, checkoutSessionKey(ctx, id), &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func putCheckoutSession(ctx context.Context, id string, s *CheckoutSession) error {
+	_, err := datastore.Put(ctx, checkoutSessionKey(ctx, id), s)
+	return err
+}
+
+// checkoutSessionForSubscription finds the session a PayPal subscription was
+// created from.
+func checkoutSessionForSubscription(ctx context.Context, subscriptionID string) (*CheckoutSession, error) {
+	var sessions []CheckoutSession
+	q := datastore.NewQuery("CheckoutSession").Filter("SubscriptionID =", subscriptionID).Limit(1)
+	if _, err := q.GetAll(ctx, &sessions); err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	return &sessions[0], nil
+}
+
+func signCheckoutSession(secret []byte, id string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("checkout-session:" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
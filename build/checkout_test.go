@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+const roundTripShop = "roundtrip.myshopify.com"
+
+var (
+	sessionField = regexp.MustCompile(`name="checkout-session" value="([^"]+)"`)
+	planField    = regexp.MustCompile(`name="payment-plan" value="([^"]+)"`)
+)
+
+// serve runs handler on a request to target, which may be a full app URL.
+func serve(t *testing.T, inst aetest.Instance, handler http.HandlerFunc, method string, target string, form url.Values) *httptest.ResponseRecorder {
+	target = strings.TrimPrefix(target, appURL)
+	var req *http.Request
+	if form != nil {
+		req = newTestRequest(t, inst, method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req = newTestRequest(t, inst, method, target, nil)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+// approve opens a PayPal approval link on the fake and returns where PayPal
+// sends the buyer back to.
+func approve(t *testing.T, link string) string {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(link)
+	if err != nil {
+		t.Fatalf("approve: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("approve returned %d", resp.StatusCode)
+	}
+	return resp.Header.Get("Location")
+}
+
+// openCheckout follows a storefront checkout link for one General ticket and
+// returns the checkout session token and the plans offered.
+func openCheckout(t *testing.T, inst aetest.Instance) (string, []string) {
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+	vendor := vendorSlug(ctx, roundTripShop)
+	segment, err := signLink(ctx, linkCheckout, vendor, url.Values{"product": {"100"}, "variant": {"200"}, "qty": {"1"}})
+	if err != nil {
+		t.Fatalf("signLink: %s", err)
+	}
+	return openCheckoutLink(t, inst, "/checkout/"+vendor+"/"+segment)
+}
+
+// openCheckoutLink opens a signed checkout link and returns the checkout
+// session token and the plans offered.
+func openCheckoutLink(t *testing.T, inst aetest.Instance, link string) (string, []string) {
+	w := serve(t, inst, checkout, "GET", link, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("checkout returned %d: %s", w.Code, w.Body)
+	}
+	session := sessionField.FindStringSubmatch(w.Body.String())
+	if session == nil {
+		t.Fatalf("checkout page has no session: %s", w.Body)
+	}
+	var plans []string
+	for _, m := range planField.FindAllStringSubmatch(w.Body.String(), -1) {
+		plans = append(plans, m[1])
+	}
+	return session[1], plans
+}
+
+func TestCheckoutRoundTrip(t *testing.T) {
+	fake, stopPayPal := usePayPalFake()
+	defer stopPayPal()
+	shop, stopShopify := useShopifyFake(roundTripShop)
+	defer stopShopify()
+	inst, done := newTestInstance(t)
+	defer done()
+
+	session, plans := openCheckout(t, inst)
+	if len(plans) < 2 || plans[0] == payInFull {
+		t.Fatalf("checkout offered %v, want installment plans and pay in full", plans)
+	}
+
+	w := serve(t, inst, order, "POST", "/order", url.Values{"checkout-session": {session}, "payment-plan": {plans[0]}})
+	if w.Code != http.StatusFound {
+		t.Fatalf("order returned %d: %s", w.Code, w.Body)
+	}
+	if got := shop.available(); got != 9 {
+		t.Errorf("stock after order = %d, want 9 held", got)
+	}
+	var sub *struct{ ID, ReturnURL string }
+	for id, s := range fake.Subscriptions {
+		sub = &struct{ ID, ReturnURL string }{id, s.ReturnURL}
+	}
+	if sub == nil {
+		t.Fatal("no subscription was created")
+	}
+
+	// Coming back without approving must not create the order.
+	w = serve(t, inst, thankyou, "GET", sub.ReturnURL+"?subscription_id="+sub.ID, nil)
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("unapproved thank-you returned %d, want %d", w.Code, http.StatusPaymentRequired)
+	}
+
+	back := approve(t, fake.URL+"/checkoutnow?token="+sub.ID)
+	w = serve(t, inst, thankyou, "GET", back, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("thank-you returned %d: %s", w.Code, w.Body)
+	}
+
+	o := loadTestOrder(t, inst, sub.ID)
+	if o.Shop != roundTripShop || o.Currency != "USD" || o.VariantID != 200 || o.Status != orderActive {
+		t.Errorf("order = %s %s variant %d %s", o.Shop, o.Currency, o.VariantID, o.Status)
+	}
+	if len(shop.Orders) != 1 {
+		t.Fatalf("Shopify got %d orders, want 1", len(shop.Orders))
+	}
+	if got := shop.Orders[0].InventoryBehaviour; got != "bypass" {
+		t.Errorf("Shopify order inventory behaviour = %s, want bypass since the stock is held", got)
+	}
+
+	// Reloading the thank-you page changes nothing.
+	if w = serve(t, inst, thankyou, "GET", back, nil); w.Code != http.StatusOK {
+		t.Fatalf("second thank-you returned %d", w.Code)
+	}
+	if len(shop.Orders) != 1 || shop.available() != 9 {
+		t.Errorf("reload made %d Shopify orders and left %d in stock", len(shop.Orders), shop.available())
+	}
+}
+
+func TestThankYouWithoutCheckoutSession(t *testing.T) {
+	fake, stopPayPal := usePayPalFake()
+	defer stopPayPal()
+	shop, stopShopify := useShopifyFake(roundTripShop)
+	defer stopShopify()
+	inst, done := newTestInstance(t)
+	defer done()
+
+	session, plans := openCheckout(t, inst)
+	if w := serve(t, inst, order, "POST", "/order", url.Values{"checkout-session": {session}, "payment-plan": {plans[0]}}); w.Code != http.StatusFound {
+		t.Fatalf("order returned %d: %s", w.Code, w.Body)
+	}
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+	if err := datastore.Delete(ctx, checkoutSessionKey(ctx, strings.SplitN(session, ".", 2)[0])); err != nil {
+		t.Fatalf("delete checkout session: %s", err)
+	}
+
+	if len(fake.Subscriptions) != 1 {
+		t.Fatalf("%d subscriptions were created, want 1", len(fake.Subscriptions))
+	}
+	for id := range fake.Subscriptions {
+		back := approve(t, fake.URL+"/checkoutnow?token="+id)
+		if w := serve(t, inst, thankyou, "GET", back, nil); w.Code != http.StatusNotFound {
+			t.Errorf("thank-you returned %d, want %d", w.Code, http.StatusNotFound)
+		}
+		if _, err := getOrder(ctx, id); err != datastore.ErrNoSuchEntity {
+			t.Errorf("order created from the return link: %v", err)
+		}
+	}
+	if len(shop.Orders) != 0 {
+		t.Errorf("Shopify got %d orders, want none", len(shop.Orders))
+	}
+}
+
+func TestCheckoutRoundTripPayInFull(t *testing.T) {
+	fake, stopPayPal := usePayPalFake()
+	defer stopPayPal()
+	shop, stopShopify := useShopifyFake(roundTripShop)
+	defer stopShopify()
+	inst, done := newTestInstance(t)
+	defer done()
+
+	session, _ := openCheckout(t, inst)
+	w := serve(t, inst, order, "POST", "/order", url.Values{"checkout-session": {session}, "payment-plan": {payInFull}})
+	if w.Code != http.StatusFound {
+		t.Fatalf("order returned %d: %s", w.Code, w.Body)
+	}
+	back := approve(t, w.Header().Get("Location"))
+	w = serve(t, inst, thankyou, "GET", back, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("thank-you returned %d: %s", w.Code, w.Body)
+	}
+
+	if len(fake.Orders) != 1 {
+		t.Fatalf("PayPal has %d orders, want 1", len(fake.Orders))
+	}
+	for id, paid := range fake.Orders {
+		if paid.Status != "COMPLETED" || paid.Amount.Value != "62.50" {
+			t.Errorf("PayPal order = %s for %s, want COMPLETED for 62.50", paid.Status, paid.Amount.Value)
+		}
+		o := loadTestOrder(t, inst, id)
+		if !o.PayInFull || o.Status != orderCompleted {
+			t.Errorf("order pay in full %v status %s, want completed", o.PayInFull, o.Status)
+		}
+	}
+	if len(shop.Orders) != 1 || shop.Orders[0].FinancialStatus != "paid" {
+		t.Errorf("Shopify got %+v, want one paid order", shop.Orders)
+	}
+}
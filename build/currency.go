@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Currency describes how amounts in a store currency are rounded, sent to the
+// payment provider and shown to buyers.
+type Currency struct {
+	Code       string
+	MinorUnits int
+	Symbol     string
+}
+
+var currencies = map[string]Currency{
+	"USD": Currency{Code: "USD", MinorUnits: 2, Symbol: "$"},
+	"CAD": Currency{Code: "CAD", MinorUnits: 2, Symbol: "CA$"},
+	"AUD": Currency{Code: "AUD", MinorUnits: 2, Symbol: "A$"},
+	"NZD": Currency{Code: "NZD", MinorUnits: 2, Symbol: "NZ$"},
+	"EUR": Currency{Code: "EUR", MinorUnits: 2, Symbol: "€"},
+	"GBP": Currency{Code: "GBP", MinorUnits: 2, Symbol: "£"},
+	"CHF": Currency{Code: "CHF", MinorUnits: 2, Symbol: "CHF "},
+	"SEK": Currency{Code: "SEK", MinorUnits: 2, Symbol: "SEK "},
+	"DKK": Currency{Code: "DKK", MinorUnits: 2, Symbol: "DKK "},
+	"NOK": Currency{Code: "NOK", MinorUnits: 2, Symbol: "NOK "},
+	"MXN": Currency{Code: "MXN", MinorUnits: 2, Symbol: "MX$"},
+	"JPY": Currency{Code: "JPY", MinorUnits: 0, Symbol: "¥"},
+}
+
+const defaultCurrency = "USD"
+
+// lookupCurrency returns the currency for an ISO 4217 code. Plans and orders
+// saved before stores had a currency have none and are in USD. Any other code
+// we don't know is an error, since guessing would charge the wrong amount.
+func lookupCurrency(code string) (Currency, error) {
+	if code == "" {
+		code = defaultCurrency
+	}
+	c, ok := currencies[strings.ToUpper(code)]
+	if !ok {
+		return Currency{}, fmt.Errorf("Currency %s is not supported", code)
+	}
+	return c, nil
+}
+
+func (c Currency) scale() float64 {
+	return math.Pow(10, float64(c.MinorUnits))
+}
+
+// round rounds amount to the nearest minor unit.
+func (c Currency) round(amount float64) float64 {
+	return math.Round(amount*c.scale()) / c.scale()
+}
+
+// ceil rounds amount up to the next minor unit, so installments never add up
+// to less than the total.
+func (c Currency) ceil(amount float64) float64 {
+	// Drop float noise first so 12.000000001 doesn't become 12.01.
+	return math.Ceil(math.Round(amount*c.scale()*1e6)/1e6) / c.scale()
+}
+
+// value formats amount the way payment providers expect it, e.g. "12.50" or
+// "1250" for currencies without minor units.
+func (c Currency) value(amount float64) string {
+	return strconv.FormatFloat(c.round(amount), 'f', c.MinorUnits, 64)
+}
+
+// display formats amount for buyers, e.g. "$1,250.00" or "¥1,250".
+func (c Currency) display(amount float64) string {
+	v := c.value(math.Abs(amount))
+	whole, frac := v, ""
+	if i := strings.Index(v, "."); i != -1 {
+		whole, frac = v[:i], v[i:]
+	}
+	var b strings.Builder
+	for i, d := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(d)
+	}
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+	}
+	return sign + c.Symbol + b.String() + frac
+}
+
+// formatMoney is the "money" template function. It takes a currency code and
+// an amount as stored on plans and orders.
+func formatMoney(code string, amount string) (string, error) {
+	f, err := strconv.ParseFloat(amount, 64)
+	if err != nil {
+		return amount, nil
+	}
+	cur, err := lookupCurrency(code)
+	if err != nil {
+		return "", err
+	}
+	return cur.display(f), nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLookupCurrency(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+		ok   bool
+	}{
+		{"USD", "USD", true},
+		{"jpy", "JPY", true},
+		// Orders saved before stores had a currency.
+		{"", "USD", true},
+		{"XYZ", "", false},
+		{"US", "", false},
+	}
+	for _, tt := range tests {
+		cur, err := lookupCurrency(tt.code)
+		if (err == nil) != tt.ok {
+			t.Errorf("lookupCurrency(%q) error = %v, want ok %v", tt.code, err, tt.ok)
+			continue
+		}
+		if cur.Code != tt.want {
+			t.Errorf("lookupCurrency(%q) = %s, want %s", tt.code, cur.Code, tt.want)
+		}
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	if got, err := formatMoney("JPY", "1250"); err != nil || got != "¥1,250" {
+		t.Errorf("formatMoney(JPY) = %q, %v", got, err)
+	}
+	if got, err := formatMoney("EUR", "-3.5"); err != nil || got != "-€3.50" {
+		t.Errorf("formatMoney(EUR) = %q, %v", got, err)
+	}
+	if _, err := formatMoney("XYZ", "10"); err == nil {
+		t.Error("formatMoney accepted an unknown currency")
+	}
+}
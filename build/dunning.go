@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+)
+
+// DunningPolicy decides what happens after an installment fails. We retry the
+// outstanding balance RetryDays after the first failure and remind the buyer
+// each time. Once GraceDays have passed, or the event is less than CutoffDays
+// away, the order is flagged for the merchant or cancelled outright.
+type DunningPolicy struct {
+	RetryDays  []int
+	GraceDays  int
+	CutoffDays int
+	Cancel     bool
+}
+
+var dunningPolicy = DunningPolicy{
+	RetryDays:  []int{3, 7, 14},
+	GraceDays:  21,
+	CutoffDays: 14,
+}
+
+// payNowPrefix marks the custom ID of PayPal orders that settle a balance.
+const payNowPrefix = "pay-now:"
+
+const mailSender = "Tixpire Payments <noreply@tixpire.appspotmail.com>"
+
+var reminderTemplate = template.Must(template.New("reminder").Parse(`Hi,
+
+Your payment of {{.Amount}} for {{.Order.Event}} - {{.Order.Variant}} didn't go through.
+
+You can pay the outstanding balance now at:
+{{.PayNowURL}}
+
+{{if .Deadline}}Please pay before {{.Deadline}} to keep your booking.{{end}}
+
+Thanks,
+{{.Order.Vendor}}
+`))
+
+func init() {
+	if days := os.Getenv("DUNNING_RETRY_DAYS"); days != "" {
+		dunningPolicy.RetryDays = nil
+		for _, d := range strings.Split(days, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(d))
+			if err != nil {
+				panic("Invalid DUNNING_RETRY_DAYS")
+			}
+			dunningPolicy.RetryDays = append(dunningPolicy.RetryDays, n)
+		}
+	}
+	if days := os.Getenv("DUNNING_GRACE_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			panic("Invalid DUNNING_GRACE_DAYS")
+		}
+		dunningPolicy.GraceDays = n
+	}
+	if days := os.Getenv("DUNNING_CUTOFF_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			panic("Invalid DUNNING_CUTOFF_DAYS")
+		}
+		dunningPolicy.CutoffDays = n
+	}
+	dunningPolicy.Cancel = os.Getenv("DUNNING_ACTION") == "cancel"
+}
+
+// deadline is when an order that is still behind gets flagged or cancelled.
+func (p DunningPolicy) deadline(o *Order) time.Time {
+	deadline := o.DunningSince.AddDate(0, 0, p.GraceDays)
+	if !o.EventTime.IsZero() {
+		cutoff := o.EventTime.AddDate(0, 0, -p.CutoffDays)
+		if cutoff.Before(deadline) {
+			deadline = cutoff
+		}
+	}
+	return deadline
+}
+
+func (o *Order) startDunning(at time.Time) {
+	if o.InDunning {
+		return
+	}
+	o.InDunning = true
+	o.DunningSince = at
+	o.DunningStage = 0
+	o.NextRetry = time.Time{}
+	if len(dunningPolicy.RetryDays) > 0 {
+		o.NextRetry = at.AddDate(0, 0, dunningPolicy.RetryDays[0])
+	}
+}
+
+func (o *Order) stopDunning() {
+	o.InDunning = false
+	o.DunningStage = 0
+	o.NextRetry = time.Time{}
+	o.Flagged = false
+	o.FlagReason = ""
+}
+
+// serveDunning is run by cron. It walks every order with a failed installment
+// and retries, reminds, flags or cancels it according to dunningPolicy.
+func serveDunning(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	keys, err := datastore.NewQuery("Order").Filter("InDunning =", true).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		log.Errorf(ctx, "Dunning Query Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Debugf(ctx, "Dunning %d orders", len(keys))
+
+	now := time.Now()
+	for _, key := range keys {
+		o, err := dunStoredOrder(ctx, key.StringID(), now)
+		if err != nil {
+			log.Errorf(ctx, "Dunning order %s: %s", key.StringID(), err)
+		} else if o.Status == orderCancelled {
+			if err := syncInventoryHold(ctx, o.AgreementID); err != nil {
+				log.Errorf(ctx, "Sync Inventory Hold Error: %s", err)
+			}
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// dunStoredOrder reloads the order and applies dunOrder to it in a
+// transaction, so a payment recorded by a webhook since the query isn't
+// overwritten. dunOrder charges and emails the buyer, so the transaction is
+// tried only once; if it fails the next run sees whatever the webhook
+// recorded.
+func dunStoredOrder(ctx context.Context, agreementID string, now time.Time) (*Order, error) {
+	var o *Order
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		var err error
+		if o, err = getOrder(tc, agreementID); err != nil {
+			return err
+		}
+		if !o.InDunning {
+			return nil
+		}
+		if err := dunOrder(tc, o, now); err != nil {
+			return err
+		}
+		return putOrder(tc, o)
+	}, &datastore.TransactionOptions{Attempts: 1})
+	return o, err
+}
+
+func dunOrder(ctx context.Context, o *Order, now time.Time) error {
+	if o.Status == orderCancelled || o.outstanding() == 0 {
+		o.stopDunning()
+		return nil
+	}
+
+	deadline := dunningPolicy.deadline(o)
+	if !now.Before(deadline) {
+		if o.Flagged {
+			return nil
+		}
+		o.Flagged = true
+		o.FlagReason = "Balance unpaid after " + deadline.Format("January 2, 2006")
+		if !dunningPolicy.Cancel {
+			return nil
+		}
+		c, err := newPayPalClient(ctx)
+		if err != nil {
+			return err
+		}
+		if err := cancelPayPalOrder(c, o, "Installments unpaid before the event"); err != nil {
+			return err
+		}
+		o.Status = orderCancelled
+		o.InDunning = false
+		return nil
+	}
+
+	if o.NextRetry.IsZero() || now.Before(o.NextRetry) {
+		return nil
+	}
+	cur, err := lookupCurrency(o.Currency)
+	if err != nil {
+		return err
+	}
+	c, err := newPayPalClient(ctx)
+	if err != nil {
+		return err
+	}
+	if err := chargeOutstanding(c, o, cur.value(o.outstanding()), "Retry of failed installment"); err != nil {
+		// The reminder still goes out so the buyer can pay another way.
+		log.Warningf(ctx, "Charge Outstanding Error: %s", err)
+	}
+	if err := sendPaymentReminder(ctx, o, cur.display(o.outstanding()), deadline); err != nil {
+		log.Warningf(ctx, "Send Reminder Error: %s", err)
+	}
+
+	o.DunningStage++
+	o.NextRetry = time.Time{}
+	if o.DunningStage < len(dunningPolicy.RetryDays) {
+		o.NextRetry = o.DunningSince.AddDate(0, 0, dunningPolicy.RetryDays[o.DunningStage])
+	}
+	return nil
+}
+
+func sendPaymentReminder(ctx context.Context, o *Order, amount string, deadline time.Time) error {
+	if o.Email == "" {
+		return nil
+	}
+	var body bytes.Buffer
+	err := reminderTemplate.Execute(&body, struct {
+		Order     *Order
+		Amount    string
+		PayNowURL string
+		Deadline  string
+	}{
+		Order:     o,
+		Amount:    amount,
+		PayNowURL: appURL + "/pay-now/" + o.AgreementID,
+		Deadline:  deadline.Format("January 2, 2006"),
+	})
+	if err != nil {
+		return err
+	}
+	return mail.Send(ctx, &mail.Message{
+		Sender:  mailSender,
+		To:      []string{o.Email},
+		Subject: "Payment failed for " + o.Event,
+		Body:    body.String(),
+	})
+}
+
+// payNow lets a buyer settle the outstanding balance of an order with a
+// one-off PayPal payment. /pay-now/{order} sends them to PayPal and
+// /pay-now/{order}/return captures the payment once they approve it.
+func payNow(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	path := strings.Split(r.URL.Path[len("/pay-now/"):], "/")
+	o, tenant, err := orderTenant(ctx, path[0])
+	if err != nil {
+		log.Debugf(ctx, "Get Order Error: %s", err)
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	outstanding := o.outstanding()
+	if outstanding == 0 {
+		io.WriteString(w, "Nothing is owed on this order.")
+		return
+	}
+	cur, err := lookupCurrency(o.Currency)
+	if err != nil {
+		log.Errorf(ctx, "Currency Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	c, err := newPayPalClient(ctx)
+	if err != nil {
+		log.Errorf(ctx, "New Client Error: %s", err)
+		http.Error(w, "PayPal unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if len(path) > 1 && path[1] == "return" {
+		resp, err := capturePayPalCheckoutOrder(c, r.URL.Query().Get("token"))
+		if err != nil {
+			log.Errorf(ctx, "Capture Order Error: %s", err)
+			http.Error(w, "Payment could not be completed", http.StatusBadGateway)
+			return
+		}
+		capture := resp.capture()
+		if resp.Status != "COMPLETED" || capture == nil || capture.CustomID != payNowPrefix+o.AgreementID {
+			http.Error(w, "Payment could not be completed", http.StatusPaymentRequired)
+			return
+		}
+		err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+			// The capture webhook may have recorded this or another
+			// payment since o was read.
+			o, err := tenant.order(tc, o.AgreementID)
+			if err != nil {
+				return err
+			}
+			o.recordBalancePayment(capture.ID, time.Now())
+			return tenant.putOrder(tc, o)
+		}, nil)
+		if err != nil {
+			log.Errorf(ctx, "Put Order Error: %s", err)
+		} else if err := syncShopifyOrder(ctx, o.AgreementID); err != nil {
+			log.Errorf(ctx, "Sync Shopify Order Error: %s", err)
+		}
+		io.WriteString(w, "Thank you, your payment was received.")
+		return
+	}
+
+	order := payPalCheckoutOrder{
+		Intent: "CAPTURE",
+		PurchaseUnits: []payPalPurchaseUnit{
+			payPalPurchaseUnit{
+				CustomID:    payNowPrefix + o.AgreementID,
+				Description: "Outstanding balance for " + o.Event + " - " + o.Variant,
+				Amount: payPalMoney{
+					Value:        cur.value(outstanding),
+					CurrencyCode: cur.Code,
+				},
+			},
+		},
+		ApplicationContext: &payPalApplicationContext{
+			ShippingPreference: "NO_SHIPPING",
+			UserAction:         "PAY_NOW",
+			ReturnURL:          appURL + "/pay-now/" + o.AgreementID + "/return",
+			CancelURL:          appURL + "/pay-now/" + o.AgreementID,
+		},
+	}
+	resp, err := createPayPalCheckoutOrder(c, order)
+	if err != nil {
+		log.Errorf(ctx, "Create Order Error: %s", err)
+		http.Error(w, "Could not start payment", http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, resp.link("approve"), http.StatusFound)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+
+	"tixpire/paypalfake"
+)
+
+// putDunningOrder stores a subscription on the fake whose first installment
+// failed at since, and whose second failed when it fell due.
+func putDunningOrder(t *testing.T, inst aetest.Instance, fake *paypalfake.Server, since time.Time) *Order {
+	fake.Subscriptions[fixtureSubscription] = &paypalfake.Subscription{ID: fixtureSubscription, Status: "ACTIVE"}
+	o := putTestOrder(t, inst, "shop.myshopify.com", fixtureSubscription)
+	o.recordFailure(since)
+	o.recordFailure(since)
+	o.recordFailure(o.Installments[1].Due)
+	if o.Installments[0].Failures != 2 || o.Installments[1].Status != installmentFailed {
+		t.Fatalf("installments after failures: %+v", o.Installments)
+	}
+	o.ShopifyOrderID = 450789469
+	if err := putOrder(appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil)), o); err != nil {
+		t.Fatalf("putOrder: %s", err)
+	}
+	return o
+}
+
+func dun(t *testing.T, inst aetest.Instance, now time.Time) *Order {
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+	if _, err := dunStoredOrder(ctx, fixtureSubscription, now); err != nil {
+		t.Fatalf("dunStoredOrder: %s", err)
+	}
+	return loadTestOrder(t, inst, fixtureSubscription)
+}
+
+func TestDunningRetries(t *testing.T) {
+	fake, stop := usePayPalFake()
+	defer stop()
+	inst, done := newTestInstance(t)
+	defer done()
+	since := time.Now()
+	putDunningOrder(t, inst, fake, since)
+
+	if o := dun(t, inst, since.AddDate(0, 0, 1)); len(fake.Captures) != 0 || o.DunningStage != 0 {
+		t.Fatalf("charged %d times before the first retry", len(fake.Captures))
+	}
+	for stage, days := range dunningPolicy.RetryDays {
+		o := dun(t, inst, since.AddDate(0, 0, days))
+		if len(fake.Captures) != stage+1 || fake.Captures[stage].Amount != "62.50" {
+			t.Fatalf("retry %d: captures = %+v, want one more of 62.50", stage+1, fake.Captures)
+		}
+		if o.DunningStage != stage+1 {
+			t.Errorf("retry %d: stage = %d", stage+1, o.DunningStage)
+		}
+		if o.ShopifyOrderID != 450789469 {
+			t.Errorf("retry %d: Shopify order = %d", stage+1, o.ShopifyOrderID)
+		}
+		// A second run the same day doesn't charge again.
+		dun(t, inst, since.AddDate(0, 0, days))
+		if len(fake.Captures) != stage+1 {
+			t.Fatalf("retry %d charged twice", stage+1)
+		}
+	}
+	if o := loadTestOrder(t, inst, fixtureSubscription); !o.NextRetry.IsZero() || o.Flagged {
+		t.Errorf("after the last retry: next %s, flagged %v", o.NextRetry, o.Flagged)
+	}
+
+	o := dun(t, inst, since.AddDate(0, 0, dunningPolicy.GraceDays))
+	if !o.Flagged || o.Status != orderActive || fake.Subscriptions[fixtureSubscription].Status != "ACTIVE" {
+		t.Errorf("after the grace period: flagged %v, %s, subscription %s", o.Flagged, o.Status, fake.Subscriptions[fixtureSubscription].Status)
+	}
+}
+
+func TestDunningBeforeEvent(t *testing.T) {
+	for _, cancel := range []bool{false, true} {
+		fake, stop := usePayPalFake()
+		inst, done := newTestInstance(t)
+		dunningPolicy.Cancel = cancel
+		since := time.Now()
+		o := putDunningOrder(t, inst, fake, since)
+		// The event is closer than the cutoff before the first retry.
+		o.EventTime = since.AddDate(0, 0, dunningPolicy.CutoffDays+1)
+		if err := putOrder(appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil)), o); err != nil {
+			t.Fatalf("putOrder: %s", err)
+		}
+
+		o = dun(t, inst, since.AddDate(0, 0, 2))
+		if !o.Flagged || !strings.HasPrefix(o.FlagReason, "Balance unpaid") {
+			t.Errorf("cancel %v: flagged %v, %q", cancel, o.Flagged, o.FlagReason)
+		}
+		if len(fake.Captures) != 0 {
+			t.Errorf("cancel %v: charged %d times after the deadline", cancel, len(fake.Captures))
+		}
+		want, wantSub := orderActive, "ACTIVE"
+		if cancel {
+			want, wantSub = orderCancelled, "CANCELLED"
+		}
+		if o.Status != want || fake.Subscriptions[fixtureSubscription].Status != wantSub {
+			t.Errorf("cancel %v: order %s, subscription %s; want %s, %s", cancel, o.Status, fake.Subscriptions[fixtureSubscription].Status, want, wantSub)
+		}
+		done()
+		stop()
+	}
+	dunningPolicy.Cancel = false
+}
+
+func TestDunningSettledByBalanceCapture(t *testing.T) {
+	fake, stop := usePayPalFake()
+	defer stop()
+	inst, done := newTestInstance(t)
+	defer done()
+	since := time.Now().AddDate(0, 0, -dunningPolicy.RetryDays[0])
+	putDunningOrder(t, inst, fake, since)
+
+	dun(t, inst, time.Now())
+	if len(fake.Captures) != 1 {
+		t.Fatalf("captures = %+v, want one", fake.Captures)
+	}
+
+	// PayPal reports the capture as a single sale for the whole balance,
+	// and may deliver it under more than one event.
+	for _, event := range []string{"WH-BALANCE-1", "WH-BALANCE-2"} {
+		body := strings.NewReplacer(
+			"WH-2WR32451HC0233532-67976317FL4543714", event,
+			`"total": "31.25"`, `"total": "62.50"`,
+		).Replace(string(fixture(t, "paypal/payment_sale_completed.json")))
+		if code := postPayPalWebhook(t, inst, []byte(body)); code != http.StatusOK {
+			t.Fatalf("webhook returned %d", code)
+		}
+	}
+	o := loadTestOrder(t, inst, fixtureSubscription)
+	for i, inst := range o.Installments[:2] {
+		if inst.Status != installmentPaid || inst.Amount != "31.25" {
+			t.Errorf("installment %d = %s %s, want paid 31.25", i+1, inst.Status, inst.Amount)
+		}
+	}
+	if o.Installments[2].Status != installmentScheduled {
+		t.Errorf("last installment = %s, want %s", o.Installments[2].Status, installmentScheduled)
+	}
+	if o.InDunning || o.outstanding() != 0 {
+		t.Errorf("still dunning with %v outstanding", o.outstanding())
+	}
+
+	dun(t, inst, since.AddDate(0, 0, dunningPolicy.RetryDays[1]))
+	if len(fake.Captures) != 1 {
+		t.Errorf("charged again after the balance was paid: %+v", fake.Captures)
+	}
+}
+
+func TestPayNow(t *testing.T) {
+	fake, stop := usePayPalFake()
+	defer stop()
+	inst, done := newTestInstance(t)
+	defer done()
+	putDunningOrder(t, inst, fake, time.Now())
+
+	w := serve(t, inst, payNow, "GET", "/pay-now/"+fixtureSubscription, nil)
+	if w.Code != http.StatusFound {
+		t.Fatalf("pay-now returned %d: %s", w.Code, w.Body)
+	}
+	for _, order := range fake.Orders {
+		if order.Amount.Value != "62.50" {
+			t.Errorf("pay-now asked for %s, want 62.50", order.Amount.Value)
+		}
+	}
+	returned := approve(t, w.Header().Get("Location"))
+	if w := serve(t, inst, payNow, "GET", returned, nil); w.Code != http.StatusOK {
+		t.Fatalf("return returned %d: %s", w.Code, w.Body)
+	}
+	o := loadTestOrder(t, inst, fixtureSubscription)
+	for i, inst := range o.Installments[:2] {
+		if inst.Status != installmentPaid || !inst.PaidSeparately {
+			t.Errorf("installment %d = %+v, want paid separately", i+1, inst)
+		}
+	}
+	if o.InDunning || o.ShopifyOrderID != 450789469 {
+		t.Errorf("after paying: dunning %v, Shopify order %d", o.InDunning, o.ShopifyOrderID)
+	}
+	if w := serve(t, inst, payNow, "GET", "/pay-now/"+fixtureSubscription, nil); !strings.Contains(w.Body.String(), "Nothing is owed") {
+		t.Errorf("pay-now after paying: %d %s", w.Code, w.Body)
+	}
+}
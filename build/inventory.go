@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/logpacker/PayPal-Go-SDK"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// inventoryHoldTTL is how long seats are held for a buyer who has been sent
+// to PayPal or Stripe but hasn't come back yet.
+const inventoryHoldTTL = time.Hour
+
+// holdPlacingTTL is how long a claim on a checkout's hold keeps other
+// requests from placing it, should the request that claimed it never finish.
+const holdPlacingTTL = time.Minute
+
+const (
+	holdPlacing   = "PLACING"
+	holdHeld      = "HELD"
+	holdConfirmed = "CONFIRMED"
+	holdReleased  = "RELEASED"
+)
+
+var errSoldOut = errors.New("Sorry, there are not enough tickets left for this order.")
+
+// InventoryHold is stock taken out of a variant's available inventory for one
+// checkout. It is keyed by the checkout session ID so choosing a different
+// plan on the same checkout doesn't take the stock twice.
+type InventoryHold struct {
+	Shop            string
+	VariantID       int64
+	InventoryItemID int64
+	LocationID      int64
+	Qty             int
+	OrderID         string
+	Status          string
+	Expires         time.Time
+	Created         time.Time
+	Updated         time.Time
+}
+
+type shopifyInventoryLevel struct {
+	InventoryItemID int64 `json:"inventory_item_id"`
+	LocationID      int64 `json:"location_id"`
+	Available       int   `json:"available"`
+}
+
+func inventoryHoldKey(ctx context.Context, sessionID string) *datastore.Key {
+	return datastore.NewKey(ctx, "InventoryHold", sessionID, 0, nil)
+}
+
+// adjustInventory changes the available stock of an item at a location and
+// returns the level it was left at.
+func adjustInventory(ctx context.Context, shop string, itemID int64, locationID int64, by int) (*shopifyInventoryLevel, error) {
+	body := map[string]interface{}{
+		"location_id":          locationID,
+		"inventory_item_id":    itemID,
+		"available_adjustment": by,
+	}
+	var resp struct {
+		InventoryLevel shopifyInventoryLevel `json:"inventory_level"`
+	}
+	if err := (Tenant{Shop: shop}).shopifyRequest(ctx, "POST", "/inventory_levels/adjust.json", body, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.InventoryLevel, nil
+}
+
+// claimInventoryHold marks the checkout's hold as being placed, and reports
+// whether this request should place it. A hold that is already held, or
+// being placed by another request, is left alone, so submitting the order
+// form twice only takes the stock once.
+func claimInventoryHold(ctx context.Context, key *datastore.Key, session *CheckoutSession) (bool, error) {
+	claimed := false
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		var hold InventoryHold
+		err := datastore.Get(tc, key, &hold)
+		now := time.Now()
+		if err == nil && hold.Status == holdHeld {
+			hold.Expires = now.Add(inventoryHoldTTL)
+			hold.Updated = now
+			_, err = datastore.Put(tc, key, &hold)
+			return err
+		} else if err == nil && hold.Status == holdPlacing && now.Before(hold.Expires) {
+			return nil
+		} else if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		qty, _ := strconv.Atoi(session.Qty)
+		hold = InventoryHold{
+			Shop:      session.Shop,
+			VariantID: session.VariantID,
+			Qty:       qty,
+			Status:    holdPlacing,
+			Expires:   now.Add(holdPlacingTTL),
+			Created:   now,
+			Updated:   now,
+		}
+		if _, err := datastore.Put(tc, key, &hold); err != nil {
+			return err
+		}
+		claimed = true
+		return nil
+	}, nil)
+	return claimed, err
+}
+
+// holdInventory takes the session's tickets out of stock while the buyer is
+// away approving payment. Variants that Shopify doesn't track stock for are
+// not held. Choosing again on the same checkout keeps the existing hold.
+func holdInventory(ctx context.Context, sessionID string, session *CheckoutSession) error {
+	if session.VariantID == 0 {
+		return nil
+	}
+	key := inventoryHoldKey(ctx, sessionID)
+	claimed, err := claimInventoryHold(ctx, key, session)
+	if err != nil || !claimed {
+		return err
+	}
+	// Until the hold is stored as held, giving up means dropping the claim
+	// so the next attempt can place it.
+	placed := false
+	defer func() {
+		if !placed {
+			datastore.Delete(ctx, key)
+		}
+	}()
+	tenant := Tenant{Shop: session.Shop}
+
+	var variant struct {
+		Variant struct {
+			InventoryItemID     int64  `json:"inventory_item_id"`
+			InventoryManagement string `json:"inventory_management"`
+			InventoryPolicy     string `json:"inventory_policy"`
+		} `json:"variant"`
+	}
+	if err := tenant.shopifyGet(ctx, "/variants/"+strconv.FormatInt(session.VariantID, 10)+".json", &variant); err != nil {
+		return err
+	}
+	if variant.Variant.InventoryManagement != "shopify" {
+		return nil
+	}
+	deny := variant.Variant.InventoryPolicy == "deny"
+	var levels struct {
+		InventoryLevels []shopifyInventoryLevel `json:"inventory_levels"`
+	}
+	path := "/inventory_levels.json?inventory_item_ids=" + strconv.FormatInt(variant.Variant.InventoryItemID, 10)
+	if err := tenant.shopifyGet(ctx, path, &levels); err != nil {
+		return err
+	}
+	// Hold the stock at whichever location has the most of it.
+	var best *shopifyInventoryLevel
+	for i := range levels.InventoryLevels {
+		if best == nil || levels.InventoryLevels[i].Available > best.Available {
+			best = &levels.InventoryLevels[i]
+		}
+	}
+	qty, _ := strconv.Atoi(session.Qty)
+	if best == nil || (deny && best.Available < qty) {
+		return errSoldOut
+	}
+	level, err := adjustInventory(ctx, session.Shop, best.InventoryItemID, best.LocationID, -qty)
+	if err != nil {
+		return err
+	}
+	// Someone else may have bought the last seats between reading the level
+	// and adjusting it. Shopify applies the adjustment anyway, so it is undone.
+	if deny && level.Available < 0 {
+		if _, err := adjustInventory(ctx, session.Shop, best.InventoryItemID, best.LocationID, qty); err != nil {
+			log.Errorf(ctx, "Revert Inventory Adjustment Error: %s", err)
+		}
+		return errSoldOut
+	}
+
+	now := time.Now()
+	hold := InventoryHold{
+		Shop:            session.Shop,
+		VariantID:       session.VariantID,
+		InventoryItemID: best.InventoryItemID,
+		LocationID:      best.LocationID,
+		Qty:             qty,
+		Status:          holdHeld,
+		Expires:         now.Add(inventoryHoldTTL),
+		Created:         now,
+		Updated:         now,
+	}
+	if _, err := datastore.Put(ctx, key, &hold); err != nil {
+		// Put the stock back rather than lose track of it.
+		adjustInventory(ctx, session.Shop, best.InventoryItemID, best.LocationID, qty)
+		return err
+	}
+	placed = true
+	return nil
+}
+
+// attachInventoryHold ties the session's hold to the subscription or payment
+// the buyer was sent to approve, which is also the ID their order is stored
+// under.
+func attachInventoryHold(ctx context.Context, sessionID string, orderID string) error {
+	key := inventoryHoldKey(ctx, sessionID)
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		var hold InventoryHold
+		err := datastore.Get(tc, key, &hold)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		hold.OrderID = orderID
+		hold.Updated = time.Now()
+		_, err = datastore.Put(tc, key, &hold)
+		return err
+	}, nil)
+}
+
+// cancelInventoryHold gives back the stock held for a checkout whose payment
+// could not be started.
+func cancelInventoryHold(ctx context.Context, sessionID string) error {
+	err := releaseHold(ctx, inventoryHoldKey(ctx, sessionID), holdHeld)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+// inventoryHoldForOrder finds the hold placed for an approved subscription or
+// payment.
+func inventoryHoldForOrder(ctx context.Context, orderID string) (*datastore.Key, *InventoryHold, error) {
+	var holds []InventoryHold
+	keys, err := datastore.NewQuery("InventoryHold").Filter("OrderID =", orderID).Limit(1).GetAll(ctx, &holds)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(holds) == 0 {
+		return nil, nil, datastore.ErrNoSuchEntity
+	}
+	return keys[0], &holds[0], nil
+}
+
+// setHoldStatus moves the hold at key from one of the from statuses to to,
+// and reports whether it did. It is how concurrent confirms and releases
+// agree on who adjusts the stock.
+func setHoldStatus(ctx context.Context, key *datastore.Key, to string, from ...string) (*InventoryHold, bool, error) {
+	var hold InventoryHold
+	moved := false
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		if err := datastore.Get(tc, key, &hold); err != nil {
+			return err
+		}
+		for _, s := range from {
+			if hold.Status == s {
+				hold.Status = to
+				hold.Updated = time.Now()
+				moved = true
+				_, err := datastore.Put(tc, key, &hold)
+				return err
+			}
+		}
+		return nil
+	}, nil)
+	return &hold, moved, err
+}
+
+// syncInventoryHold brings an order's hold in line with the order: the stock
+// stays taken while the order is live and goes back on sale once it is
+// cancelled. It is safe to call as often as needed.
+func syncInventoryHold(ctx context.Context, orderID string) error {
+	key, _, err := inventoryHoldForOrder(ctx, orderID)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	o, err := getOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	if o.Status == orderCancelled {
+		return releaseHold(ctx, key, holdHeld, holdConfirmed)
+	}
+	if _, _, err := setHoldStatus(ctx, key, holdConfirmed, holdHeld); err != nil {
+		return err
+	}
+	// A hold that timed out before the order came in is taken again, since
+	// the buyer has the seat either way. If the stock has since been sold to
+	// someone else the order is flagged for the vendor rather than taking the
+	// level below zero.
+	hold, retaken, err := setHoldStatus(ctx, key, holdConfirmed, holdReleased)
+	if err != nil || !retaken {
+		return err
+	}
+	log.Warningf(ctx, "Hold for %s had expired, taking %d back out of stock", orderID, hold.Qty)
+	taken, err := retakeInventory(ctx, hold)
+	if err != nil || !taken {
+		// Back to released so a later sync tries again.
+		setHoldStatus(ctx, key, holdReleased, holdConfirmed)
+	}
+	if err != nil {
+		return err
+	}
+	if !taken {
+		return flagOrder(ctx, orderID, "Oversold: the tickets held for this order were sold after the hold expired")
+	}
+	return nil
+}
+
+// retakeInventory takes an expired hold's stock back out at the hold's
+// location, and reports false if there isn't enough of it left.
+func retakeInventory(ctx context.Context, hold *InventoryHold) (bool, error) {
+	var levels struct {
+		InventoryLevels []shopifyInventoryLevel `json:"inventory_levels"`
+	}
+	path := "/inventory_levels.json?inventory_item_ids=" + strconv.FormatInt(hold.InventoryItemID, 10) + "&location_ids=" + strconv.FormatInt(hold.LocationID, 10)
+	if err := (Tenant{Shop: hold.Shop}).shopifyGet(ctx, path, &levels); err != nil {
+		return false, err
+	}
+	available := 0
+	for _, level := range levels.InventoryLevels {
+		if level.InventoryItemID == hold.InventoryItemID && level.LocationID == hold.LocationID {
+			available = level.Available
+		}
+	}
+	if available < hold.Qty {
+		return false, nil
+	}
+	level, err := adjustInventory(ctx, hold.Shop, hold.InventoryItemID, hold.LocationID, -hold.Qty)
+	if err != nil {
+		return false, err
+	}
+	// As when placing a hold, a sale between reading the level and
+	// adjusting it is undone.
+	if level.Available < 0 {
+		if _, err := adjustInventory(ctx, hold.Shop, hold.InventoryItemID, hold.LocationID, hold.Qty); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+func releaseHold(ctx context.Context, key *datastore.Key, from ...string) error {
+	hold, released, err := setHoldStatus(ctx, key, holdReleased, from...)
+	if err != nil || !released {
+		return err
+	}
+	if _, err := adjustInventory(ctx, hold.Shop, hold.InventoryItemID, hold.LocationID, hold.Qty); err != nil {
+		// Put it back to held so the cron tries again.
+		setHoldStatus(ctx, key, holdHeld, holdReleased)
+		return err
+	}
+	return nil
+}
+
+// serveInventoryHolds is run by cron. It releases holds for checkouts that
+// were never approved within inventoryHoldTTL, and confirms the ones that were
+// approved without the buyer coming back to the thank-you page.
+func serveInventoryHolds(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var holds []InventoryHold
+	keys, err := datastore.NewQuery("InventoryHold").Filter("Status =", holdHeld).Filter("Expires <", time.Now()).GetAll(ctx, &holds)
+	if err != nil {
+		log.Errorf(ctx, "Inventory Hold Query Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i, hold := range holds {
+		approved, err := holdApproved(ctx, &hold)
+		if err != nil {
+			log.Errorf(ctx, "Check Hold %s: %s", hold.OrderID, err)
+			continue
+		}
+		if approved {
+			// The order itself may not exist yet, so the hold is confirmed
+			// directly; a later cancellation still releases it.
+			_, _, err = setHoldStatus(ctx, keys[i], holdConfirmed, holdHeld)
+		} else {
+			err = releaseHold(ctx, keys[i], holdHeld)
+		}
+		if err != nil {
+			log.Errorf(ctx, "Expire Hold %s: %s", hold.OrderID, err)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// holdApproved reports whether the buyer approved the payment a hold is for.
+// A subscription can be approved without the buyer ever coming back to the
+// thank-you page, so PayPal is asked when there is no order yet.
+func holdApproved(ctx context.Context, hold *InventoryHold) (bool, error) {
+	if hold.OrderID == "" {
+		return false, nil
+	}
+	if _, err := getOrder(ctx, hold.OrderID); err == nil {
+		return true, nil
+	} else if err != datastore.ErrNoSuchEntity {
+		return false, err
+	}
+	c, err := newPayPalClient(ctx)
+	if err != nil {
+		return false, err
+	}
+	sub, err := getPayPalSubscription(c, hold.OrderID)
+	if e, ok := err.(*paypalsdk.ErrorResponse); ok && e.Response.StatusCode == http.StatusNotFound {
+		// Not a subscription, or PayPal doesn't know it: a pay-in-full
+		// checkout that wasn't paid would have an order by now.
+		return false, nil
+	} else if err != nil {
+		// PayPal couldn't be asked, so the hold stays until it can.
+		return false, err
+	}
+	return sub.Status == "ACTIVE" || sub.Status == "APPROVED", nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+
+	"tixpire/paypalfake"
+)
+
+func newHoldSession(qty string) *CheckoutSession {
+	return &CheckoutSession{Shop: "stock.myshopify.com", VariantID: 200, Qty: qty}
+}
+
+func loadHold(t *testing.T, ctx context.Context, sessionID string) *InventoryHold {
+	var hold InventoryHold
+	if err := datastore.Get(ctx, inventoryHoldKey(ctx, sessionID), &hold); err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		t.Fatalf("get hold: %s", err)
+	}
+	return &hold
+}
+
+func TestHoldInventory(t *testing.T) {
+	shop, stop := useShopifyFake("stock.myshopify.com")
+	defer stop()
+	ctx, _, done := newTestContext(t)
+	defer done()
+
+	if err := holdInventory(ctx, "s1", newHoldSession("2")); err != nil {
+		t.Fatalf("holdInventory: %s", err)
+	}
+	// Choosing another plan on the same checkout keeps the hold.
+	if err := holdInventory(ctx, "s1", newHoldSession("2")); err != nil {
+		t.Fatalf("second holdInventory: %s", err)
+	}
+	if shop.available() != 8 || len(shop.Adjustments) != 1 {
+		t.Errorf("stock = %d after %v, want 8 after one adjustment", shop.available(), shop.Adjustments)
+	}
+	if hold := loadHold(t, ctx, "s1"); hold == nil || hold.Status != holdHeld || hold.LocationID != 400 || hold.Qty != 2 {
+		t.Errorf("hold = %+v, want 2 held at location 400", hold)
+	}
+}
+
+func TestHoldInventoryDoubleSubmit(t *testing.T) {
+	shop, stop := useShopifyFake("stock.myshopify.com")
+	defer stop()
+	ctx, _, done := newTestContext(t)
+	defer done()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = holdInventory(ctx, "s1", newHoldSession("1"))
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("holdInventory: %s", err)
+		}
+	}
+	if shop.available() != 9 || len(shop.Adjustments) != 1 {
+		t.Errorf("stock = %d after %v, want 9 after one adjustment", shop.available(), shop.Adjustments)
+	}
+}
+
+func TestHoldInventorySoldOut(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        string
+		available     int
+		soldElsewhere int
+		err           error
+		stock         int
+		held          bool
+	}{
+		{"enough", "deny", 2, 0, nil, 0, true},
+		{"not enough", "deny", 1, 0, errSoldOut, 1, false},
+		{"sold while adjusting", "deny", 2, 1, errSoldOut, 1, false},
+		{"oversell allowed", "continue", 1, 1, nil, -2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shop, stop := useShopifyFake("stock.myshopify.com")
+			defer stop()
+			shop.Variants[200].InventoryPolicy = tt.policy
+			shop.Levels[0].Available = tt.available
+			shop.SoldElsewhere = tt.soldElsewhere
+			ctx, _, done := newTestContext(t)
+			defer done()
+
+			if err := holdInventory(ctx, "s1", newHoldSession("2")); err != tt.err {
+				t.Fatalf("holdInventory = %v, want %v", err, tt.err)
+			}
+			if got := shop.available(); got != tt.stock {
+				t.Errorf("stock = %d after %v, want %d", got, shop.Adjustments, tt.stock)
+			}
+			if hold := loadHold(t, ctx, "s1"); (hold != nil) != tt.held {
+				t.Errorf("hold = %+v, want held %v", hold, tt.held)
+			}
+		})
+	}
+}
+
+// placeTestHold holds two seats for checkout s1 and ties the hold to
+// orderID.
+func placeTestHold(t *testing.T, ctx context.Context, orderID string) *datastore.Key {
+	if err := holdInventory(ctx, "s1", newHoldSession("2")); err != nil {
+		t.Fatalf("holdInventory: %s", err)
+	}
+	if err := attachInventoryHold(ctx, "s1", orderID); err != nil {
+		t.Fatalf("attachInventoryHold: %s", err)
+	}
+	return inventoryHoldKey(ctx, "s1")
+}
+
+func TestExpireInventoryHolds(t *testing.T) {
+	shop, stop := useShopifyFake("stock.myshopify.com")
+	defer stop()
+	fake, stopPayPal := usePayPalFake()
+	defer stopPayPal()
+	ctx, inst, done := newTestContext(t)
+	defer done()
+	key := placeTestHold(t, ctx, fixtureSubscription)
+	hold := loadHold(t, ctx, "s1")
+	hold.Expires = time.Now().Add(-time.Minute)
+	if _, err := datastore.Put(ctx, key, hold); err != nil {
+		t.Fatalf("put hold: %s", err)
+	}
+	expire := func() {
+		req := newTestRequest(t, inst, "GET", "/tasks/inventory-holds", nil)
+		req.Header.Set("X-Appengine-Cron", "true")
+		serveInventoryHolds(httptest.NewRecorder(), req)
+	}
+
+	// While PayPal can't be asked, the buyer may still have approved, so
+	// the seats stay held.
+	fake.Subscriptions[fixtureSubscription] = &paypalfake.Subscription{ID: fixtureSubscription, Status: "APPROVAL_PENDING"}
+	fake.Fail["get"] = true
+	expire()
+	if hold := loadHold(t, ctx, "s1"); hold.Status != holdHeld || shop.available() != 8 {
+		t.Errorf("after a PayPal error: hold %s, stock %d; want held, 8", hold.Status, shop.available())
+	}
+
+	// A subscription PayPal has no record of was never approved.
+	fake.Fail["get"] = false
+	delete(fake.Subscriptions, fixtureSubscription)
+	expire()
+	if hold := loadHold(t, ctx, "s1"); hold.Status != holdReleased || shop.available() != 10 {
+		t.Errorf("after PayPal lost the subscription: hold %s, stock %d; want released, 10", hold.Status, shop.available())
+	}
+}
+
+func TestSyncExpiredInventoryHold(t *testing.T) {
+	tests := []struct {
+		name          string
+		available     int
+		soldElsewhere int
+		status        string
+		stock         int
+		flagged       bool
+	}{
+		{"still in stock", 10, 0, holdConfirmed, 8, false},
+		{"sold out", 1, 0, holdReleased, 1, true},
+		{"sold while adjusting", 2, 1, holdReleased, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shop, stop := useShopifyFake("stock.myshopify.com")
+			defer stop()
+			ctx, inst, done := newTestContext(t)
+			defer done()
+			key := placeTestHold(t, ctx, fixtureSubscription)
+			// The hold timed out before the order came in, and the stock
+			// went back on sale.
+			if err := releaseHold(ctx, key, holdHeld); err != nil {
+				t.Fatalf("releaseHold: %s", err)
+			}
+			shop.Levels[0].Available = tt.available
+			shop.SoldElsewhere = tt.soldElsewhere
+			putTestOrder(t, inst, "stock.myshopify.com", fixtureSubscription)
+
+			if err := syncInventoryHold(ctx, fixtureSubscription); err != nil {
+				t.Fatalf("syncInventoryHold: %s", err)
+			}
+			if hold := loadHold(t, ctx, "s1"); hold.Status != tt.status || shop.available() != tt.stock {
+				t.Errorf("hold %s, stock %d after %v; want %s, %d", hold.Status, shop.available(), shop.Adjustments, tt.status, tt.stock)
+			}
+			if o := loadTestOrder(t, inst, fixtureSubscription); o.Flagged != tt.flagged {
+				t.Errorf("flagged %v %q, want %v", o.Flagged, o.FlagReason, tt.flagged)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// linkTTL is how long a signed checkout or thank-you link stays valid.
+const linkTTL = 24 * time.Hour
+
+const (
+	linkCheckout = "checkout"
+	linkThankYou = "thank-you"
+	linkPlan     = "plan"
+)
+
+var (
+	errLinkInvalid = errors.New("This link is not valid. It may have been changed after it was created. Please start again from the store.")
+	errLinkExpired = errors.New("This link has expired. Please start again from the store.")
+)
+
+// ShopSecret is the key a shop's checkout links are signed with. It is
+// created the first time a link is issued for the shop.
+type ShopSecret struct {
+	Secret  []byte `datastore:",noindex"`
+	Created time.Time
+}
+
+func shopSecretKey(ctx context.Context, shop string) *datastore.Key {
+	return datastore.NewKey(ctx, "ShopSecret", shop, 0, nil)
+}
+
+// shopSecret returns the key shop's links were signed with. It only reads, so
+// verifying links for made-up vendors never stores anything; a shop without a
+// secret has issued no links, and any link for it is invalid.
+func shopSecret(ctx context.Context, shop string) ([]byte, error) {
+	var s ShopSecret
+	err := datastore.Get(ctx, shopSecretKey(ctx, shop), &s)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, errLinkInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	return s.Secret, nil
+}
+
+// signingShopSecret returns the key to sign shop's links with, creating it
+// the first time. Only installed shops issue links.
+func signingShopSecret(ctx context.Context, shop string) ([]byte, error) {
+	if _, err := shops.Get(ctx, shop); err != nil {
+		return nil, err
+	}
+	key := shopSecretKey(ctx, shop)
+	var s ShopSecret
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		err := datastore.Get(tc, key, &s)
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		s.Secret = make([]byte, 32)
+		if _, err := rand.Read(s.Secret); err != nil {
+			return err
+		}
+		s.Created = time.Now()
+		_, err = datastore.Put(tc, key, &s)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.Secret, nil
+}
+
+func signLinkPayload(secret []byte, kind string, vendor string, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(kind + ":" + vendor + "/" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signLink returns the "{payload}.{signature}" path segment for a link of the
+// given kind. The payload is the base64 query the handlers already read, with
+// an expiry and a nonce added.
+func signLink(ctx context.Context, kind string, vendor string, query url.Values) (string, error) {
+	return signLinkTTL(ctx, kind, vendor, query, linkTTL)
+}
+
+// signLinkTTL is signLink for links that stay valid for ttl.
+func signLinkTTL(ctx context.Context, kind string, vendor string, query url.Values, ttl time.Duration) (string, error) {
+	secret, err := signingShopSecret(ctx, vendorShop(ctx, vendor))
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("expires", strconv.FormatInt(time.Now().Add(ttl).Unix(), 10))
+	q.Set("nonce", hex.EncodeToString(nonce))
+	payload := base64.RawURLEncoding.EncodeToString([]byte("?" + q.Encode()))
+	return payload + "." + signLinkPayload(secret, kind, vendor, payload), nil
+}
+
+// verifyLink checks a "{payload}.{signature}" path segment and returns the
+// query it carries.
+func verifyLink(ctx context.Context, kind string, vendor string, segment string) (url.Values, error) {
+	parts := strings.SplitN(segment, ".", 2)
+	if len(parts) != 2 || vendor == "" {
+		return nil, errLinkInvalid
+	}
+	secret, err := shopSecret(ctx, vendorShop(ctx, vendor))
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(parts[1]), []byte(signLinkPayload(secret, kind, vendor, parts[0]))) {
+		return nil, errLinkInvalid
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errLinkInvalid
+	}
+	parsed, err := url.Parse(string(decoded))
+	if err != nil {
+		return nil, errLinkInvalid
+	}
+	q := parsed.Query()
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || q.Get("nonce") == "" {
+		return nil, errLinkInvalid
+	}
+	if time.Now().After(time.Unix(expires, 0)) {
+		return nil, errLinkExpired
+	}
+	return q, nil
+}
+
+// linkError shows the buyer a page explaining why their link didn't work.
+func linkError(w http.ResponseWriter, err error) {
+	status := http.StatusForbidden
+	if err == errLinkExpired {
+		status = http.StatusGone
+	} else if err != errLinkInvalid {
+		status = http.StatusInternalServerError
+		err = errors.New("Something went wrong on our end. Please try again in a few minutes.")
+	}
+	w.WriteHeader(status)
+	tpl.ExecuteTemplate(w, "link-error.gohtml", struct{ Message string }{err.Error()})
+}
+
+// appProxySignatureOk verifies a request forwarded by the Shopify app proxy.
+// Shopify signs the sorted query parameters, joined without separators.
+func appProxySignatureOk(u *url.URL) bool {
+	q := u.Query()
+	signature := q.Get("signature")
+	if signature == "" {
+		return false
+	}
+	var pairs []string
+	for k, v := range q {
+		if k == "signature" {
+			continue
+		}
+		pairs = append(pairs, k+"="+strings.Join(v, ","))
+	}
+	sort.Strings(pairs)
+	mac := hmac.New(sha256.New, []byte(app.APISecret))
+	mac.Write([]byte(strings.Join(pairs, "")))
+	return hmac.Equal([]byte(signature), []byte(hex.EncodeToString(mac.Sum(nil))))
+}
+
+// serveCheckoutLink is reached from the storefront through the app proxy at
+// /apps/tixpire/checkout. It issues a signed checkout link for the product,
+// variant and quantity and sends the buyer to it. Prices are looked up when
+// the link is opened, never taken from the storefront.
+func serveCheckoutLink(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if !appProxySignatureOk(r.URL) {
+		log.Warningf(ctx, "Invalid app proxy signature")
+		linkError(w, errLinkInvalid)
+		return
+	}
+	params := r.URL.Query()
+	vendor := vendorSlug(ctx, params.Get("shop"))
+
+	query := url.Values{}
+	for _, k := range []string{"product", "variant", "qty"} {
+		query.Set(k, params.Get(k))
+	}
+	segment, err := signLink(ctx, linkCheckout, vendor, query)
+	if err != nil {
+		log.Errorf(ctx, "Sign Checkout Link Error: %s", err)
+		linkError(w, err)
+		return
+	}
+	http.Redirect(w, r, appURL+"/checkout/"+vendor+"/"+segment, http.StatusFound)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestLinkRoundTrip(t *testing.T) {
+	shops.Put(context.Background(), &ShopRecord{Domain: "links.myshopify.com", Token: "test-token"})
+	defer shops.Delete(context.Background(), "links.myshopify.com")
+	ctx, _, done := newTestContext(t)
+	defer done()
+
+	segment, err := signLink(ctx, linkCheckout, "links", url.Values{"product": {"1"}})
+	if err != nil {
+		t.Fatalf("signLink: %s", err)
+	}
+	q, err := verifyLink(ctx, linkCheckout, "links", segment)
+	if err != nil || q.Get("product") != "1" {
+		t.Fatalf("verifyLink = %v, %v", q, err)
+	}
+	if _, err := verifyLink(ctx, linkThankYou, "links", segment); err != errLinkInvalid {
+		t.Errorf("link verified as another kind: %v", err)
+	}
+	tampered := strings.Replace(segment, ".", "x.", 1)
+	if _, err := verifyLink(ctx, linkCheckout, "links", tampered); err != errLinkInvalid {
+		t.Errorf("tampered link verified: %v", err)
+	}
+}
+
+func TestVerifyLinkDoesNotCreateSecrets(t *testing.T) {
+	ctx, _, done := newTestContext(t)
+	defer done()
+
+	if _, err := verifyLink(ctx, linkCheckout, "made-up", "cGF5bG9hZA.c2ln"); err != errLinkInvalid {
+		t.Errorf("verifyLink = %v, want %v", err, errLinkInvalid)
+	}
+	if n, _ := datastore.NewQuery("ShopSecret").Count(ctx); n != 0 {
+		t.Errorf("verifying stored %d secrets", n)
+	}
+}
+
+func TestSignLinkNeedsInstalledShop(t *testing.T) {
+	ctx, _, done := newTestContext(t)
+	defer done()
+
+	if _, err := signLink(ctx, linkCheckout, "made-up", url.Values{}); err != errShopNotFound {
+		t.Errorf("signLink = %v, want %v", err, errShopNotFound)
+	}
+	if n, _ := datastore.NewQuery("ShopSecret").Count(ctx); n != 0 {
+		t.Errorf("signing for an unknown shop stored %d secrets", n)
+	}
+}
@@ -7,44 +7,33 @@ package main
 import (
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/datastore"
 	"github.com/logpacker/PayPal-Go-SDK"
-	"encoding/base64"
+	"errors"
+	"fmt"
 	"html/template"
+	"os"
 	"strconv"
 	"net/http"
-	"net/url"
 	"strings"
 	"time"
 	"math"
-	"os"
 )
 
 var tpl *template.Template
-var paymentPlanToken string
-
-Parameters {
-	Vendor: string
-	Event: string
-	Variant: string
-	Date: params.Get("date")
-	TotalDue: params.Get("total-due")
-	Qty: params.Get("qty")
-}
 
+const appURL = "https://tixpire.appspot.com"
 
-type Events struct {
-	Date:			string
-	Price:		string
-	Qty:			string
-}
-
-type PaymentSchedule {
+type PaymentSchedule struct {
+	ID 				string
 	Name 			string
+	Days 			string
 	Cycles 		string
 	Interval 	string
 	Amount 		string
 	Fee				string
 	Tax 			string
+	Currency 	string
 	Dates 		[]string
 }
 
@@ -55,274 +44,319 @@ type Checkout struct {
 	Date 			string
 	TotalDue 	string
 	Qty 			string
+	Currency 	string
 	Plans 		[]PaymentSchedule
+	Session 	string
+	Stripe 		bool
+	LogoURL 	string
+	AccentColor string
 }
 
 func init() {
 
-	tpl = template.Must(template.ParseGlob("templates/*"))
+	tpl = template.Must(template.New("").Funcs(template.FuncMap{"money": formatMoney, "inc": func(i int) int { return i + 1 }, "percent": func(f float64) string { return strconv.FormatFloat(f * 100, 'f', -1, 64) }}).ParseGlob("templates/*"))
 
 }
 
-func createBillingSchedule(today time.Time, event time.Time, total float64, feePercent float64, taxPercent float64, cycles int, interval int) (*PaymentSchedule, err string) {
-
-	estimated := today.AddDate(0, 0, 7 * interval * (cycles - 1) + 30)
-	if (estimated.After(event)) {
-		return nil, "Estimated date is after actual date"
-	}
-	time := event.Sub(today).Hours()
-	if (interval == 0) {
-		interval = math.Floor((time - 29 * 24) / ((cycles - 1) * 24 * 7))
-		if (interval == 0) {
-			return nil, "Too many cycles"
+// createBillingSchedule works out a plan of weekly-interval payments that
+// finishes the vendor's minimum number of days before the event. Either
+// cycles or interval may be zero, in which case it is chosen to fit the time
+// left.
+func createBillingSchedule(today time.Time, event time.Time, total float64, cur Currency, cfg *VendorConfig, cycles int, interval int) (*PaymentSchedule, error) {
+	feePercent := cfg.FeePercent
+	taxPercent := cfg.TaxPercent
+	minHours := float64(cfg.MinDaysBeforeEvent * 24)
+	hours := event.Sub(today).Hours()
+	if (cycles == 1) {
+		interval = 1
+	} else if (interval == 0) {
+		interval = int(math.Floor((hours - minHours) / float64((cycles - 1) * 24 * 7)))
+		if (interval < 1) {
+			return nil, errors.New("Too many cycles")
 		}
 	} else if (cycles == 0) {
-		cycles = math.Floor((time - 29 * 24) / (interval * 24 * 7))
+		cycles = int(math.Floor((hours - minHours) / float64(interval * 24 * 7)))
 		if (cycles == 1) {
-			feePercent = 0.03
-		} else if (cycles == 0) {
-			return nil, "Interval is too large"
+			feePercent = cfg.SingleFeePercent
+		} else if (cycles < 1) {
+			return nil, errors.New("Interval is too large")
 		}
 	}
+	estimated := today.AddDate(0, 0, 7 * interval * (cycles - 1) + cfg.MinDaysBeforeEvent)
+	if (estimated.After(event)) {
+		return nil, errors.New("Estimated date is after actual date")
+	}
+
 	dates := make([]string, cycles)
 	for i := 0; i < cycles; i++ {
-		dates[i] = today.AddDate(0, 0, 1 + interval * i).Format(time.UnixDate)
+		dates[i] = today.AddDate(0, 0, 1 + 7 * interval * i).Format(time.UnixDate)
 	}
-	total, _ := strconv.ParseFloat(totalDue, 64)
 
-	amount := math.Ceil(total * 100 / cycles) / 100
-	fee := math.Ceil(total * feePercent * 100) / 100
-	tax := math.Ceil(amount * taxPercent * 100) / 100
+	amount := cur.ceil(total / float64(cycles))
+	fee := cur.ceil(total * feePercent)
+	tax := cur.ceil(amount * taxPercent)
 
 	cyclesStr := strconv.Itoa(cycles)
 	intervalStr := strconv.Itoa(interval)
 
-	name := cyclesStr + " PAYMENTS OF " + amount " - " + interval + " WEEK INTERVALS"
+	name := cyclesStr + " PAYMENTS OF " + cur.display(amount) + " - " + intervalStr + " WEEK INTERVALS"
 
 	ps := PaymentSchedule {
 		Name:				name,
+		Days: 			strconv.Itoa(7 * interval * (cycles - 1)),
 		Cycles: 		cyclesStr,
 		Interval: 	intervalStr,
-		Amount: 		amount,
-		Fee: 				fee,
-		Tax: 				tax,
+		Amount: 		cur.value(amount),
+		Fee: 				cur.value(fee),
+		Tax: 				cur.value(tax),
+		Currency: 	cur.Code,
 		Dates: 			dates,
 	}
 
 	return &ps, nil
 }
 
-func createPlans(vendor string, events []Events], totalDue float64, feePercent float64, taxPercent float64, planTypes ...string) []PaymentSchedule {
-	today := time.Now()
-	date := today
-	totalDue := 0.0
-	dateForm := "2001 January 01"
-
-	// Convert dates of type string to type time.Time
-	// Find the furthest date
-	// Calculate totalDue
-	var eventDate time.Time
-	for i := 0; i < len(events); i++ {
-		if (events[i].Date == "none") {
-			eventDate = today.AddDate(0, 6, 0)
-		} else if (vendor == "taste-of-travel") {
-			thisDate, _ := time.Parse(dateForm,  strconv.Itoa(today.Year()) + " " + events[i].Date)
-			if (thisDate.Before(today)) {
-				eventDate, _ = time.Parse(dateForm, strconv.Itoa(today.Year() + 1) + " " + events[i].Date)
-			} else {
-				eventDate = thisDate
+// createPlans builds one payment schedule per plan type the vendor offers:
+// "low:high" tries the most cycles in the range that fits,
+// "low-high" tries the longest interval in weeks that fits,
+// "cycles,interval" is a fixed schedule.
+// Duplicate schedules are dropped.
+func createPlans(req *CheckoutRequest, cfg *VendorConfig) []PaymentSchedule {
+	today := time.Now().In(cfg.location())
+	event := req.Date
+	if (event.IsZero()) {
+		event = today.AddDate(0, 6, 0)
+	}
+
+	var plans []PaymentSchedule
+	for _, planType := range cfg.PlanTypes {
+		var nums []string
+		var sep string
+		for _, sep = range []string{":", "-", ","} {
+			if nums = strings.Split(planType, sep); len(nums) == 2 {
+				break
 			}
-		} else {
-			eventDate, _ = time.Parse(dateForm, events[i].Date)
 		}
-		if (eventDate.After(date)) {
-			date = eventDate
+		if (len(nums) != 2) {
+			continue
+		}
+		low, err1 := strconv.Atoi(nums[0])
+		high, err2 := strconv.Atoi(nums[1])
+		if (err1 != nil || err2 != nil) {
+			continue
 		}
-		totalDue += strconv.ParseFloat(events[i].Price, 64) * strconv.Atoi(events[i].Qty)
-	}
-
-	plans := make([]PaymentSchedule, len(planTypes))
-	for _, planType := range planTypes {
-  	if (strings.ContainsAny(planType, ":")) {
-			nums := strings.Split(planType, ":")
-			low := strconv.Atoi(nums[0])
-			high := strconv.Atoi(nums[1])
-			for i := high; i <= low; i-- {
-				plan, err := createBillingSchedule(today, date, totalDue, feePercent, taxPercent, i, 0)
-				if (err == nil) {
-					plans = append(plans, plan)
+		switch sep {
+		case ":":
+			for i := high; i >= low; i-- {
+				if plan, err := createBillingSchedule(today, event, req.Total, req.Currency, cfg, i, 0); err == nil {
+					plans = append(plans, *plan)
 					break
 				}
 			}
-		} else if (strings.ContainsAny(planType, "-")) {
-			nums := strings.Split(planType, "-")
-			low := strconv.Atoi(nums[0])
-			high := strconv.Atoi(nums[1])
-			for i := high; i <= low; i-- {
-				plan, err := createBillingSchedule(today, date, totalDue, feePercent, taxPercent, 0, i)
-				if (err == nil) {
-					plans = append(plans, plan)
+		case "-":
+			for i := high; i >= low; i-- {
+				if plan, err := createBillingSchedule(today, event, req.Total, req.Currency, cfg, 0, i); err == nil {
+					plans = append(plans, *plan)
 					break
 				}
 			}
-		} else if (strings.ContainsAny(planType, ",")) {
-			nums := strings.Split(planType, ",")
-			cycles := strconv.Atoi(nums[0])
-			interval := strconv.Atoi(nums[1])
-			plan, err := createBillingSchedule(today, date, totalDue, feePercent, taxPercent, cycles, interval)
-			if (err == nil) {
-				plans = append(plans, plan)
+		case ",":
+			if plan, err := createBillingSchedule(today, event, req.Total, req.Currency, cfg, low, high); err == nil {
+				plans = append(plans, *plan)
 			}
 		}
-  }
-	length := len(plans)
-	for j := 0; j < length; j++ {
-		for (k := j + 1; k < length; k++) {
-			if (plans[j].Cycles == plans[k].Cycles && plans[j].Interval == plans[k].Interval) {
-				plans = append(plans[:j], plans[j+1]...)
+	}
+
+	unique := plans[:0]
+	for _, plan := range plans {
+		duplicate := false
+		for _, seen := range unique {
+			if (seen.Cycles == plan.Cycles && seen.Interval == plan.Interval) {
+				duplicate = true
+				break
 			}
 		}
+		if (!duplicate) {
+			unique = append(unique, plan)
+		}
 	}
-	return plans
+	return unique
 }
 
-func createPayPalBillingPlan(event string, variant string, days string, interval string, cycles string, amount string, tax string, fee string, returnURL string, cancelURL string, c *paypalsdk.Client, r *http.Request) string {
+func createPayPalBillingPlan(shop string, event string, variant string, days string, interval string, cycles string, amount string, taxPercent string, fee string, currency string, returnURL string, cancelURL string, c *paypalsdk.Client, r *http.Request) string {
 	ctx := appengine.NewContext(r)
 	log.Debugf(ctx, "createBillingPlan amount: %s", amount)
-	plan := paypalsdk.BillingPlan {
+	intervalCount, _ := strconv.Atoi(interval)
+	totalCycles, _ := strconv.Atoi(cycles)
+
+	productID, err := payPalProductID(ctx, c, shop, event, variant)
+	if err != nil {
+		log.Errorf(ctx, "PayPal Product Error: %s", err)
+		return ""
+	}
+
+	plan := payPalPlan {
+		ProductID:   productID,
 		Name:        "Payment plan for " + event + " - " + cycles + " payments",
 		Description: cycles + " payments over the course of " + days + " days for " + event + " - " + variant + ".",
-		Type:        "fixed",
-		PaymentDefinitions: []paypalsdk.PaymentDefinition{
-			paypalsdk.PaymentDefinition{
-				Name:              "Payment Plan - " + cycles + " Payments Over " + days + " Days",
-				Type:              "REGULAR",
-				Frequency:         "WEEK",
-				FrequencyInterval: interval,
-				Amount: paypalsdk.AmountPayout{
-					Value:    amount,
-					Currency: "USD",
+		Status:      "ACTIVE",
+		BillingCycles: []payPalBillingCycle{
+			payPalBillingCycle{
+				Frequency: payPalFrequency{
+					IntervalUnit:  "WEEK",
+					IntervalCount: intervalCount,
 				},
-				Cycles: cycles,
-				ChargeModels: []paypalsdk.ChargeModel{
-					paypalsdk.ChargeModel{
-						Type: "TAX",
-						Amount: paypalsdk.AmountPayout{
-							Value:    tax,
-							Currency: "USD",
-						},
+				TenureType:  "REGULAR",
+				Sequence:    1,
+				TotalCycles: totalCycles,
+				PricingScheme: &payPalPricingScheme{
+					FixedPrice: payPalMoney{
+						Value:        amount,
+						CurrencyCode: currency,
 					},
 				},
 			},
 		},
-		MerchantPreferences: &paypalsdk.MerchantPreferences{
-			SetupFee: &paypalsdk.AmountPayout{
-				Value:    fee,
-				Currency: "USD",
+		// Failed installments are retried by the dunning job rather than
+		// rolled into the next payment, see dunning.go.
+		PaymentPreferences: payPalPaymentPreferences{
+			AutoBillOutstanding: false,
+			SetupFee: &payPalMoney{
+				Value:        fee,
+				CurrencyCode: currency,
 			},
-			ReturnURL:               returnURL,
-			CancelURL:               cancelURL,
-			AutoBillAmount:          "YES",
-			InitialFailAmountAction: "CONTINUE",
-			MaxFailAttempts:         "0",
+			SetupFeeFailureAction:   "CONTINUE",
+			PaymentFailureThreshold: 0,
+		},
+		Taxes: &payPalTaxes{
+			Percentage: taxPercent,
+			Inclusive:  false,
 		},
 	}
-	log.Debugf(ctx, "createBillingPlan plan %s", plan)
-	resp, err := c.CreateBillingPlan(plan)
+	log.Debugf(ctx, "createBillingPlan plan %+v", plan)
+	resp, err := createPayPalPlan(c, plan)
 	if err != nil {
-		log.Debugf(ctx, "Create Billing Plan Error: %s", err)
-		log.Debugf(ctx, "Response Err: %s", resp)
+		log.Errorf(ctx, "Create Billing Plan Error: %s", err)
+		return ""
 	}
-	log.Debugf(ctx, "Reponse no err: %s", resp)
-	return resp.ID
-}
+	log.Debugf(ctx, "Reponse no err: %+v", resp)
 
-func parseEncodedString(encodedQuery string) (*Parameters, err string) {
-	decodedQuery, err := base64.StdEncoding.DecodeString(encodedQuery)
-	if err != nil {
-		return nil, "Decode String Error: " + err
-	}
-	if (strings.ContainsAny(string(decodedQuery), "�")) {
-		return nil, "Contains Weird Characters"
-	}
-	parsedQuery, err := url.Parse(string(decodedQuery))
-	if err != nil {
-		return nil, "Parse URL error"
+	record := PayPalPlan {
+		Shop:      shop,
+		ReturnURL: returnURL,
+		CancelURL: cancelURL,
+		Created:   time.Now(),
 	}
-
-	params := parsedQuery.Query()
-
-	parameters := Parameters {
-		Vendor: params.Get("vendor")
-		Event: params.Get("event")
-		Variant: params.Get("variant")
-		Date: params.Get("date")
-		TotalDue: params.Get("total-due")
-		Qty: params.Get("qty")
+	if _, err := datastore.Put(ctx, datastore.NewKey(ctx, "PayPalPlan", resp.ID, 0, nil), &record); err != nil {
+		log.Errorf(ctx, "Put PayPal Plan Error: %s", err)
+		return ""
 	}
-	return &parameters, nil
+	return resp.ID
 }
 
-
 func checkout(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 
 	originalPath := r.URL.String()
 	vendorQuery := r.URL.Path[len("/checkout/"):]
 	path := strings.Split(vendorQuery, "/")
-	encodedQuery := path[1]
-
-	if (qty == "") {
+	if (len(path) < 2) {
 		http.Redirect(w, r, "/", http.StatusFound)
-    return
+		return
 	}
-
-	// num:num for Cycles
-	// num-num for interval
-	// num,num for interval, cycle
-	plans := createPlans(eventDate, totalDue, 0.07, 0.0825, 1:3, 4:4, 4-4)
-
-
-	v := Checkout {
-		Vendor: vendor,
-		Event: event,
-		Variant: variant,
-		Date: date,
-		TotalDue: strconv.FormatFloat(totalDue, 'f', -1, 64),
-		Qty: qty,
-		Plans: plans,
+	query, err := verifyLink(ctx, linkCheckout, path[0], path[1])
+	if err != nil {
+		log.Warningf(ctx, "Checkout Link Error: %s", err)
+		linkError(w, err)
+		return
+	}
+	productID, _ := strconv.ParseInt(query.Get("product"), 10, 64)
+	variantID, _ := strconv.ParseInt(query.Get("variant"), 10, 64)
+	qty, _ := strconv.Atoi(query.Get("qty"))
+	if productID <= 0 || variantID <= 0 || qty <= 0 {
+		linkError(w, errLinkInvalid)
+		return
+	}
+	tenant := vendorTenant(ctx, path[0])
+	req, err := resolveCart(ctx, tenant, productID, variantID, qty)
+	if err != nil {
+		log.Errorf(ctx, "Resolve Cart Error: %s", err)
+		http.Error(w, errCartUnavailable.Error(), http.StatusNotFound)
+		return
+	}
+	cfg, err := tenant.vendorConfig(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Get Vendor Config Error: %s", err)
+		http.Error(w, "Could not start checkout", http.StatusInternalServerError)
+		return
 	}
 
-	log.Debugf(ctx, "Checkout Struct: %s", v)
-	errr := tpl.ExecuteTemplate(w, "checkout.gohtml", v)
-	if errr != nil {
-  	log.Debugf(ctx, "Execute Template Error: %s", err)
-  }
+	cur := req.Currency
+	plans := createPlans(req, cfg)
 
 	// Initialize client
-	c, err := paypalsdk.NewClient(ctx, os.Getenv("PAYPAL_CLIENT_ID"), os.Getenv("PAYPAL_SECRET_ID"), paypalsdk.APIBaseSandBox)
+	c, err := newPayPalClient(ctx)
 	if err != nil {
-    log.Debugf(ctx, "New Client Error: %s", err)
+		log.Errorf(ctx, "New Client Error: %s", err)
+		http.Error(w, "PayPal unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	for i := range plans {
+		returnQuery := req.values()
+		returnQuery.Set("amount", plans[i].Amount)
+		returnQuery["payment-date"] = plans[i].Dates
+		returnPath, err := signLink(ctx, linkThankYou, path[0], returnQuery)
+		if err != nil {
+			log.Errorf(ctx, "Sign Thank You Link Error: %s", err)
+			http.Error(w, "Could not start checkout", http.StatusInternalServerError)
+			return
+		}
+		returnURL := appURL + "/thank-you/" + path[0] + "/" + returnPath
+		plans[i].ID = createPayPalBillingPlan(tenant.Shop, req.Event, req.Variant, plans[i].Days, plans[i].Interval, plans[i].Cycles, plans[i].Amount, strconv.FormatFloat(cfg.TaxPercent * 100, 'f', -1, 64), plans[i].Fee, cur.Code, returnURL, appURL + originalPath, c, r)
+	}
+
+	var token string
+	session, err := newCheckoutSession(tenant.Shop, req, plans)
+	if err == nil {
+		session.CheckoutURL = appURL + originalPath
+		session.ResumedFrom = query.Get("resumed")
+		token, err = saveCheckoutSession(ctx, session)
 	}
-	log.Debugf(ctx, "paypalsdk Client: %s", c)
-	// Retrieve access token
-	_, err = c.GetAccessToken()
 	if err != nil {
-    log.Debugf(ctx, "Get Access Token Error: %s", err)
+		log.Errorf(ctx, "Save Checkout Session Error: %s", err)
+		http.Error(w, "Could not start checkout", http.StatusInternalServerError)
+		return
 	}
 
-	plan1ReturnPath := []byte("?vendor=" + vendor + "&event=" + event + "&variant=" + variant + "&event-date=" + date + "&amount=" + payPlan1.Amount + plan1DatesString)
-	encodedPlan1ReturnPath := base64.StdEncoding.EncodeToString(plan1ReturnPath)
-	plan1ReturnUrl := "https://tixpire.appspot.com/thank-you/" + path[0] + "/" + encodedPlan1ReturnPath
-
-	plan2ReturnPath := []byte("?vendor=" + vendor + "&event=" + event + "&variant=" + variant + "&event-date=" + date + "&amount=" + payPlan2.Amount + plan2DatesString)
-	encodedPlan2ReturnPath := base64.StdEncoding.EncodeToString(plan2ReturnPath)
-	plan2ReturnUrl := "https://tixpire.appspot.com/thank-you/" + path[0] + "/" + encodedPlan2ReturnPath
-
-	plan3ReturnPath := []byte("?vendor=" + vendor + "&event=" + event + "&variant=" + variant + "&event-date=" + date + "&amount=" + payPlan3.Amount + plan3DatesString)
-	encodedPlan3ReturnPath := base64.StdEncoding.EncodeToString(plan3ReturnPath)
-	plan3ReturnUrl := "https://tixpire.appspot.com/thank-you/" + path[0] + "/" + encodedPlan3ReturnPath
+	vendorName := req.Vendor
+	if cfg.DisplayName != "" {
+		vendorName = cfg.DisplayName
+	}
+	var date string
+	if !req.Date.IsZero() {
+		date = req.Date.Format(cfg.DateFormat)
+	}
+	v := Checkout {
+		Vendor: vendorName,
+		Event: req.Event,
+		Variant: req.Variant,
+		Date: date,
+		TotalDue: cur.value(req.Total),
+		Qty: strconv.Itoa(req.Qty),
+		Currency: cur.Code,
+		Plans: plans,
+		Session: token,
+		Stripe: stripeEnabled(),
+		LogoURL: cfg.LogoURL,
+		AccentColor: cfg.AccentColor,
+	}
 
+	log.Debugf(ctx, "Checkout Struct: %+v", v)
+	err = tpl.ExecuteTemplate(w, "checkout.gohtml", v)
+	if err != nil {
+		log.Debugf(ctx, "Execute Template Error: %s", err)
+	}
 }
 
 
@@ -333,44 +367,103 @@ func order(w http.ResponseWriter, r *http.Request) {
   if err != nil {
   	log.Debugf(ctx, "Parse Form Error: %s", err)
   }
-	log.Debugf(ctx, "Payment Plan Id: %s", r.PostFormValue("payment-plan"))
+	planID := r.PostFormValue("payment-plan")
+	log.Debugf(ctx, "Payment Plan Id: %s", planID)
 
-	// Initialize client
-	c, err := paypalsdk.NewClient(ctx, os.Getenv("PAYPAL_CLIENT_ID"), os.Getenv("PAYPAL_SECRET_ID"), paypalsdk.APIBaseSandBox)
+	// Everything about the plan comes from the session we stored at checkout;
+	// the form only tells us which of the offered plans the buyer picked.
+	sessionID, session, err := loadCheckoutSession(ctx, r.PostFormValue("checkout-session"))
 	if err != nil {
-    log.Debugf(ctx, "New Client Error: %s", err)
+		log.Debugf(ctx, "Load Checkout Session Error: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-
-	// Retrieve access token
-	_, err = c.GetAccessToken()
+	// The email is optional and only used to send a link back to the
+	// checkout if the buyer doesn't finish.
+	if email, err := checkoutEmail(r.PostFormValue("email")); err == nil && email != "" {
+		session.Email = email
+	}
+	session.advance(checkoutPlanSelected)
+	if err := putCheckoutSession(ctx, sessionID, session); err != nil {
+		log.Errorf(ctx, "Put Checkout Session Error: %s", err)
+	}
+	if planID == payInFull {
+		startPayInFull(ctx, w, r, sessionID, session)
+		return
+	}
+	plan, err := session.plan(planID)
 	if err != nil {
-    log.Debugf(ctx, "Get Access Token Error: %s", err)
+		log.Debugf(ctx, "Checkout Session Plan Error: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for field, want := range map[string]string{"event": session.Event, "variant": session.Variant, "cycles": plan.Cycles} {
+		if got, ok := r.PostForm[field]; ok && (len(got) != 1 || got[0] != want) {
+			log.Debugf(ctx, "Order form %s %s does not match session %s", field, got, want)
+			http.Error(w, "The order form does not match this checkout. Please start again from the store.", http.StatusBadRequest)
+			return
+		}
 	}
 
-	err = c.ActivatePlan(r.PostFormValue("payment-plan"))
-	log.Debugf(ctx, "Activate Plan Error: %s", err)
-
+	var planRecord PayPalPlan
+	if err := datastore.Get(ctx, datastore.NewKey(ctx, "PayPalPlan", planID, 0, nil), &planRecord); err != nil {
+		log.Debugf(ctx, "Get PayPal Plan Error: %s", err)
+		http.Error(w, "Unknown payment plan", http.StatusBadRequest)
+		return
+	}
 
-	agreement := paypalsdk.BillingAgreement {
-		Name:        "Payment plan agreement for " + r.PostFormValue("event") + " - " + r.PostFormValue("cycles") + " payments",
-		Description: r.PostFormValue("cycles") + " payments over the course of " + r.PostFormValue("total-days") + " days for " + r.PostFormValue("event") + " - " + r.PostFormValue("variant") + ".",
-		StartDate:   paypalsdk.JSONTime(time.Now().Add(time.Hour * 24)),
-		Plan:        paypalsdk.BillingPlan{ID: r.PostFormValue("payment-plan")},
-		Payer: paypalsdk.Payer{
-			PaymentMethod: "paypal",
+	// Initialize client
+	c, err := newPayPalClient(ctx)
+	if err != nil {
+		log.Errorf(ctx, "New Client Error: %s", err)
+		http.Error(w, "PayPal unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	subscription := payPalSubscription {
+		PlanID:    planID,
+		StartTime: time.Now().Add(time.Hour * 24).UTC().Format(time.RFC3339),
+		ApplicationContext: &payPalApplicationContext{
+			ShippingPreference: "NO_SHIPPING",
+			UserAction:         "SUBSCRIBE_NOW",
+			ReturnURL:          planRecord.ReturnURL,
+			CancelURL:          planRecord.CancelURL,
 		},
 	}
-	resp, err := c.CreateBillingAgreement(agreement)
-	log.Debugf(ctx, "Create Billing Agreement Response: %s", resp)
-	log.Debugf(ctx, "Create Billing Agreement Error: %s", err)
-
-
-	approvalUrl := resp.Links[0].Href
+	// The tickets are held before the buyer is sent to PayPal so two buyers
+	// can't approve plans for the last seat.
+	if err := holdInventory(ctx, sessionID, session); err == errSoldOut {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "Hold Inventory Error: %s", err)
+		http.Error(w, "Could not reserve tickets", http.StatusBadGateway)
+		return
+	}
+	resp, err := createPayPalSubscription(c, subscription)
+	log.Debugf(ctx, "Create Subscription Response: %+v", resp)
+	if err != nil {
+		log.Errorf(ctx, "Create Subscription Error: %s", err)
+		if err := cancelInventoryHold(ctx, sessionID); err != nil {
+			log.Errorf(ctx, "Cancel Inventory Hold Error: %s", err)
+		}
+		http.Error(w, "Could not create subscription", http.StatusBadGateway)
+		return
+	}
+	if err := attachInventoryHold(ctx, sessionID, resp.ID); err != nil {
+		log.Errorf(ctx, "Attach Inventory Hold Error: %s", err)
+	}
 
-	token := strings.Split(approvalUrl, "token=")
-	paymentPlanToken = token[1]
+	session.PlanID = planID
+	session.SubscriptionID = resp.ID
+	session.advance(checkoutRedirected)
+	if err := putCheckoutSession(ctx, sessionID, session); err != nil {
+		log.Errorf(ctx, "Put Checkout Session Error: %s", err)
+		http.Error(w, "Could not save checkout", http.StatusInternalServerError)
+		return
+	}
 
-	http.Redirect(w, r, resp.Links[0].Href, http.StatusFound)
+	http.Redirect(w, r, resp.link("approve"), http.StatusFound)
 
 	/*
 
@@ -430,47 +523,177 @@ func thankyou(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 	log.Debugf(ctx, "Entered Thank You Page")
 
-	// Initialize client
-	c, err := paypalsdk.NewClient(ctx, os.Getenv("PAYPAL_CLIENT_ID"), os.Getenv("PAYPAL_SECRET_ID"), paypalsdk.APIBaseSandBox)
+	path := strings.Split(r.URL.Path[len("/thank-you/"):], "/")
+	if len(path) < 2 {
+		linkError(w, errLinkInvalid)
+		return
+	}
+	params, err := verifyLink(ctx, linkThankYou, path[0], path[1])
+	if err != nil {
+		log.Warningf(ctx, "Thank You Link Error: %s", err)
+		linkError(w, err)
+		return
+	}
+	// The payment PayPal or Stripe sends the buyer back with isn't signed, so
+	// it has to be one of this link's shop's checkouts.
+	tenant := vendorTenant(ctx, path[0])
+	req, err := parseCheckoutRequest(params, time.Now())
 	if err != nil {
-		log.Debugf(ctx, "New Client Error: %s", err)
+		log.Warningf(ctx, "Thank You Request Error: %s", err)
+		linkError(w, errLinkInvalid)
+		return
 	}
 
-	// Retrieve access token
-	_, err = c.GetAccessToken()
+	// Initialize client
+	c, err := newPayPalClient(ctx)
 	if err != nil {
-		log.Debugf(ctx, "Get Access Token Error: %s", err)
+		log.Errorf(ctx, "New Client Error: %s", err)
+		http.Error(w, "PayPal unavailable", http.StatusServiceUnavailable)
+		return
 	}
 	log.Debugf(ctx, "Got New Client and Access Token")
-	resp, err := c.ExecuteApprovedAgreement(paymentPlanToken)
-	if err != nil {
-		log.Debugf(ctx, "Decode String Error: %s", err)
+
+	var agreementID, email, tax, fee string
+	var paidInFull, planSession *CheckoutSession
+	legacy := false
+	returned := r.URL.Query()
+	if sessionID := returned.Get("pay-in-full"); sessionID != "" {
+		paidInFull, err = confirmPayInFull(ctx, tenant, c, sessionID, returned)
+		if err != nil {
+			log.Errorf(ctx, "Confirm Pay In Full Error: %s", err)
+			if err == errOtherShop {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			if err == errPaymentMismatch {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			http.Error(w, errPaymentIncomplete.Error(), http.StatusPaymentRequired)
+			return
+		}
+	} else if subscriptionID := returned.Get("subscription_id"); subscriptionID != "" {
+		resp, err := getPayPalSubscription(c, subscriptionID)
+		if err != nil {
+			log.Errorf(ctx, "Get Subscription Error: %s", err)
+			http.Error(w, "PayPal unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		log.Debugf(ctx, "Subscription %s status: %s", resp.ID, resp.Status)
+		// The return URL can be opened without ever approving the
+		// subscription, which pays nothing until it is.
+		if resp.Status != "ACTIVE" && resp.Status != "APPROVED" {
+			log.Warningf(ctx, "Thank you page for %s subscription %s", resp.Status, resp.ID)
+			http.Error(w, errPaymentIncomplete.Error(), http.StatusPaymentRequired)
+			return
+		}
+		agreementID = resp.ID
+		if resp.Subscriber != nil {
+			email = resp.Subscriber.EmailAddress
+		}
+	} else if token := returned.Get("token"); token != "" {
+		// Approvals started before the move to subscriptions still come back
+		// with an agreement token that has to be executed.
+		resp, err := c.ExecuteApprovedAgreement(token)
+		if err != nil {
+			log.Errorf(ctx, "Execute Approved Agreement Error: %s", err)
+		} else {
+			log.Debugf(ctx, "Execute Approved Agreement Response: %s", resp)
+			agreementID = resp.ID
+			legacy = true
+		}
 	}
-	log.Debugf(ctx, "Execute Approved Agreement Response: %s", resp)
 
-	vendorQuery := r.URL.Path[len("/thank-you/"):]
-	path := strings.Split(vendorQuery, "/")
-	encodedQuery := path[1]
-	decodedQuery, err := base64.StdEncoding.DecodeString(encodedQuery)
-	if err != nil {
-		log.Debugf(ctx, "Decode String Error: %s", err)
+	vendor := req.Vendor
+	event := req.Event
+	variant := req.Variant
+	date := req.dateString()
+	amount := params.Get("amount")
+	currency := req.Currency.Code
+
+	// Subscriptions record the plan the buyer actually chose, which wins over
+	// anything carried in the return URL.
+	if paidInFull != nil {
+		vendor = paidInFull.Vendor
+		event = paidInFull.Event
+		variant = paidInFull.Variant
+		date = paidInFull.Date
+		amount = paidInFull.TotalDue
+		currency = paidInFull.Currency
+		params["payment-date"] = []string{time.Now().Format(time.UnixDate)}
+	} else if agreementID == "" {
+		log.Warningf(ctx, "Thank you page without an approved payment")
+	} else if session, err := tenant.checkoutSessionForSubscription(ctx, agreementID); err == errOtherShop {
+		log.Warningf(ctx, "Subscription %s is not a checkout of %s", agreementID, tenant.Shop)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err == nil {
+		planSession = session
+		if err := approveCheckoutForSubscription(ctx, agreementID); err != nil {
+			log.Errorf(ctx, "Approve Checkout Session Error: %s", err)
+		}
+		if plan, err := session.plan(session.PlanID); err == nil {
+			vendor = session.Vendor
+			event = session.Event
+			variant = session.Variant
+			date = session.Date
+			amount = plan.Amount
+			currency = plan.Currency
+			tax = plan.Tax
+			fee = plan.Fee
+			params["payment-date"] = plan.Dates
+		}
+	} else if !legacy {
+		// Every subscription is started from a checkout session, so without
+		// one there's no plan we offered to build the order from.
+		log.Errorf(ctx, "No checkout session for subscription %s: %s", agreementID, err)
+		if err == datastore.ErrNoSuchEntity {
+			http.Error(w, "Checkout not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Could not load checkout", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	orderID := agreementID
+	if paidInFull != nil {
+		orderID = paidInFull.PaymentID
+	}
+	if agreementID != "" {
+		// Reloading the page must not reset payments already recorded on the
+		// order, so it is only created the first time through.
+		if _, err := tenant.order(ctx, agreementID); err == datastore.ErrNoSuchEntity {
+			o := newOrder(tenant.Shop, vendor, event, variant, date, agreementID, amount, params["payment-date"])
+			o.Email = email
+			o.Currency = currency
+			o.Legacy = legacy
+			o.Tax = tax
+			o.Fee = fee
+			o.ProductID = req.ProductID
+			o.VariantID = req.VariantID
+			o.Qty = req.Qty
+			o.Total = req.Currency.value(req.Total)
+			if planSession != nil {
+				o.setCart(planSession)
+			}
+			if err := tenant.putOrder(ctx, o); err != nil {
+				log.Errorf(ctx, "Put Order Error: %s", err)
+			} else if err := sendPlanLink(ctx, o); err != nil {
+				log.Errorf(ctx, "Send Plan Link Error: %s", err)
+			}
+		}
 	}
-	if (strings.ContainsAny(string(decodedQuery), "�")) {
-		http.Redirect(w, r, "/", http.StatusFound)
-    return
+	var myPlan string
+	if o, err := tenant.order(ctx, orderID); err == nil && orderID != "" {
+		if myPlan, err = planURL(ctx, o); err != nil {
+			log.Errorf(ctx, "Plan Link Error: %s", err)
+		}
 	}
-	log.Debugf(ctx, "Encoded Query String: %s", encodedQuery)
-	log.Debugf(ctx, "Decoded Query String: %s", string(decodedQuery))
-	parsedQuery, err := url.Parse(string(decodedQuery))
-	if err != nil {
-		log.Debugf(ctx, "Parse Query Error: %s", err)
+	if orderID != "" {
+		if err := syncShopifyOrder(ctx, orderID); err != nil {
+			log.Errorf(ctx, "Sync Shopify Order Error: %s", err)
+		}
 	}
-	params := parsedQuery.Query()
-	vendor := params.Get("vendor")
-	event := params.Get("event")
-	variant := params.Get("variant")
-	date := params.Get("event-date")
-	amount := params.Get("amount")
 
 	type ThankYou struct {
 		Vendor string
@@ -478,6 +701,9 @@ func thankyou(w http.ResponseWriter, r *http.Request) {
 		Variant string
 		Date string
 		Amount string
+		Currency string
+		Dates []string
+		PlanURL string
 	}
 
 	v := ThankYou {
@@ -486,6 +712,9 @@ func thankyou(w http.ResponseWriter, r *http.Request) {
 		Variant: variant,
 		Date: date,
 		Amount: amount,
+		Currency: currency,
+		Dates: params["payment-date"],
+		PlanURL: myPlan,
 	}
 
 	tpl.ExecuteTemplate(w, "thankyou.gohtml", v)
@@ -503,15 +732,34 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 
-	http.HandleFunc("/install", serveInstall)
-	http.HandleFunc("/admin", serveAdmin)
-	http.HandleFunc("/update", serveUpdate)
-	http.HandleFunc("/addCheckout", serveAddCheckout)
-	http.HandleFunc("/addProduct", serveAddProduct)
-	http.HandleFunc("/getTemplate", serveGetTemplate)
+	sessions, err := sessionStoreFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	http.HandleFunc("/install", serveInstall(sessions))
+	http.HandleFunc("/admin", withShop(sessions, serveAdmin))
+	http.HandleFunc("/update", withSessionToken(serveUpdate))
+	http.HandleFunc("/addCheckout", withSessionToken(serveAddCheckout))
+	http.HandleFunc("/addProduct", withSessionToken(serveAddProduct))
+	http.HandleFunc("/getTemplate", withSessionToken(serveGetTemplate))
+	http.HandleFunc("/vendorConfig", withSessionToken(serveVendorConfig))
 	http.HandleFunc("/checkout/", checkout)
+	http.HandleFunc("/proxy/checkout", serveCheckoutLink)
 	http.HandleFunc("/order", order)
 	http.HandleFunc("/thank-you/", thankyou)
+	http.HandleFunc("/webhooks/paypal", paypalWebhook)
+	http.HandleFunc("/webhooks/stripe", stripeWebhook)
+	http.HandleFunc(shopifyWebhookPath, shopifyWebhook)
+	http.HandleFunc("/pay-now/", payNow)
+	http.HandleFunc("/my-plan/", serveMyPlan)
+	http.HandleFunc("/tasks/dunning", serveDunning)
+	http.HandleFunc("/tasks/reconcile", serveReconcile)
+	http.HandleFunc("/tasks/inventory-holds", serveInventoryHolds)
+	http.HandleFunc("/tasks/abandoned-checkouts", serveAbandonedCheckouts)
+	http.HandleFunc("/admin/reconciliation", withShop(sessions, serveReconciliation))
+	http.HandleFunc("/admin/data-requests/", withShop(sessions, serveDataRequest))
 	http.Handle("/assets/", http.StripPrefix("/assets", http.FileServer(http.Dir("./assets"))))
 	http.HandleFunc("/", indexHandler)
 	appengine.Main()
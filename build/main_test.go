@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+
+	"tixpire/paypalfake"
+)
+
+// The app reads its configuration in init functions, which run after every
+// package variable has been initialized, so the test environment is set up
+// here. Anything already set in the environment wins.
+var _ = setTestEnv()
+
+func setTestEnv() bool {
+	for k, v := range map[string]string{
+		"SHOPIFY_API_KEY":      "test-api-key",
+		"SHOPIFY_API_SECRET":   "test-api-secret",
+		"SHOPIFY_API_REDIRECT": appURL + "/install",
+		"SESSION_SECRET":       "test-session-secret",
+		"SHOP_STORE":           "memory",
+	} {
+		if os.Getenv(k) == "" {
+			os.Setenv(k, v)
+		}
+	}
+	return true
+}
+
+// newTestInstance starts a development app server whose datastore is
+// strongly consistent, so queries see what the test just wrote.
+func newTestInstance(t *testing.T) (aetest.Instance, func()) {
+	inst, err := aetest.NewInstance(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Fatalf("NewInstance: %s", err)
+	}
+	return inst, func() { inst.Close() }
+}
+
+// newTestRequest makes a request to inst, so handlers can get a context from
+// it.
+func newTestRequest(t *testing.T, inst aetest.Instance, method string, url string, body io.Reader) *http.Request {
+	req, err := inst.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("NewRequest: %s", err)
+	}
+	return req
+}
+
+// newTestContext returns a context for a fresh instance.
+func newTestContext(t *testing.T) (context.Context, aetest.Instance, func()) {
+	inst, done := newTestInstance(t)
+	return appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil)), inst, done
+}
+
+// setEnv sets environment variables for one test and returns a function that
+// restores them.
+func setEnv(vars map[string]string) func() {
+	old := map[string]string{}
+	for k, v := range vars {
+		old[k] = os.Getenv(k)
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range old {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+// usePayPalFake points the PayPal client at a fake server. The returned
+// function shuts it down again.
+func usePayPalFake() (*paypalfake.Server, func()) {
+	fake := paypalfake.NewServer()
+	restore := setEnv(map[string]string{
+		"PAYPAL_API_BASE":  fake.URL,
+		"PAYPAL_CLIENT_ID": "test-client",
+		"PAYPAL_SECRET_ID": "test-secret",
+	})
+	return fake, func() {
+		restore()
+		fake.Close()
+	}
+}
+
+// fixture reads a file from testdata.
+func fixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("fixture %s: %s", name, err)
+	}
+	return data
+}
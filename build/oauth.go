@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// oauthStateTTL is how long a merchant has to approve the app on Shopify
+// before the install has to be started again.
+const oauthStateTTL = 5 * time.Minute
+
+var errOAuthState = errors.New("This install link is invalid or has expired. Please install the app again.")
+
+// OAuthState is the state parameter of one install attempt. It is keyed by the
+// state value itself and deleted as soon as the callback uses it, so every
+// install has its own state and none can be replayed.
+type OAuthState struct {
+	Shop    string
+	Created time.Time
+	Expires time.Time
+}
+
+func oauthStateKey(ctx context.Context, state string) *datastore.Key {
+	return datastore.NewKey(ctx, "OAuthState", state, 0, nil)
+}
+
+// newOAuthState stores a fresh state for an install of shop and returns it.
+func newOAuthState(ctx context.Context, shop string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	state := hex.EncodeToString(b)
+	now := time.Now()
+	s := OAuthState{
+		Shop:    shop,
+		Created: now,
+		Expires: now.Add(oauthStateTTL),
+	}
+	if _, err := datastore.Put(ctx, oauthStateKey(ctx, state), &s); err != nil {
+		return "", err
+	}
+
+	// Installs that were never finished leave their state behind.
+	stale, err := datastore.NewQuery("OAuthState").Filter("Expires <", now).KeysOnly().Limit(50).GetAll(ctx, nil)
+	if err == nil && len(stale) > 0 {
+		if err := datastore.DeleteMulti(ctx, stale); err != nil {
+			log.Warningf(ctx, "Delete Stale OAuth State Error: %s", err)
+		}
+	}
+	return state, nil
+}
+
+// consumeOAuthState checks that state was issued for an install of shop and
+// hasn't expired, and deletes it so it can only be used once. A callback for
+// another shop leaves the state for the install it belongs to.
+func consumeOAuthState(ctx context.Context, state string, shop string) error {
+	if state == "" {
+		return errOAuthState
+	}
+	key := oauthStateKey(ctx, state)
+	var s OAuthState
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		if err := datastore.Get(tc, key, &s); err != nil {
+			return err
+		}
+		if s.Shop != shop {
+			return errOAuthState
+		}
+		return datastore.Delete(tc, key)
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		return errOAuthState
+	} else if err != nil {
+		return err
+	}
+	if time.Now().After(s.Expires) {
+		return errOAuthState
+	}
+	return nil
+}
+
+// validShopDomain reports whether shop looks like a store's myshopify.com
+// domain, which is all Shopify ever sends.
+func validShopDomain(shop string) bool {
+	name := strings.TrimSuffix(shop, ".myshopify.com")
+	if name == shop || name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// redirectToAuthorize starts an install of the app on shop, or sends a shop
+// that has it installed to grant the scopes it is missing.
+func redirectToAuthorize(ctx context.Context, w http.ResponseWriter, r *http.Request, shop string) {
+	if !validShopDomain(shop) {
+		http.Error(w, "Invalid shop", http.StatusBadRequest)
+		return
+	}
+	state, err := newOAuthState(ctx, shop)
+	if err != nil {
+		log.Errorf(ctx, "New OAuth State Error: %s", err)
+		http.Error(w, "Could not start install", http.StatusInternalServerError)
+		return
+	}
+	target := app.AuthorizeURL(shop, strings.Join(requiredScopes, ","), state)
+	// Inside the embedded admin the redirect has to happen in the top frame.
+	if r.URL.Query().Get("embedded") == "1" || r.URL.Query().Get("id_token") != "" {
+		tpl.ExecuteTemplate(w, "authorize.gohtml", struct {
+			APIKey string
+			URL    string
+		}{app.APIKey, target})
+		return
+	}
+	http.Redirect(w, r, target, 302)
+}
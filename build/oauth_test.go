@@ -0,0 +1,159 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestOAuthStatePerInstall(t *testing.T) {
+	ctx, _, done := newTestContext(t)
+	defer done()
+
+	const shop, other = "one.myshopify.com", "two.myshopify.com"
+	first, err := newOAuthState(ctx, shop)
+	if err != nil {
+		t.Fatalf("newOAuthState: %s", err)
+	}
+	second, err := newOAuthState(ctx, shop)
+	if err != nil {
+		t.Fatalf("newOAuthState again: %s", err)
+	}
+	third, err := newOAuthState(ctx, other)
+	if err != nil {
+		t.Fatalf("newOAuthState for %s: %s", other, err)
+	}
+	fourth, err := newOAuthState(ctx, other)
+	if err != nil {
+		t.Fatalf("newOAuthState again for %s: %s", other, err)
+	}
+	if first == second || third == fourth || first == third {
+		t.Fatalf("states repeat: %s %s %s %s", first, second, third, fourth)
+	}
+
+	// A callback for one shop can't use, or use up, another shop's state.
+	if err := consumeOAuthState(ctx, third, shop); err != errOAuthState {
+		t.Errorf("consumed %s's state for %s: %v", other, shop, err)
+	}
+
+	if err := consumeOAuthState(ctx, second, shop); err != nil {
+		t.Errorf("second install: %s", err)
+	}
+	if err := consumeOAuthState(ctx, first, shop); err != nil {
+		t.Errorf("first install after the second: %s", err)
+	}
+	if err := consumeOAuthState(ctx, third, other); err != nil {
+		t.Errorf("%s install: %s", other, err)
+	}
+
+	// Each state works once.
+	for _, state := range []string{first, second, third} {
+		if err := consumeOAuthState(ctx, state, shop); err != errOAuthState {
+			t.Errorf("replayed %s: %v", state, err)
+		}
+		if err := consumeOAuthState(ctx, state, other); err != errOAuthState {
+			t.Errorf("replayed %s: %v", state, err)
+		}
+	}
+	if err := consumeOAuthState(ctx, fourth, other); err != nil {
+		t.Errorf("untouched %s install: %s", other, err)
+	}
+}
+
+func TestOAuthStateConcurrentInstalls(t *testing.T) {
+	ctx, _, done := newTestContext(t)
+	defer done()
+
+	// Several admins start installing the same shop at once.
+	const shop = "one.myshopify.com"
+	states := make([]string, 5)
+	var wg sync.WaitGroup
+	for i := range states {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			state, err := newOAuthState(ctx, shop)
+			if err != nil {
+				t.Errorf("newOAuthState: %s", err)
+			}
+			states[i] = state
+		}(i)
+	}
+	wg.Wait()
+	seen := map[string]bool{}
+	for _, state := range states {
+		if seen[state] {
+			t.Fatalf("states repeat: %v", states)
+		}
+		seen[state] = true
+	}
+
+	// Every callback arrives twice at once, as a double-clicked or replayed
+	// redirect would. Each state is only used once.
+	var mu sync.Mutex
+	consumed := map[string]int{}
+	for _, state := range states {
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(state string) {
+				defer wg.Done()
+				err := consumeOAuthState(ctx, state, shop)
+				if err != nil && err != errOAuthState {
+					t.Errorf("consumeOAuthState: %s", err)
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if err == nil {
+					consumed[state]++
+				}
+			}(state)
+		}
+	}
+	wg.Wait()
+	for _, state := range states {
+		if consumed[state] != 1 {
+			t.Errorf("state %s consumed %d times, want once", state, consumed[state])
+		}
+	}
+}
+
+func TestOAuthStateExpires(t *testing.T) {
+	ctx, _, done := newTestContext(t)
+	defer done()
+
+	const shop = "one.myshopify.com"
+	created := time.Now().Add(-oauthStateTTL - time.Minute)
+	s := OAuthState{Shop: shop, Created: created, Expires: created.Add(oauthStateTTL)}
+	if _, err := datastore.Put(ctx, oauthStateKey(ctx, "expired"), &s); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	if err := consumeOAuthState(ctx, "expired", shop); err != errOAuthState {
+		t.Errorf("expired state = %v, want %v", err, errOAuthState)
+	}
+	if err := datastore.Get(ctx, oauthStateKey(ctx, "expired"), &s); err != datastore.ErrNoSuchEntity {
+		t.Errorf("expired state kept: %v", err)
+	}
+
+	// Unfinished installs are swept up when the next one starts.
+	if _, err := datastore.Put(ctx, oauthStateKey(ctx, "abandoned"), &s); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	if _, err := newOAuthState(ctx, shop); err != nil {
+		t.Fatalf("newOAuthState: %s", err)
+	}
+	if err := datastore.Get(ctx, oauthStateKey(ctx, "abandoned"), &s); err != datastore.ErrNoSuchEntity {
+		t.Errorf("abandoned state kept: %v", err)
+	}
+}
+
+func TestOAuthStateEmpty(t *testing.T) {
+	ctx, _, done := newTestContext(t)
+	defer done()
+
+	if err := consumeOAuthState(ctx, "", "one.myshopify.com"); err != errOAuthState {
+		t.Errorf("empty state = %v, want %v", err, errOAuthState)
+	}
+}
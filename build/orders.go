@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	orderActive    = "ACTIVE"
+	orderSuspended = "SUSPENDED"
+	orderCancelled = "CANCELLED"
+	orderCompleted = "COMPLETED"
+
+	installmentScheduled = "SCHEDULED"
+	installmentPaid      = "PAID"
+	installmentFailed    = "FAILED"
+)
+
+// Order is the stored record of a buyer's payment plan. It is keyed by the
+// PayPal subscription ID so webhook events can look it up directly. Legacy
+// orders were placed through v1 billing agreements and are keyed by the
+// agreement ID instead. Orders paid in full are keyed by the PayPal order or
+// Stripe checkout session ID.
+type Order struct {
+	Shop         string
+	Vendor       string
+	Event        string
+	Variant      string
+	EventDate    string
+	EventTime    time.Time
+	Email        string
+	AgreementID  string
+	Legacy       bool
+	Provider     string
+	PayInFull    bool
+	Status       string
+	Amount       string
+	Currency     string
+	Tax          string
+	Fee          string
+	Installments []Installment
+	Created      time.Time
+	Updated      time.Time
+
+	// What was bought and the matching order in the merchant's store, see
+	// shopify_orders.go.
+	ProductID      int64
+	VariantID      int64
+	Qty            int
+	Total          string
+	ShopifyOrderID int64
+	ShopifyClaimed time.Time
+	// ShopifyPending is kept by putOrder so the reconciliation job can find
+	// orders whose sync failed, whatever their status.
+	ShopifyPending bool
+
+	// Set when the buyer asks to cancel from the plan portal, see portal.go.
+	CancelRequested time.Time
+	CancelReason    string `datastore:",noindex"`
+
+	// Dunning state, see dunning.go.
+	InDunning    bool
+	DunningSince time.Time
+	DunningStage int
+	NextRetry    time.Time
+	Flagged      bool
+	FlagReason   string
+}
+
+// Installment is one scheduled payment of an Order.
+type Installment struct {
+	Due           time.Time
+	Amount        string
+	Status        string
+	TransactionID string
+	Paid          time.Time
+	Failures      int
+
+	// PaidSeparately is set when the installment was settled by a one-off
+	// payment from the pay-now page or an early payoff, so PayPal has no
+	// charge for it on the subscription.
+	PaidSeparately bool
+
+	// ShopifyTransactionID is set once the payment has been posted to the
+	// Shopify order.
+	ShopifyTransactionID int64
+}
+
+func orderKey(ctx context.Context, agreementID string) *datastore.Key {
+	return datastore.NewKey(ctx, "Order", agreementID, 0, nil)
+}
+
+func newOrder(shop string, vendor string, event string, variant string, eventDate string, agreementID string, amount string, dates []string) *Order {
+	now := time.Now()
+	installments := make([]Installment, 0, len(dates))
+	for _, date := range dates {
+		due, err := time.Parse(time.UnixDate, date)
+		if err != nil {
+			continue
+		}
+		installments = append(installments, Installment{
+			Due:    due,
+			Amount: amount,
+			Status: installmentScheduled,
+		})
+	}
+	return &Order{
+		Shop:         shop,
+		Vendor:       vendor,
+		Event:        event,
+		Variant:      variant,
+		EventDate:    eventDate,
+		EventTime:    parseEventDate(eventDate),
+		AgreementID:  agreementID,
+		Status:       orderActive,
+		Amount:       amount,
+		Installments: installments,
+		Created:      now,
+		Updated:      now,
+	}
+}
+
+// parseEventDate understands the date formats vendors put in checkout links.
+// It returns the zero time if none of them match.
+func parseEventDate(date string) time.Time {
+	for _, layout := range []string{time.UnixDate, "2006-01-02", "January 2, 2006", "2006 January 2"} {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func getOrder(ctx context.Context, agreementID string) (*Order, error) {
+	var o Order
+	if err := datastore.Get(ctx, orderKey(ctx, agreementID), &o); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func putOrder(ctx context.Context, o *Order) error {
+	o.Updated = time.Now()
+	o.ShopifyPending = o.needsShopifySync()
+	_, err := datastore.Put(ctx, orderKey(ctx, o.AgreementID), o)
+	return err
+}
+
+// flagOrder marks the order for the merchant's attention in the admin.
+func flagOrder(ctx context.Context, agreementID string, reason string) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		o, err := getOrder(tc, agreementID)
+		if err != nil {
+			return err
+		}
+		o.Flagged = true
+		o.FlagReason = reason
+		return putOrder(tc, o)
+	}, nil)
+}
+
+// payInFullPayment is a completed single payment as reported by the provider.
+type payInFullPayment struct {
+	ID            string
+	Provider      string
+	TransactionID string
+	Amount        string
+	Currency      string
+	Email         string
+}
+
+// recordPayInFull creates or updates the order for a checkout that was paid
+// in a single payment. It is safe to call from both the thank-you page and the
+// provider's webhook, whichever comes first. The payment must be the one the
+// checkout started, for the amount and currency it offered, or nothing is
+// recorded and errPaymentMismatch is returned. An existing order for the
+// payment must belong to the checkout's shop. It returns the order, or nil if
+// there was no checkout to record it against.
+func recordPayInFull(ctx context.Context, sessionID string, p payInFullPayment) (*Order, error) {
+	session, tenant, err := checkoutSessionTenant(ctx, sessionID)
+	if err == datastore.ErrNoSuchEntity {
+		log.Warningf(ctx, "No checkout session %s for payment %s", sessionID, p.ID)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := session.checkPayment(p); err != nil {
+		log.Warningf(ctx, "Payment %s for checkout %s: %s", p.ID, sessionID, err)
+		return nil, errPaymentMismatch
+	}
+
+	o, err := tenant.order(ctx, p.ID)
+	if err == errOtherShop {
+		log.Warningf(ctx, "Payment %s for checkout %s is another store's order", p.ID, sessionID)
+		return nil, errPaymentMismatch
+	} else if err == datastore.ErrNoSuchEntity {
+		o = newOrder(session.Shop, session.Vendor, session.Event, session.Variant, session.Date, p.ID, session.TotalDue, []string{time.Now().Format(time.UnixDate)})
+		o.Currency = session.Currency
+		o.Provider = p.Provider
+		o.PayInFull = true
+		o.setCart(session)
+	} else if err != nil {
+		return nil, err
+	}
+	if o.Email == "" {
+		o.Email = p.Email
+	}
+	o.recordPayment(p.TransactionID, "", time.Now())
+	if err := tenant.putOrder(ctx, o); err != nil {
+		return nil, err
+	}
+	// Webhooks call this inside a transaction, so the session is updated
+	// directly rather than through advanceCheckoutSession.
+	session.advance(checkoutApproved)
+	return o, putCheckoutSession(ctx, sessionID, session)
+}
+
+// setCart copies what was bought from the checkout session onto the order.
+func (o *Order) setCart(session *CheckoutSession) {
+	o.ProductID = session.ProductID
+	o.VariantID = session.VariantID
+	o.Qty, _ = strconv.Atoi(session.Qty)
+	o.Total = session.TotalDue
+}
+
+// nextInstallment returns the index of the earliest installment that has not
+// been paid yet, or -1 if the plan is fully paid.
+func (o *Order) nextInstallment() int {
+	for i := range o.Installments {
+		if o.Installments[i].Status != installmentPaid {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordPayment marks the earliest unpaid installment as paid. Payments that
+// were already recorded under the same transaction ID are ignored.
+func (o *Order) recordPayment(transactionID string, amount string, at time.Time) {
+	for _, inst := range o.Installments {
+		if inst.TransactionID == transactionID {
+			return
+		}
+	}
+	i := o.nextInstallment()
+	if i == -1 {
+		// More payments than scheduled; keep them so nothing is lost.
+		o.Installments = append(o.Installments, Installment{Due: at})
+		i = len(o.Installments) - 1
+	}
+	o.Installments[i].Status = installmentPaid
+	o.Installments[i].TransactionID = transactionID
+	o.Installments[i].Paid = at
+	if amount != "" {
+		o.Installments[i].Amount = amount
+	}
+	if o.nextInstallment() == -1 {
+		o.Status = orderCompleted
+	} else if o.Status == orderSuspended {
+		o.Status = orderActive
+	}
+	if o.outstanding() == 0 {
+		o.stopDunning()
+	}
+}
+
+// recordBalancePayment marks every failed installment as paid by a single
+// payment of the outstanding balance.
+func (o *Order) recordBalancePayment(transactionID string, at time.Time) {
+	for i := range o.Installments {
+		if o.Installments[i].Status == installmentFailed {
+			o.recordSeparatePayment(transactionID+"-"+strconv.Itoa(i), at)
+		}
+	}
+}
+
+// recordSale applies a completed sale on the subscription. A sale for the
+// whole outstanding balance, as the dunning job captures, pays every failed
+// installment the way recordBalancePayment does. Any other sale pays the
+// earliest unpaid installment.
+func (o *Order) recordSale(transactionID string, amount string, at time.Time) {
+	for _, inst := range o.Installments {
+		if strings.HasPrefix(inst.TransactionID, transactionID+"-") {
+			return
+		}
+	}
+	if o.isOutstanding(amount) {
+		o.recordBalancePayment(transactionID, at)
+		return
+	}
+	o.recordPayment(transactionID, amount, at)
+}
+
+// isOutstanding reports whether amount is the order's outstanding balance.
+func (o *Order) isOutstanding(amount string) bool {
+	outstanding := o.outstanding()
+	if outstanding == 0 {
+		return false
+	}
+	cur, err := lookupCurrency(o.Currency)
+	if err != nil {
+		return false
+	}
+	paid, err := strconv.ParseFloat(amount, 64)
+	return err == nil && cur.value(paid) == cur.value(outstanding)
+}
+
+// recordSeparatePayment records a payment made outside the subscription.
+func (o *Order) recordSeparatePayment(transactionID string, at time.Time) {
+	o.recordPayment(transactionID, "", at)
+	for i := range o.Installments {
+		if o.Installments[i].TransactionID == transactionID {
+			o.Installments[i].PaidSeparately = true
+		}
+	}
+}
+
+// paidSeparately reports whether installment i was settled outside the
+// subscription.
+func (o *Order) paidSeparately(i int) bool {
+	inst := o.Installments[i]
+	return inst.Status == installmentPaid && inst.PaidSeparately
+}
+
+// recordFailure marks the earliest unpaid installment as failed and starts
+// dunning if it hasn't started already. PayPal retries a failed installment
+// until the next one is due, and that one then fails in its own right.
+func (o *Order) recordFailure(at time.Time) {
+	i := o.nextInstallment()
+	if i == -1 {
+		return
+	}
+	for i+1 < len(o.Installments) && o.Installments[i].Status == installmentFailed &&
+		o.Installments[i+1].Status != installmentPaid && !o.Installments[i+1].Due.After(at) {
+		i++
+	}
+	o.Installments[i].Status = installmentFailed
+	o.Installments[i].Failures++
+	o.startDunning(at)
+}
+
+// outstanding returns the total of all failed installments.
+// Callers format it with the order's currency, which rounds away float noise.
+func (o *Order) outstanding() float64 {
+	total := 0.0
+	for _, inst := range o.Installments {
+		if inst.Status == installmentFailed {
+			amount, _ := strconv.ParseFloat(inst.Amount, 64)
+			total += amount
+		}
+	}
+	return total
+}
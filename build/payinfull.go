@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/logpacker/PayPal-Go-SDK"
+	"google.golang.org/appengine/log"
+)
+
+var errPaymentIncomplete = errors.New("Your payment could not be completed. You have not been charged.")
+
+// startPayInFull sends the buyer to PayPal or Stripe to pay the whole cart in
+// a single payment. The amount always comes from the checkout session.
+func startPayInFull(ctx context.Context, w http.ResponseWriter, r *http.Request, sessionID string, session *CheckoutSession) {
+	req, err := session.request()
+	if err != nil {
+		log.Errorf(ctx, "Checkout Session Request Error: %s", err)
+		http.Error(w, "This checkout has no amount due.", http.StatusBadRequest)
+		return
+	}
+	cur := req.Currency
+	total := req.Total
+
+	vendor := vendorSlug(ctx, session.Shop)
+	returnQuery := req.values()
+	returnQuery.Set("amount", cur.value(total))
+	returnQuery.Set("payment-date", time.Now().Format(time.UnixDate))
+	returnPath, err := signLink(ctx, linkThankYou, vendor, returnQuery)
+	if err != nil {
+		log.Errorf(ctx, "Sign Thank You Link Error: %s", err)
+		http.Error(w, "Could not start payment", http.StatusInternalServerError)
+		return
+	}
+	returnURL := appURL + "/thank-you/" + vendor + "/" + returnPath + "?pay-in-full=" + url.QueryEscape(sessionID)
+	description := req.Event + " - " + req.Variant
+
+	if err := holdInventory(ctx, sessionID, session); err == errSoldOut {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "Hold Inventory Error: %s", err)
+		http.Error(w, "Could not reserve tickets", http.StatusBadGateway)
+		return
+	}
+	// The hold is given back if the payment can't be started.
+	started := false
+	defer func() {
+		if started {
+			return
+		}
+		if err := cancelInventoryHold(ctx, sessionID); err != nil {
+			log.Errorf(ctx, "Cancel Inventory Hold Error: %s", err)
+		}
+	}()
+
+	var paymentID, approveURL string
+	if r.PostFormValue("provider") == "stripe" && stripeEnabled() {
+		s, err := createStripeCheckout(ctx, sessionID, description, total, cur, returnURL+"&stripe-session={CHECKOUT_SESSION_ID}", session.CheckoutURL)
+		if err != nil {
+			log.Errorf(ctx, "Create Stripe Checkout Error: %s", err)
+			http.Error(w, "Could not start payment", http.StatusBadGateway)
+			return
+		}
+		paymentID, approveURL = s.ID, s.URL
+	} else {
+		c, err := newPayPalClient(ctx)
+		if err != nil {
+			log.Errorf(ctx, "New Client Error: %s", err)
+			http.Error(w, "PayPal unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		order := payPalCheckoutOrder{
+			Intent: "CAPTURE",
+			PurchaseUnits: []payPalPurchaseUnit{
+				payPalPurchaseUnit{
+					CustomID:    sessionID,
+					Description: description,
+					Amount: payPalMoney{
+						Value:        cur.value(total),
+						CurrencyCode: cur.Code,
+					},
+				},
+			},
+			ApplicationContext: &payPalApplicationContext{
+				ShippingPreference: "NO_SHIPPING",
+				UserAction:         "PAY_NOW",
+				ReturnURL:          returnURL,
+				CancelURL:          session.CheckoutURL,
+			},
+		}
+		resp, err := createPayPalCheckoutOrder(c, order)
+		if err != nil {
+			log.Errorf(ctx, "Create Order Error: %s", err)
+			http.Error(w, "Could not start payment", http.StatusBadGateway)
+			return
+		}
+		paymentID, approveURL = resp.ID, resp.link("approve")
+	}
+	started = true
+	if err := attachInventoryHold(ctx, sessionID, paymentID); err != nil {
+		log.Errorf(ctx, "Attach Inventory Hold Error: %s", err)
+	}
+
+	session.PlanID = payInFull
+	session.PaymentID = paymentID
+	session.advance(checkoutRedirected)
+	if err := putCheckoutSession(ctx, sessionID, session); err != nil {
+		log.Errorf(ctx, "Put Checkout Session Error: %s", err)
+		http.Error(w, "Could not save checkout", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, approveURL, http.StatusFound)
+}
+
+// confirmPayInFull completes a pay-in-full checkout when the buyer comes back
+// from the provider and records the order. The checkout must be one of the
+// tenant's.
+func confirmPayInFull(ctx context.Context, t Tenant, c *paypalsdk.Client, sessionID string, returned url.Values) (*CheckoutSession, error) {
+	session, err := t.checkoutSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.PlanID != payInFull || session.PaymentID == "" {
+		return nil, errPlanMismatch
+	}
+
+	if stripeSession := returned.Get("stripe-session"); stripeSession != "" {
+		s, err := getStripeCheckout(ctx, stripeSession)
+		if err != nil {
+			return nil, err
+		}
+		if s.ID != session.PaymentID || s.ClientReferenceID != sessionID || s.PaymentStatus != "paid" {
+			return nil, errPaymentIncomplete
+		}
+		_, err = recordPayInFull(ctx, sessionID, stripePayment(s))
+		return session, err
+	}
+
+	if returned.Get("token") != session.PaymentID {
+		return nil, errPaymentIncomplete
+	}
+	resp, err := capturePayPalCheckoutOrder(c, session.PaymentID)
+	if err != nil {
+		return nil, err
+	}
+	capture := resp.capture()
+	if resp.Status != "COMPLETED" || capture == nil || capture.CustomID != sessionID {
+		return nil, errPaymentIncomplete
+	}
+	_, err = recordPayInFull(ctx, sessionID, payInFullPayment{
+		ID:            resp.ID,
+		Provider:      "paypal",
+		TransactionID: capture.ID,
+		Amount:        capture.Amount.Value,
+		Currency:      capture.Amount.CurrencyCode,
+	})
+	return session, err
+}
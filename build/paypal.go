@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/logpacker/PayPal-Go-SDK"
+	"google.golang.org/appengine/datastore"
+)
+
+// newPayPalClient returns a PayPal client that already holds an access token.
+// PAYPAL_API_BASE overrides the sandbox, e.g. to point at a paypalfake server
+// during local development.
+func newPayPalClient(ctx context.Context) (*paypalsdk.Client, error) {
+	base := os.Getenv("PAYPAL_API_BASE")
+	if base == "" {
+		base = paypalsdk.APIBaseSandBox
+	}
+	c, err := paypalsdk.NewClient(ctx, os.Getenv("PAYPAL_CLIENT_ID"), os.Getenv("PAYPAL_SECRET_ID"), base)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.GetAccessToken(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type verifyWebhookRequest struct {
+	AuthAlgo         string          `json:"auth_algo"`
+	CertURL          string          `json:"cert_url"`
+	TransmissionID   string          `json:"transmission_id"`
+	TransmissionSig  string          `json:"transmission_sig"`
+	TransmissionTime string          `json:"transmission_time"`
+	WebhookID        string          `json:"webhook_id"`
+	WebhookEvent     json.RawMessage `json:"webhook_event"`
+}
+
+type verifyWebhookResponse struct {
+	VerificationStatus string `json:"verification_status"`
+}
+
+// verifyWebhookSignature asks PayPal whether body was signed for our webhook,
+// using the transmission headers PayPal sent along with it.
+func verifyWebhookSignature(c *paypalsdk.Client, h http.Header, body []byte) (bool, error) {
+	v := verifyWebhookRequest{
+		AuthAlgo:         h.Get("PAYPAL-AUTH-ALGO"),
+		CertURL:          h.Get("PAYPAL-CERT-URL"),
+		TransmissionID:   h.Get("PAYPAL-TRANSMISSION-ID"),
+		TransmissionSig:  h.Get("PAYPAL-TRANSMISSION-SIG"),
+		TransmissionTime: h.Get("PAYPAL-TRANSMISSION-TIME"),
+		WebhookID:        os.Getenv("PAYPAL_WEBHOOK_ID"),
+		WebhookEvent:     json.RawMessage(body),
+	}
+	req, err := c.NewRequest("POST", c.APIBase+"/v1/notifications/verify-webhook-signature", v)
+	if err != nil {
+		return false, err
+	}
+	resp := &verifyWebhookResponse{}
+	if err := c.SendWithAuth(req, resp); err != nil {
+		return false, err
+	}
+	return resp.VerificationStatus == "SUCCESS", nil
+}
+
+// PayPal Subscriptions API (v2). Plans hang off a catalog product, and a
+// subscription is approved by the buyer and becomes active without a separate
+// execute call.
+
+type payPalMoney struct {
+	Value        string `json:"value"`
+	CurrencyCode string `json:"currency_code"`
+}
+
+type payPalLink struct {
+	Href   string `json:"href"`
+	Rel    string `json:"rel"`
+	Method string `json:"method,omitempty"`
+}
+
+type payPalProduct struct {
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Type        string `json:"type"`
+	Category    string `json:"category,omitempty"`
+}
+
+type payPalFrequency struct {
+	IntervalUnit  string `json:"interval_unit"`
+	IntervalCount int    `json:"interval_count"`
+}
+
+type payPalPricingScheme struct {
+	FixedPrice payPalMoney `json:"fixed_price"`
+}
+
+type payPalBillingCycle struct {
+	Frequency     payPalFrequency      `json:"frequency"`
+	TenureType    string               `json:"tenure_type"`
+	Sequence      int                  `json:"sequence"`
+	TotalCycles   int                  `json:"total_cycles"`
+	PricingScheme *payPalPricingScheme `json:"pricing_scheme,omitempty"`
+}
+
+type payPalPaymentPreferences struct {
+	AutoBillOutstanding     bool         `json:"auto_bill_outstanding"`
+	SetupFee                *payPalMoney `json:"setup_fee,omitempty"`
+	SetupFeeFailureAction   string       `json:"setup_fee_failure_action,omitempty"`
+	PaymentFailureThreshold int          `json:"payment_failure_threshold"`
+}
+
+type payPalTaxes struct {
+	Percentage string `json:"percentage"`
+	Inclusive  bool   `json:"inclusive"`
+}
+
+type payPalPlan struct {
+	ID                 string                   `json:"id,omitempty"`
+	ProductID          string                   `json:"product_id"`
+	Name               string                   `json:"name"`
+	Description        string                   `json:"description,omitempty"`
+	Status             string                   `json:"status,omitempty"`
+	BillingCycles      []payPalBillingCycle     `json:"billing_cycles"`
+	PaymentPreferences payPalPaymentPreferences `json:"payment_preferences"`
+	Taxes              *payPalTaxes             `json:"taxes,omitempty"`
+}
+
+type payPalApplicationContext struct {
+	BrandName          string `json:"brand_name,omitempty"`
+	ShippingPreference string `json:"shipping_preference,omitempty"`
+	UserAction         string `json:"user_action,omitempty"`
+	ReturnURL          string `json:"return_url"`
+	CancelURL          string `json:"cancel_url"`
+}
+
+type payPalSubscriber struct {
+	EmailAddress string `json:"email_address,omitempty"`
+	PayerID      string `json:"payer_id,omitempty"`
+}
+
+type payPalSubscription struct {
+	ID                 string                    `json:"id,omitempty"`
+	PlanID             string                    `json:"plan_id"`
+	Status             string                    `json:"status,omitempty"`
+	StartTime          string                    `json:"start_time,omitempty"`
+	Subscriber         *payPalSubscriber         `json:"subscriber,omitempty"`
+	ApplicationContext *payPalApplicationContext `json:"application_context,omitempty"`
+	Links              []payPalLink              `json:"links,omitempty"`
+}
+
+// PayPalPlan is stored under the PayPal plan ID. v2 plans no longer carry the
+// return and cancel URLs, so we keep them here for when the buyer subscribes.
+type PayPalPlan struct {
+	Shop      string
+	ReturnURL string `datastore:",noindex"`
+	CancelURL string `datastore:",noindex"`
+	Created   time.Time
+}
+
+// PayPalProduct is the catalog product that a shop's plans for one event and
+// variant are created under, so checkouts reuse it rather than adding a
+// product to the catalog every time the page is viewed. It is keyed by
+// payPalProductKey.
+type PayPalProduct struct {
+	Shop      string
+	Event     string `datastore:",noindex"`
+	Variant   string `datastore:",noindex"`
+	ProductID string `datastore:",noindex"`
+	Created   time.Time
+}
+
+// payPalProductKey hashes the names, which can be longer than a key allows.
+func payPalProductKey(ctx context.Context, shop string, event string, variant string) *datastore.Key {
+	sum := sha256.Sum256([]byte(shop + "\x00" + event + "\x00" + variant))
+	return datastore.NewKey(ctx, "PayPalProduct", hex.EncodeToString(sum[:]), 0, nil)
+}
+
+// payPalProductID returns the ID of the product for shop's event and variant,
+// creating it the first time. Two checkouts racing for a new event may both
+// create one; the loser's is left unused in the catalog.
+func payPalProductID(ctx context.Context, c *paypalsdk.Client, shop string, event string, variant string) (string, error) {
+	key := payPalProductKey(ctx, shop, event, variant)
+	var stored PayPalProduct
+	err := datastore.Get(ctx, key, &stored)
+	if err == nil && stored.ProductID != "" {
+		return stored.ProductID, nil
+	} else if err != nil && err != datastore.ErrNoSuchEntity {
+		return "", err
+	}
+	product, err := createPayPalProduct(c, payPalProduct{
+		Name:        event,
+		Description: event + " - " + variant,
+		Type:        "SERVICE",
+	})
+	if err != nil {
+		return "", err
+	}
+	stored = PayPalProduct{
+		Shop:      shop,
+		Event:     event,
+		Variant:   variant,
+		ProductID: product.ID,
+		Created:   time.Now(),
+	}
+	if _, err := datastore.Put(ctx, key, &stored); err != nil {
+		return "", err
+	}
+	return product.ID, nil
+}
+
+// link returns the href of the link with the given rel, or "".
+func (s *payPalSubscription) link(rel string) string {
+	for _, l := range s.Links {
+		if l.Rel == rel {
+			return l.Href
+		}
+	}
+	return ""
+}
+
+func createPayPalProduct(c *paypalsdk.Client, product payPalProduct) (*payPalProduct, error) {
+	req, err := c.NewRequest("POST", c.APIBase+"/v1/catalogs/products", product)
+	if err != nil {
+		return nil, err
+	}
+	resp := &payPalProduct{}
+	if err := c.SendWithAuth(req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func createPayPalPlan(c *paypalsdk.Client, plan payPalPlan) (*payPalPlan, error) {
+	req, err := c.NewRequest("POST", c.APIBase+"/v1/billing/plans", plan)
+	if err != nil {
+		return nil, err
+	}
+	resp := &payPalPlan{}
+	if err := c.SendWithAuth(req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func createPayPalSubscription(c *paypalsdk.Client, sub payPalSubscription) (*payPalSubscription, error) {
+	req, err := c.NewRequest("POST", c.APIBase+"/v1/billing/subscriptions", sub)
+	if err != nil {
+		return nil, err
+	}
+	resp := &payPalSubscription{}
+	if err := c.SendWithAuth(req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func getPayPalSubscription(c *paypalsdk.Client, id string) (*payPalSubscription, error) {
+	req, err := c.NewRequest("GET", c.APIBase+"/v1/billing/subscriptions/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp := &payPalSubscription{}
+	if err := c.SendWithAuth(req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// payPalAgreement is the subset of a legacy v1 billing agreement we still read
+// for orders placed before the move to subscriptions.
+type payPalAgreement struct {
+	ID          string `json:"id"`
+	State       string `json:"state"`
+	Description string `json:"description"`
+}
+
+func getPayPalAgreement(c *paypalsdk.Client, id string) (*payPalAgreement, error) {
+	req, err := c.NewRequest("GET", c.APIBase+"/v1/payments/billing-agreements/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp := &payPalAgreement{}
+	if err := c.SendWithAuth(req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// payPalOrderStatus returns the current PayPal status of o, reading legacy
+// agreements through the v1 API and everything else as a subscription.
+func payPalOrderStatus(c *paypalsdk.Client, o *Order) (string, error) {
+	if o.Legacy {
+		a, err := getPayPalAgreement(c, o.AgreementID)
+		if err != nil {
+			return "", err
+		}
+		return strings.ToUpper(a.State), nil
+	}
+	s, err := getPayPalSubscription(c, o.AgreementID)
+	if err != nil {
+		return "", err
+	}
+	return s.Status, nil
+}
+
+type payPalCaptureRequest struct {
+	Note        string      `json:"note"`
+	CaptureType string      `json:"capture_type"`
+	Amount      payPalMoney `json:"amount"`
+}
+
+type payPalLegacyAmount struct {
+	Value    string `json:"value"`
+	Currency string `json:"currency"`
+}
+
+type payPalBillBalanceRequest struct {
+	Note   string             `json:"note"`
+	Amount payPalLegacyAmount `json:"amount"`
+}
+
+// chargeOutstanding asks PayPal to charge amount of the outstanding balance on
+// the order's subscription or legacy agreement right away.
+func chargeOutstanding(c *paypalsdk.Client, o *Order, amount string, note string) error {
+	cur, err := lookupCurrency(o.Currency)
+	if err != nil {
+		return err
+	}
+	currency := cur.Code
+	var url string
+	var body interface{}
+	if o.Legacy {
+		url = c.APIBase + "/v1/payments/billing-agreements/" + o.AgreementID + "/bill-balance"
+		body = payPalBillBalanceRequest{
+			Note:   note,
+			Amount: payPalLegacyAmount{Value: amount, Currency: currency},
+		}
+	} else {
+		url = c.APIBase + "/v1/billing/subscriptions/" + o.AgreementID + "/capture"
+		body = payPalCaptureRequest{
+			Note:        note,
+			CaptureType: "OUTSTANDING_BALANCE",
+			Amount:      payPalMoney{Value: amount, CurrencyCode: currency},
+		}
+	}
+	req, err := c.NewRequest("POST", url, body)
+	if err != nil {
+		return err
+	}
+	return c.SendWithAuth(req, nil)
+}
+
+// cancelPayPalOrder cancels the order's subscription or legacy agreement.
+func cancelPayPalOrder(c *paypalsdk.Client, o *Order, reason string) error {
+	return changePayPalOrder(c, o, "cancel", "cancel", reason)
+}
+
+// suspendPayPalOrder pauses the order's subscription or legacy agreement so
+// nothing is charged until it is activated again or cancelled.
+func suspendPayPalOrder(c *paypalsdk.Client, o *Order, reason string) error {
+	return changePayPalOrder(c, o, "suspend", "suspend", reason)
+}
+
+// activatePayPalOrder resumes a subscription or legacy agreement paused by
+// suspendPayPalOrder.
+func activatePayPalOrder(c *paypalsdk.Client, o *Order, reason string) error {
+	return changePayPalOrder(c, o, "activate", "re-activate", reason)
+}
+
+// changePayPalOrder posts a status change to the order's subscription, or to
+// its legacy agreement, which names some actions differently and takes the
+// reason as a note.
+func changePayPalOrder(c *paypalsdk.Client, o *Order, action string, legacyAction string, reason string) error {
+	var url string
+	var body interface{}
+	if o.Legacy {
+		url = c.APIBase + "/v1/payments/billing-agreements/" + o.AgreementID + "/" + legacyAction
+		body = map[string]string{"note": reason}
+	} else {
+		url = c.APIBase + "/v1/billing/subscriptions/" + o.AgreementID + "/" + action
+		body = map[string]string{"reason": reason}
+	}
+	req, err := c.NewRequest("POST", url, body)
+	if err != nil {
+		return err
+	}
+	return c.SendWithAuth(req, nil)
+}
+
+// PayPal Orders API (v2), used for one-off payments outside a subscription.
+
+type payPalPurchaseUnit struct {
+	ReferenceID string      `json:"reference_id,omitempty"`
+	CustomID    string      `json:"custom_id,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Amount      payPalMoney `json:"amount"`
+	Payments    *struct {
+		Captures []payPalCapture `json:"captures"`
+	} `json:"payments,omitempty"`
+}
+
+type payPalCapture struct {
+	ID       string      `json:"id"`
+	Status   string      `json:"status"`
+	CustomID string      `json:"custom_id"`
+	Amount   payPalMoney `json:"amount"`
+}
+
+type payPalCheckoutOrder struct {
+	ID                 string                    `json:"id,omitempty"`
+	Intent             string                    `json:"intent,omitempty"`
+	Status             string                    `json:"status,omitempty"`
+	PurchaseUnits      []payPalPurchaseUnit      `json:"purchase_units"`
+	ApplicationContext *payPalApplicationContext `json:"application_context,omitempty"`
+	Links              []payPalLink              `json:"links,omitempty"`
+}
+
+func (o *payPalCheckoutOrder) link(rel string) string {
+	for _, l := range o.Links {
+		if l.Rel == rel {
+			return l.Href
+		}
+	}
+	return ""
+}
+
+// capture returns the first capture of a completed checkout order, or nil.
+func (o *payPalCheckoutOrder) capture() *payPalCapture {
+	for _, unit := range o.PurchaseUnits {
+		if unit.Payments != nil && len(unit.Payments.Captures) > 0 {
+			return &unit.Payments.Captures[0]
+		}
+	}
+	return nil
+}
+
+func createPayPalCheckoutOrder(c *paypalsdk.Client, order payPalCheckoutOrder) (*payPalCheckoutOrder, error) {
+	req, err := c.NewRequest("POST", c.APIBase+"/v2/checkout/orders", order)
+	if err != nil {
+		return nil, err
+	}
+	resp := &payPalCheckoutOrder{}
+	if err := c.SendWithAuth(req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func capturePayPalCheckoutOrder(c *paypalsdk.Client, id string) (*payPalCheckoutOrder, error) {
+	req, err := c.NewRequest("POST", c.APIBase+"/v2/checkout/orders/"+id+"/capture", struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	resp := &payPalCheckoutOrder{}
+	if err := c.SendWithAuth(req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
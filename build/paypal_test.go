@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPayPalProductReused(t *testing.T) {
+	fake, stop := usePayPalFake()
+	defer stop()
+	ctx, _, done := newTestContext(t)
+	defer done()
+	c, err := newPayPalClient(ctx)
+	if err != nil {
+		t.Fatalf("newPayPalClient: %s", err)
+	}
+
+	first, err := payPalProductID(ctx, c, "shop.myshopify.com", "Event", "General")
+	if err != nil {
+		t.Fatalf("payPalProductID: %s", err)
+	}
+	again, err := payPalProductID(ctx, c, "shop.myshopify.com", "Event", "General")
+	if err != nil {
+		t.Fatalf("payPalProductID again: %s", err)
+	}
+	if again != first {
+		t.Errorf("second checkout got product %s, want %s", again, first)
+	}
+	other, err := payPalProductID(ctx, c, "shop.myshopify.com", "Event", "VIP")
+	if err != nil {
+		t.Fatalf("payPalProductID other variant: %s", err)
+	}
+	if other == first {
+		t.Errorf("another variant reused product %s", first)
+	}
+	if len(fake.Products) != 2 {
+		t.Errorf("created %d products, want 2", len(fake.Products))
+	}
+}
@@ -0,0 +1,491 @@
+// Package paypalfake is an in-memory stand-in for the parts of the PayPal REST
+// API that Tixpire calls. It lets the checkout → approval → thank-you round
+// trip run in tests or during local development without network access.
+//
+// Point the app at it by setting PAYPAL_API_BASE to the server's URL. Approval
+// links returned by the fake lead to its own /checkoutnow page, which approves
+// the subscription or order straight away and redirects to the return URL the
+// way PayPal does.
+package paypalfake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessToken is the bearer token handed out by the fake token endpoint.
+const AccessToken = "fake-access-token"
+
+// Server is a fake PayPal API. The zero value is not usable; call NewHandler
+// or NewServer.
+type Server struct {
+	// URL is the base URL of the server, used to build approval links.
+	URL string
+
+	// RejectWebhooks makes signature verification fail, to exercise the
+	// webhook handler's rejection path.
+	RejectWebhooks bool
+
+	// Fail makes the named action ("get", "capture", "suspend", "cancel"
+	// and so on) answer with a server error wherever it is requested, to
+	// exercise the app's recovery paths.
+	Fail map[string]bool
+
+	mu            sync.Mutex
+	nextID        int
+	Products      map[string]map[string]interface{}
+	Plans         map[string]map[string]interface{}
+	Subscriptions map[string]*Subscription
+	Orders        map[string]*Order
+	Agreements    map[string]string
+	Captures      []Capture
+
+	mux *http.ServeMux
+	ts  *httptest.Server
+}
+
+// Subscription is a v2 subscription as stored by the fake.
+type Subscription struct {
+	ID        string
+	PlanID    string
+	Status    string
+	StartTime string
+	ReturnURL string
+	CancelURL string
+}
+
+// Order is a v2 checkout order as stored by the fake.
+type Order struct {
+	ID        string
+	Status    string
+	CustomID  string
+	Amount    Money
+	ReturnURL string
+	CancelURL string
+	CaptureID string
+}
+
+// Money is a PayPal v2 amount.
+type Money struct {
+	Value        string `json:"value"`
+	CurrencyCode string `json:"currency_code"`
+}
+
+// Capture records a charge made through the subscription capture or legacy
+// bill-balance endpoints.
+type Capture struct {
+	AgreementID string
+	Amount      string
+}
+
+// NewHandler returns a fake whose approval links point at baseURL.
+func NewHandler(baseURL string) *Server {
+	s := &Server{
+		URL:           strings.TrimSuffix(baseURL, "/"),
+		Products:      map[string]map[string]interface{}{},
+		Plans:         map[string]map[string]interface{}{},
+		Subscriptions: map[string]*Subscription{},
+		Orders:        map[string]*Order{},
+		Agreements:    map[string]string{},
+		Fail:          map[string]bool{},
+		mux:           http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/v1/oauth2/token", s.serveToken)
+	s.mux.HandleFunc("/v1/catalogs/products", s.authed(s.serveProducts))
+	s.mux.HandleFunc("/v1/billing/plans", s.authed(s.servePlans))
+	s.mux.HandleFunc("/v1/billing/subscriptions", s.authed(s.serveCreateSubscription))
+	s.mux.HandleFunc("/v1/billing/subscriptions/", s.authed(s.serveSubscription))
+	s.mux.HandleFunc("/v1/payments/billing-agreements/", s.authed(s.serveAgreement))
+	s.mux.HandleFunc("/v2/checkout/orders", s.authed(s.serveCreateOrder))
+	s.mux.HandleFunc("/v2/checkout/orders/", s.authed(s.serveOrder))
+	s.mux.HandleFunc("/v1/notifications/verify-webhook-signature", s.authed(s.serveVerifyWebhook))
+	s.mux.HandleFunc("/checkoutnow", s.serveApprove)
+	return s
+}
+
+// NewServer starts a fake on a local httptest server. Callers should Close
+// it when done.
+func NewServer() *Server {
+	s := NewHandler("")
+	s.ts = httptest.NewServer(s)
+	s.URL = s.ts.URL
+	return s
+}
+
+// Close shuts down a server started with NewServer.
+func (s *Server) Close() {
+	if s.ts != nil {
+		s.ts.Close()
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) id(prefix string) string {
+	s.nextID++
+	return fmt.Sprintf("%s-FAKE%08d", prefix, s.nextID)
+}
+
+func (s *Server) authed(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+AccessToken {
+			writeError(w, http.StatusUnauthorized, "AUTHENTICATION_FAILURE")
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		h(w, r)
+	}
+}
+
+// failed answers with a server error if the action in the path is set to
+// fail. Reading the resource itself is the "get" action.
+func (s *Server) failed(w http.ResponseWriter, parts []string) bool {
+	action := "get"
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	if !s.Fail[action] {
+		return false
+	}
+	writeError(w, http.StatusInternalServerError, "INTERNAL_SERVICE_ERROR")
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, name string) {
+	writeJSON(w, status, map[string]string{"name": name, "message": name})
+}
+
+func decode(r *http.Request, v interface{}) bool {
+	return json.NewDecoder(r.Body).Decode(v) == nil
+}
+
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := r.BasicAuth(); !ok || r.Method != "POST" {
+		writeError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": AccessToken,
+		"token_type":   "Bearer",
+		"app_id":       "APP-FAKE",
+		"expires_in":   32400,
+	})
+}
+
+func (s *Server) serveProducts(w http.ResponseWriter, r *http.Request) {
+	var product map[string]interface{}
+	if r.Method != "POST" || !decode(r, &product) || product["name"] == nil {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST")
+		return
+	}
+	product["id"] = s.id("PROD")
+	s.Products[product["id"].(string)] = product
+	writeJSON(w, http.StatusCreated, product)
+}
+
+func (s *Server) servePlans(w http.ResponseWriter, r *http.Request) {
+	var plan map[string]interface{}
+	if r.Method != "POST" || !decode(r, &plan) {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST")
+		return
+	}
+	productID, _ := plan["product_id"].(string)
+	if _, ok := s.Products[productID]; !ok {
+		writeError(w, http.StatusUnprocessableEntity, "INVALID_PRODUCT_ID")
+		return
+	}
+	plan["id"] = s.id("P")
+	if plan["status"] == nil {
+		plan["status"] = "ACTIVE"
+	}
+	s.Plans[plan["id"].(string)] = plan
+	writeJSON(w, http.StatusCreated, plan)
+}
+
+type subscriptionRequest struct {
+	PlanID             string `json:"plan_id"`
+	StartTime          string `json:"start_time"`
+	ApplicationContext struct {
+		ReturnURL string `json:"return_url"`
+		CancelURL string `json:"cancel_url"`
+	} `json:"application_context"`
+}
+
+func (s *Server) subscriptionJSON(sub *Subscription) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         sub.ID,
+		"plan_id":    sub.PlanID,
+		"status":     sub.Status,
+		"start_time": sub.StartTime,
+		"subscriber": map[string]string{
+			"email_address": "buyer@example.com",
+			"payer_id":      "FAKEPAYER",
+		},
+		"links": []map[string]string{
+			{"href": s.URL + "/checkoutnow?token=" + sub.ID, "rel": "approve", "method": "GET"},
+			{"href": s.URL + "/v1/billing/subscriptions/" + sub.ID, "rel": "self", "method": "GET"},
+		},
+	}
+}
+
+func (s *Server) serveCreateSubscription(w http.ResponseWriter, r *http.Request) {
+	var req subscriptionRequest
+	if r.Method != "POST" || !decode(r, &req) {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST")
+		return
+	}
+	if _, ok := s.Plans[req.PlanID]; !ok {
+		writeError(w, http.StatusUnprocessableEntity, "INVALID_PLAN_ID")
+		return
+	}
+	sub := &Subscription{
+		ID:        s.id("I"),
+		PlanID:    req.PlanID,
+		Status:    "APPROVAL_PENDING",
+		StartTime: req.StartTime,
+		ReturnURL: req.ApplicationContext.ReturnURL,
+		CancelURL: req.ApplicationContext.CancelURL,
+	}
+	s.Subscriptions[sub.ID] = sub
+	writeJSON(w, http.StatusCreated, s.subscriptionJSON(sub))
+}
+
+// serveSubscription handles GET /v1/billing/subscriptions/{id} and the
+// capture, suspend, activate and cancel actions under it.
+func (s *Server) serveSubscription(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/billing/subscriptions/"), "/")
+	sub, ok := s.Subscriptions[parts[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "RESOURCE_NOT_FOUND")
+		return
+	}
+	if s.failed(w, parts) {
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		writeJSON(w, http.StatusOK, s.subscriptionJSON(sub))
+	case len(parts) == 2 && parts[1] == "capture" && r.Method == "POST":
+		var req struct {
+			Amount Money `json:"amount"`
+		}
+		decode(r, &req)
+		s.Captures = append(s.Captures, Capture{AgreementID: sub.ID, Amount: req.Amount.Value})
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"id": s.id("CAP"), "status": "COMPLETED", "amount_with_breakdown": map[string]Money{"gross_amount": req.Amount}})
+	case len(parts) == 2 && parts[1] == "suspend" && r.Method == "POST":
+		sub.Status = "SUSPENDED"
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "activate" && r.Method == "POST":
+		sub.Status = "ACTIVE"
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "cancel" && r.Method == "POST":
+		if sub.Status == "CANCELLED" {
+			writeError(w, http.StatusUnprocessableEntity, "UNPROCESSABLE_ENTITY")
+			return
+		}
+		sub.Status = "CANCELLED"
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotFound, "RESOURCE_NOT_FOUND")
+	}
+}
+
+// serveAgreement covers the legacy v1 agreement calls that are still made for
+// orders placed before subscriptions: execute, get, bill-balance, suspend,
+// re-activate and cancel.
+func (s *Server) serveAgreement(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/payments/billing-agreements/"), "/")
+	if len(parts) == 2 && parts[1] == "agreement-execute" && r.Method == "POST" {
+		id := s.id("I")
+		s.Agreements[id] = "Active"
+		writeJSON(w, http.StatusOK, map[string]string{"id": id, "state": "Active"})
+		return
+	}
+	state, ok := s.Agreements[parts[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "INVALID_PROFILE_ID")
+		return
+	}
+	if s.failed(w, parts) {
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		writeJSON(w, http.StatusOK, map[string]string{"id": parts[0], "state": state})
+	case len(parts) == 2 && parts[1] == "bill-balance" && r.Method == "POST":
+		var req struct {
+			Amount struct {
+				Value string `json:"value"`
+			} `json:"amount"`
+		}
+		decode(r, &req)
+		s.Captures = append(s.Captures, Capture{AgreementID: parts[0], Amount: req.Amount.Value})
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "suspend" && r.Method == "POST":
+		s.Agreements[parts[0]] = "Suspended"
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "re-activate" && r.Method == "POST":
+		s.Agreements[parts[0]] = "Active"
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "cancel" && r.Method == "POST":
+		if state == "Cancelled" {
+			writeError(w, http.StatusBadRequest, "STATUS_INVALID")
+			return
+		}
+		s.Agreements[parts[0]] = "Cancelled"
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotFound, "INVALID_PROFILE_ID")
+	}
+}
+
+type orderRequest struct {
+	Intent        string `json:"intent"`
+	PurchaseUnits []struct {
+		CustomID string `json:"custom_id"`
+		Amount   Money  `json:"amount"`
+	} `json:"purchase_units"`
+	ApplicationContext struct {
+		ReturnURL string `json:"return_url"`
+		CancelURL string `json:"cancel_url"`
+	} `json:"application_context"`
+}
+
+func (s *Server) orderJSON(o *Order) map[string]interface{} {
+	unit := map[string]interface{}{
+		"custom_id": o.CustomID,
+		"amount":    o.Amount,
+	}
+	if o.CaptureID != "" {
+		unit["payments"] = map[string]interface{}{
+			"captures": []map[string]interface{}{
+				{"id": o.CaptureID, "status": "COMPLETED", "custom_id": o.CustomID, "amount": o.Amount},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"id":             o.ID,
+		"intent":         "CAPTURE",
+		"status":         o.Status,
+		"purchase_units": []interface{}{unit},
+		"links": []map[string]string{
+			{"href": s.URL + "/checkoutnow?token=" + o.ID, "rel": "approve", "method": "GET"},
+			{"href": s.URL + "/v2/checkout/orders/" + o.ID, "rel": "self", "method": "GET"},
+		},
+	}
+}
+
+func (s *Server) serveCreateOrder(w http.ResponseWriter, r *http.Request) {
+	var req orderRequest
+	if r.Method != "POST" || !decode(r, &req) || len(req.PurchaseUnits) != 1 {
+		writeError(w, http.StatusBadRequest, "INVALID_REQUEST")
+		return
+	}
+	o := &Order{
+		ID:        s.id("ORDER"),
+		Status:    "CREATED",
+		CustomID:  req.PurchaseUnits[0].CustomID,
+		Amount:    req.PurchaseUnits[0].Amount,
+		ReturnURL: req.ApplicationContext.ReturnURL,
+		CancelURL: req.ApplicationContext.CancelURL,
+	}
+	s.Orders[o.ID] = o
+	writeJSON(w, http.StatusCreated, s.orderJSON(o))
+}
+
+func (s *Server) serveOrder(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/checkout/orders/"), "/")
+	o, ok := s.Orders[parts[0]]
+	if !ok {
+		writeError(w, http.StatusNotFound, "RESOURCE_NOT_FOUND")
+		return
+	}
+	if s.failed(w, parts) {
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		writeJSON(w, http.StatusOK, s.orderJSON(o))
+	case len(parts) == 2 && parts[1] == "capture" && r.Method == "POST":
+		if o.Status != "APPROVED" {
+			writeError(w, http.StatusUnprocessableEntity, "ORDER_NOT_APPROVED")
+			return
+		}
+		o.Status = "COMPLETED"
+		o.CaptureID = s.id("CAP")
+		writeJSON(w, http.StatusCreated, s.orderJSON(o))
+	default:
+		writeError(w, http.StatusNotFound, "RESOURCE_NOT_FOUND")
+	}
+}
+
+func (s *Server) serveVerifyWebhook(w http.ResponseWriter, r *http.Request) {
+	status := "SUCCESS"
+	if s.RejectWebhooks {
+		status = "FAILURE"
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"verification_status": status})
+}
+
+// serveApprove stands in for the page where the buyer logs into PayPal. It
+// approves whatever the token refers to and redirects to the return URL,
+// adding the same query parameters PayPal does. ?cancel=1 follows the cancel
+// URL instead.
+func (s *Server) serveApprove(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token := r.URL.Query().Get("token")
+	cancel := r.URL.Query().Get("cancel") != ""
+
+	var target string
+	extra := url.Values{}
+	if sub, ok := s.Subscriptions[token]; ok {
+		target = sub.ReturnURL
+		if cancel {
+			target = sub.CancelURL
+		} else {
+			sub.Status = "ACTIVE"
+			if sub.StartTime == "" {
+				sub.StartTime = time.Now().UTC().Format(time.RFC3339)
+			}
+			extra.Set("subscription_id", sub.ID)
+			extra.Set("ba_token", "BA-"+sub.ID)
+			extra.Set("token", "EC-"+sub.ID)
+		}
+	} else if o, ok := s.Orders[token]; ok {
+		target = o.ReturnURL
+		if cancel {
+			target = o.CancelURL
+		} else {
+			o.Status = "APPROVED"
+			extra.Set("token", o.ID)
+			extra.Set("PayerID", "FAKEPAYER")
+		}
+	} else {
+		http.Error(w, "Unknown token", http.StatusNotFound)
+		return
+	}
+	if !cancel {
+		sep := "?"
+		if strings.Contains(target, "?") {
+			sep = "&"
+		}
+		target += sep + extra.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/mail"
+)
+
+// planLinkTTL is how long a magic link to the plan portal stays valid. Buyers
+// can ask for a new one from the portal at any time.
+const planLinkTTL = 7 * 24 * time.Hour
+
+// payEarlyPrefix marks the custom ID of PayPal orders that pay off the rest of
+// a plan.
+const payEarlyPrefix = "pay-early:"
+
+// payPalAutopayURL is where buyers change the card or bank account behind a
+// PayPal subscription. PayPal doesn't let merchants change it for them.
+const payPalAutopayURL = "https://www.paypal.com/myaccount/autopay/"
+
+var planLinkTemplate = template.Must(template.New("plan-link").Parse(`Hi,
+
+You can see your payment schedule for {{.Order.Event}}{{if .Order.Variant}} - {{.Order.Variant}}{{end}}, pay early or make changes at:
+{{.PlanURL}}
+
+This link is personal to you and works for 7 days. You can ask for a new one from the same page.
+
+Thanks,
+{{.Order.Vendor}}
+`))
+
+// planURL returns a signed link to the order's page in the plan portal.
+func planURL(ctx context.Context, o *Order) (string, error) {
+	vendor := vendorSlug(ctx, o.Shop)
+	segment, err := signLinkTTL(ctx, linkPlan, vendor, url.Values{"order": {o.AgreementID}}, planLinkTTL)
+	if err != nil {
+		return "", err
+	}
+	return appURL + "/my-plan/" + url.PathEscape(o.AgreementID) + "/" + segment, nil
+}
+
+// sendPlanLink emails the buyer a magic link to their plan.
+func sendPlanLink(ctx context.Context, o *Order) error {
+	if o.Email == "" {
+		return nil
+	}
+	link, err := planURL(ctx, o)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	err = planLinkTemplate.Execute(&body, struct {
+		Order   *Order
+		PlanURL string
+	}{
+		Order:   o,
+		PlanURL: link,
+	})
+	if err != nil {
+		return err
+	}
+	return mail.Send(ctx, &mail.Message{
+		Sender:  mailSender,
+		To:      []string{o.Email},
+		Subject: "Your payment plan for " + o.Event,
+		Body:    body.String(),
+	})
+}
+
+// remaining returns the total of all installments not paid yet.
+// Callers format it with the order's currency, which rounds away float noise.
+func (o *Order) remaining() float64 {
+	total := 0.0
+	for _, inst := range o.Installments {
+		if inst.Status != installmentPaid {
+			amount, _ := strconv.ParseFloat(inst.Amount, 64)
+			total += amount
+		}
+	}
+	return total
+}
+
+// recordEarlyPayoff marks every unpaid installment as paid by a single payment
+// of the remaining balance.
+func (o *Order) recordEarlyPayoff(transactionID string, at time.Time) {
+	for i := o.nextInstallment(); i != -1; i = o.nextInstallment() {
+		o.recordSeparatePayment(transactionID+"-"+strconv.Itoa(i), at)
+	}
+}
+
+// canPayEarly reports whether the buyer can pay off the rest of the plan from
+// the portal.
+func (o *Order) canPayEarly() bool {
+	return !o.PayInFull && o.Status != orderCancelled && o.remaining() > 0
+}
+
+// serveMyPlan is the buyer's plan portal. /my-plan/{order} asks for the
+// buyer's email and sends them a magic link, which opens
+// /my-plan/{order}/{link}. Actions are posted to /my-plan/{order}/{link}/{action}.
+func serveMyPlan(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	path := strings.Split(strings.Trim(r.URL.Path[len("/my-plan/"):], "/"), "/")
+	orderID := path[0]
+	if orderID == "" {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if len(path) == 1 {
+		requestPlanLink(ctx, w, r, orderID)
+		return
+	}
+
+	// The link is verified with the secret of the order's own shop, so one
+	// signed by another shop doesn't open it.
+	o, tenant, err := orderTenant(ctx, orderID)
+	if err == datastore.ErrNoSuchEntity {
+		linkError(w, errLinkInvalid)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "Get Order Error: %s", err)
+		linkError(w, err)
+		return
+	}
+	params, err := verifyLink(ctx, linkPlan, vendorSlug(ctx, tenant.Shop), path[1])
+	if err == nil && params.Get("order") != orderID {
+		err = errLinkInvalid
+	}
+	if err == errLinkExpired {
+		renderPlanLinkRequest(w, orderID, "This link has expired. Enter your email and we'll send you a new one.")
+		return
+	} else if err != nil {
+		log.Warningf(ctx, "Plan Link Error: %s", err)
+		linkError(w, err)
+		return
+	}
+	self := appURL + "/my-plan/" + url.PathEscape(orderID) + "/" + path[1]
+
+	action := ""
+	if len(path) > 2 {
+		action = path[2]
+	}
+	switch action {
+	case "":
+		renderPlan(w, o, self)
+	case "pay-early":
+		if r.Method != "POST" {
+			http.Redirect(w, r, self, http.StatusFound)
+			return
+		}
+		startEarlyPayoff(ctx, w, r, o, self)
+	case "paid":
+		finishEarlyPayoff(ctx, w, r, tenant, o, self)
+	case "payment-method":
+		if o.Legacy || o.PayInFull || o.Provider == "stripe" {
+			http.Redirect(w, r, self, http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, payPalAutopayURL, http.StatusFound)
+	case "cancel":
+		if r.Method != "POST" {
+			http.Redirect(w, r, self, http.StatusFound)
+			return
+		}
+		if err := requestCancellation(ctx, tenant, orderID, r.PostFormValue("reason")); err != nil {
+			log.Errorf(ctx, "Request Cancellation Error: %s", err)
+			http.Error(w, "Could not send your request. Please try again.", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, self, http.StatusSeeOther)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// requestPlanLink shows the form to ask for a magic link and sends one when
+// the email given matches the order. The response is the same either way so
+// the form can't be used to find out who bought what.
+func requestPlanLink(ctx context.Context, w http.ResponseWriter, r *http.Request, orderID string) {
+	if r.Method != "POST" {
+		renderPlanLinkRequest(w, orderID, "")
+		return
+	}
+	email, err := checkoutEmail(r.PostFormValue("email"))
+	if err != nil || email == "" {
+		renderPlanLinkRequest(w, orderID, "Please enter a valid email address.")
+		return
+	}
+	// Anyone can ask, but the link only goes to the order's own email.
+	o, _, err := orderTenant(ctx, orderID)
+	if err == nil && o.Email != "" && strings.EqualFold(o.Email, email) {
+		if err := sendPlanLink(ctx, o); err != nil {
+			log.Errorf(ctx, "Send Plan Link Error: %s", err)
+		}
+	} else if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Errorf(ctx, "Get Order Error: %s", err)
+	}
+	renderPlanLinkRequest(w, orderID, "If that email matches the order, a link to your plan is on its way.")
+}
+
+func renderPlanLinkRequest(w http.ResponseWriter, orderID string, message string) {
+	v := struct {
+		Action  string
+		Message string
+	}{
+		Action:  "/my-plan/" + url.PathEscape(orderID),
+		Message: message,
+	}
+	tpl.ExecuteTemplate(w, "my-plan-link.gohtml", v)
+}
+
+func renderPlan(w http.ResponseWriter, o *Order, self string) {
+	type planInstallment struct {
+		Number int
+		Installment
+	}
+	cur, err := lookupCurrency(o.Currency)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var paid, upcoming []planInstallment
+	for i, inst := range o.Installments {
+		if inst.Status == installmentPaid {
+			paid = append(paid, planInstallment{i + 1, inst})
+		} else {
+			upcoming = append(upcoming, planInstallment{i + 1, inst})
+		}
+	}
+	v := struct {
+		Order         *Order
+		Paid          []planInstallment
+		Upcoming      []planInstallment
+		Remaining     string
+		Outstanding   string
+		PayEarly      bool
+		ChangePayment bool
+		CanCancel     bool
+		Self          string
+		PayNowURL     string
+	}{
+		Order:         o,
+		Paid:          paid,
+		Upcoming:      upcoming,
+		Remaining:     cur.value(o.remaining()),
+		Outstanding:   cur.value(o.outstanding()),
+		PayEarly:      o.canPayEarly(),
+		ChangePayment: !o.Legacy && !o.PayInFull && o.Provider != "stripe" && o.Status != orderCancelled && o.Status != orderCompleted,
+		CanCancel:     o.Status != orderCancelled && o.Status != orderCompleted && o.CancelRequested.IsZero(),
+		Self:          self,
+		PayNowURL:     appURL + "/pay-now/" + o.AgreementID,
+	}
+	if err := tpl.ExecuteTemplate(w, "my-plan.gohtml", v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// startEarlyPayoff sends the buyer to PayPal to pay the rest of the plan in
+// one go.
+func startEarlyPayoff(ctx context.Context, w http.ResponseWriter, r *http.Request, o *Order, self string) {
+	if !o.canPayEarly() {
+		http.Redirect(w, r, self, http.StatusSeeOther)
+		return
+	}
+	cur, err := lookupCurrency(o.Currency)
+	if err != nil {
+		log.Errorf(ctx, "Currency Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c, err := newPayPalClient(ctx)
+	if err != nil {
+		log.Errorf(ctx, "New Client Error: %s", err)
+		http.Error(w, "PayPal unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	order := payPalCheckoutOrder{
+		Intent: "CAPTURE",
+		PurchaseUnits: []payPalPurchaseUnit{
+			payPalPurchaseUnit{
+				CustomID:    payEarlyPrefix + o.AgreementID,
+				Description: "Remaining balance for " + o.Event + " - " + o.Variant,
+				Amount: payPalMoney{
+					Value:        cur.value(o.remaining()),
+					CurrencyCode: cur.Code,
+				},
+			},
+		},
+		ApplicationContext: &payPalApplicationContext{
+			ShippingPreference: "NO_SHIPPING",
+			UserAction:         "PAY_NOW",
+			ReturnURL:          self + "/paid",
+			CancelURL:          self,
+		},
+	}
+	resp, err := createPayPalCheckoutOrder(c, order)
+	if err != nil {
+		log.Errorf(ctx, "Create Order Error: %s", err)
+		http.Error(w, "Could not start payment", http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, resp.link("approve"), http.StatusFound)
+}
+
+// finishEarlyPayoff captures the payoff when the buyer comes back from PayPal
+// and cancels the subscription so nothing more is charged. The subscription
+// is suspended before the capture, so it can't also charge an installment the
+// payoff covers, even if cancelling it afterwards fails.
+func finishEarlyPayoff(ctx context.Context, w http.ResponseWriter, r *http.Request, t Tenant, o *Order, self string) {
+	c, err := newPayPalClient(ctx)
+	if err != nil {
+		log.Errorf(ctx, "New Client Error: %s", err)
+		http.Error(w, "PayPal unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err := suspendPayPalOrder(c, o, "Paying off early"); err != nil {
+		log.Errorf(ctx, "Suspend Subscription %s Error: %s", o.AgreementID, err)
+		http.Error(w, "Payment could not be completed", http.StatusBadGateway)
+		return
+	}
+	resp, captureErr := capturePayPalCheckoutOrder(c, r.URL.Query().Get("token"))
+	var capture *payPalCapture
+	if captureErr == nil {
+		capture = resp.capture()
+	}
+	if captureErr != nil || resp.Status != "COMPLETED" || capture == nil || capture.CustomID != payEarlyPrefix+o.AgreementID {
+		if captureErr != nil {
+			log.Errorf(ctx, "Capture Order Error: %s", captureErr)
+		}
+		// Nothing was paid, so the plan carries on.
+		if err := activatePayPalOrder(c, o, "Early payoff not completed"); err != nil {
+			log.Errorf(ctx, "Activate Subscription %s Error: %s", o.AgreementID, err)
+			if err := flagOrder(ctx, o.AgreementID, "PayPal subscription left suspended after an early payoff failed"); err != nil {
+				log.Errorf(ctx, "Flag Order Error: %s", err)
+			}
+		}
+		if captureErr != nil {
+			http.Error(w, "Payment could not be completed", http.StatusBadGateway)
+		} else {
+			http.Error(w, "Payment could not be completed", http.StatusPaymentRequired)
+		}
+		return
+	}
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		// o was read before PayPal was called, and a webhook may have
+		// recorded a payment since.
+		o, err := t.order(tc, o.AgreementID)
+		if err != nil {
+			return err
+		}
+		o.recordEarlyPayoff(capture.ID, time.Now())
+		return t.putOrder(tc, o)
+	}, nil)
+	if err != nil {
+		log.Errorf(ctx, "Put Order Error: %s", err)
+		http.Error(w, "Your payment was received but could not be saved. Please contact the seller.", http.StatusInternalServerError)
+		return
+	}
+	if err := cancelPayPalOrder(c, o, "Paid off early"); err != nil {
+		log.Errorf(ctx, "Cancel Paid Off Subscription %s Error: %s", o.AgreementID, err)
+		// The subscription is still suspended, so it charges nothing, but
+		// the merchant should cancel it.
+		if err := flagOrder(ctx, o.AgreementID, "Paid off early but the PayPal subscription could not be cancelled"); err != nil {
+			log.Errorf(ctx, "Flag Order Error: %s", err)
+		}
+	}
+	if err := syncShopifyOrder(ctx, o.AgreementID); err != nil {
+		log.Errorf(ctx, "Sync Shopify Order Error: %s", err)
+	}
+	http.Redirect(w, r, self, http.StatusFound)
+}
+
+// requestCancellation records that the buyer asked to cancel. The merchant
+// decides what happens next from the admin.
+func requestCancellation(ctx context.Context, t Tenant, orderID string, reason string) error {
+	reason = strings.TrimSpace(reason)
+	if len(reason) > 1000 {
+		reason = reason[:1000]
+	}
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		o, err := t.order(tc, orderID)
+		if err != nil {
+			return err
+		}
+		if !o.CancelRequested.IsZero() {
+			return nil
+		}
+		o.CancelRequested = time.Now()
+		o.CancelReason = reason
+		return t.putOrder(tc, o)
+	}, nil)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+
+	"tixpire/paypalfake"
+)
+
+const portalShop = "portal.myshopify.com"
+
+// startPayoff puts a subscription order on the fake, opens its plan and
+// starts paying it off early. It returns the URL PayPal sends the buyer back
+// to once they approve the payment.
+func startPayoff(t *testing.T, inst aetest.Instance, fake *paypalfake.Server) string {
+	shops.Put(context.Background(), &ShopRecord{Domain: portalShop, Token: "test-token"})
+	fake.Subscriptions[fixtureSubscription] = &paypalfake.Subscription{ID: fixtureSubscription, Status: "ACTIVE"}
+	putTestOrder(t, inst, portalShop, fixtureSubscription)
+
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+	segment, err := signLink(ctx, linkPlan, vendorSlug(ctx, portalShop), url.Values{"order": {fixtureSubscription}})
+	if err != nil {
+		t.Fatalf("signLink: %s", err)
+	}
+	w := serve(t, inst, serveMyPlan, "POST", "/my-plan/"+fixtureSubscription+"/"+segment+"/pay-early", url.Values{})
+	if w.Code != http.StatusFound {
+		t.Fatalf("pay-early returned %d: %s", w.Code, w.Body)
+	}
+	return approve(t, w.Header().Get("Location"))
+}
+
+func TestEarlyPayoff(t *testing.T) {
+	fake, stop := usePayPalFake()
+	defer stop()
+	inst, done := newTestInstance(t)
+	defer done()
+	defer shops.Delete(context.Background(), portalShop)
+
+	returned := startPayoff(t, inst, fake)
+	if w := serve(t, inst, serveMyPlan, "GET", returned, nil); w.Code != http.StatusFound {
+		t.Fatalf("paid returned %d: %s", w.Code, w.Body)
+	}
+	o := loadTestOrder(t, inst, fixtureSubscription)
+	if o.Status != orderCompleted || o.remaining() != 0 || o.Flagged {
+		t.Errorf("order = %s, %v remaining, flagged %v; want completed and paid", o.Status, o.remaining(), o.Flagged)
+	}
+	if got := fake.Subscriptions[fixtureSubscription].Status; got != "CANCELLED" {
+		t.Errorf("subscription = %s, want CANCELLED", got)
+	}
+}
+
+func TestEarlyPayoffSuspendsBeforeCapture(t *testing.T) {
+	fake, stop := usePayPalFake()
+	defer stop()
+	inst, done := newTestInstance(t)
+	defer done()
+	defer shops.Delete(context.Background(), portalShop)
+
+	returned := startPayoff(t, inst, fake)
+	fake.Fail["suspend"] = true
+	if w := serve(t, inst, serveMyPlan, "GET", returned, nil); w.Code != http.StatusBadGateway {
+		t.Errorf("paid returned %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	for _, order := range fake.Orders {
+		if order.Status == "COMPLETED" {
+			t.Errorf("payoff %s was captured while the subscription was still active", order.ID)
+		}
+	}
+	if o := loadTestOrder(t, inst, fixtureSubscription); o.nextInstallment() != 0 {
+		t.Errorf("installments paid without a capture: %+v", o.Installments)
+	}
+}
+
+func TestEarlyPayoffCaptureFails(t *testing.T) {
+	fake, stop := usePayPalFake()
+	defer stop()
+	inst, done := newTestInstance(t)
+	defer done()
+	defer shops.Delete(context.Background(), portalShop)
+
+	returned := startPayoff(t, inst, fake)
+	fake.Fail["capture"] = true
+	if w := serve(t, inst, serveMyPlan, "GET", returned, nil); w.Code != http.StatusBadGateway {
+		t.Errorf("paid returned %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	if got := fake.Subscriptions[fixtureSubscription].Status; got != "ACTIVE" {
+		t.Errorf("subscription = %s, want ACTIVE again", got)
+	}
+	if o := loadTestOrder(t, inst, fixtureSubscription); o.Flagged {
+		t.Errorf("order flagged: %s", o.FlagReason)
+	}
+}
+
+func TestEarlyPayoffCancelFails(t *testing.T) {
+	fake, stop := usePayPalFake()
+	defer stop()
+	inst, done := newTestInstance(t)
+	defer done()
+	defer shops.Delete(context.Background(), portalShop)
+
+	returned := startPayoff(t, inst, fake)
+	fake.Fail["cancel"] = true
+	if w := serve(t, inst, serveMyPlan, "GET", returned, nil); w.Code != http.StatusFound {
+		t.Fatalf("paid returned %d: %s", w.Code, w.Body)
+	}
+	if got := fake.Subscriptions[fixtureSubscription].Status; got != "SUSPENDED" {
+		t.Errorf("subscription = %s, want SUSPENDED", got)
+	}
+	o := loadTestOrder(t, inst, fixtureSubscription)
+	if o.Status != orderCompleted {
+		t.Errorf("status = %s, want %s", o.Status, orderCompleted)
+	}
+	if !o.Flagged || !strings.Contains(o.FlagReason, "could not be cancelled") {
+		t.Errorf("flag = %v %q, want the failed cancel flagged", o.Flagged, o.FlagReason)
+	}
+}
+
+func TestEarlyPayoffKeepsConcurrentPayment(t *testing.T) {
+	fake, stop := usePayPalFake()
+	defer stop()
+	inst, done := newTestInstance(t)
+	defer done()
+	defer shops.Delete(context.Background(), portalShop)
+
+	returned := startPayoff(t, inst, fake)
+
+	// The subscription charges the first installment while the buyer is
+	// capturing the payoff, after the portal has read the order.
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/capture") {
+			ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+			o, err := getOrder(ctx, fixtureSubscription)
+			if err == nil {
+				o.recordPayment("SALE-1", "31.25", time.Now())
+				err = putOrder(ctx, o)
+			}
+			if err != nil {
+				t.Errorf("recording sale: %s", err)
+			}
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+	defer setEnv(map[string]string{"PAYPAL_API_BASE": proxy.URL})()
+
+	if w := serve(t, inst, serveMyPlan, "GET", returned, nil); w.Code != http.StatusFound {
+		t.Fatalf("paid returned %d: %s", w.Code, w.Body)
+	}
+	o := loadTestOrder(t, inst, fixtureSubscription)
+	if o.Installments[0].TransactionID != "SALE-1" || o.Installments[0].PaidSeparately {
+		t.Errorf("first installment = %+v, want the subscription's sale kept", o.Installments[0])
+	}
+	if o.Status != orderCompleted {
+		t.Errorf("status = %s, want %s", o.Status, orderCompleted)
+	}
+}
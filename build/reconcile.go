@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/logpacker/PayPal-Go-SDK"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	discrepancyMissed      = "missed"
+	discrepancyExtra       = "extra"
+	discrepancyLate        = "late"
+	discrepancyWrongAmount = "wrong-amount"
+)
+
+// lateAfter is how long after its due date a charge may land before it is
+// reported as late, or as missed if it hasn't landed at all.
+const lateAfter = 3 * 24 * time.Hour
+
+// ReconciliationReport is written for each shop once per run of the
+// reconciliation job and keyed by the shop and the day it ran. Its
+// Discrepancy entities are stored as children.
+type ReconciliationReport struct {
+	Shop          string
+	Created       time.Time
+	OrdersChecked int
+	Discrepancies int
+	Errors        int
+}
+
+// Discrepancy is a difference between an order's payment schedule and what
+// the provider actually charged.
+type Discrepancy struct {
+	Shop          string
+	OrderID       string
+	Event         string
+	Kind          string
+	Expected      string
+	Actual        string
+	Currency      string
+	Due           time.Time
+	Charged       time.Time
+	TransactionID string
+}
+
+// providerTransaction is a completed charge as reported by PayPal, for either
+// a subscription or a legacy agreement.
+type providerTransaction struct {
+	ID     string
+	Amount float64
+	Time   time.Time
+}
+
+// expectedCharge is a charge the order's schedule says should have happened.
+type expectedCharge struct {
+	Due    time.Time
+	Amount float64
+}
+
+type subscriptionTransactions struct {
+	Transactions []struct {
+		ID                  string `json:"id"`
+		Status              string `json:"status"`
+		Time                string `json:"time"`
+		AmountWithBreakdown struct {
+			GrossAmount payPalMoney `json:"gross_amount"`
+		} `json:"amount_with_breakdown"`
+	} `json:"transactions"`
+}
+
+type agreementTransactions struct {
+	AgreementTransactionList []struct {
+		TransactionID   string             `json:"transaction_id"`
+		Status          string             `json:"status"`
+		TransactionType string             `json:"transaction_type"`
+		TimeStamp       string             `json:"time_stamp"`
+		Amount          payPalLegacyAmount `json:"amount"`
+	} `json:"agreement_transaction_list"`
+}
+
+// payPalTransactions returns the completed charges on an order between start
+// and end.
+func payPalTransactions(c *paypalsdk.Client, o *Order, start time.Time, end time.Time) ([]providerTransaction, error) {
+	var txns []providerTransaction
+	if o.Legacy {
+		q := url.Values{}
+		q.Set("start_date", start.Format("2006-01-02"))
+		q.Set("end_date", end.Format("2006-01-02"))
+		req, err := c.NewRequest("GET", c.APIBase+"/v1/payments/billing-agreements/"+o.AgreementID+"/transactions?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp := &agreementTransactions{}
+		if err := c.SendWithAuth(req, resp); err != nil {
+			return nil, err
+		}
+		for _, t := range resp.AgreementTransactionList {
+			if !strings.EqualFold(t.Status, "Completed") || !strings.EqualFold(t.TransactionType, "Recurring Payment") {
+				continue
+			}
+			amount, _ := strconv.ParseFloat(t.Amount.Value, 64)
+			at, _ := time.Parse(time.RFC3339, t.TimeStamp)
+			txns = append(txns, providerTransaction{ID: t.TransactionID, Amount: amount, Time: at})
+		}
+		return txns, nil
+	}
+
+	q := url.Values{}
+	q.Set("start_time", start.UTC().Format(time.RFC3339))
+	q.Set("end_time", end.UTC().Format(time.RFC3339))
+	req, err := c.NewRequest("GET", c.APIBase+"/v1/billing/subscriptions/"+o.AgreementID+"/transactions?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp := &subscriptionTransactions{}
+	if err := c.SendWithAuth(req, resp); err != nil {
+		return nil, err
+	}
+	for _, t := range resp.Transactions {
+		if t.Status != "COMPLETED" {
+			continue
+		}
+		amount, _ := strconv.ParseFloat(t.AmountWithBreakdown.GrossAmount.Value, 64)
+		at, _ := time.Parse(time.RFC3339, t.Time)
+		txns = append(txns, providerTransaction{ID: t.ID, Amount: amount, Time: at})
+	}
+	return txns, nil
+}
+
+// expectedCharges lists what should have been charged on o's subscription by
+// now: the setup fee when the plan started, then each installment with its
+// tax. Installments paid off from the pay-now page or the portal were charged
+// as separate payments and aren't expected on the subscription.
+func (o *Order) expectedCharges(cur Currency, now time.Time) []expectedCharge {
+	tax, _ := strconv.ParseFloat(o.Tax, 64)
+	var charges []expectedCharge
+	if fee, _ := strconv.ParseFloat(o.Fee, 64); fee > 0 {
+		charges = append(charges, expectedCharge{Due: o.Created, Amount: fee})
+	}
+	for i, inst := range o.Installments {
+		if inst.Due.After(now) {
+			break
+		}
+		if o.paidSeparately(i) {
+			continue
+		}
+		amount, _ := strconv.ParseFloat(inst.Amount, 64)
+		charges = append(charges, expectedCharge{Due: inst.Due, Amount: cur.round(amount + tax)})
+	}
+	return charges
+}
+
+// matchCharges pairs each transaction with the expected charge whose due date
+// is nearest, closest pairs first, so one missed or extra charge doesn't shift
+// every later pairing. Charges due the same day are told apart by amount, so
+// the setup fee and the first installment aren't swapped. It returns the
+// index of the transaction matched to each charge, or -1.
+func matchCharges(expected []expectedCharge, txns []providerTransaction, tolerance float64) []int {
+	type pair struct {
+		charge, txn int
+		days        int64
+		wrongAmount bool
+		distance    time.Duration
+	}
+	var pairs []pair
+	for i, want := range expected {
+		for j, got := range txns {
+			d := got.Time.Sub(want.Due)
+			if d < 0 {
+				d = -d
+			}
+			pairs = append(pairs, pair{i, j, int64(d / (24 * time.Hour)), math.Abs(got.Amount-want.Amount) > tolerance, d})
+		}
+	}
+	sort.Slice(pairs, func(a, b int) bool {
+		if pairs[a].days != pairs[b].days {
+			return pairs[a].days < pairs[b].days
+		}
+		if pairs[a].wrongAmount != pairs[b].wrongAmount {
+			return !pairs[a].wrongAmount
+		}
+		return pairs[a].distance < pairs[b].distance
+	})
+	matched := make([]int, len(expected))
+	for i := range matched {
+		matched[i] = -1
+	}
+	used := make([]bool, len(txns))
+	for _, p := range pairs {
+		if matched[p.charge] == -1 && !used[p.txn] {
+			matched[p.charge] = p.txn
+			used[p.txn] = true
+		}
+	}
+	return matched
+}
+
+// reconcileOrder matches expected charges with actual transactions and
+// reports every match that doesn't line up, plus anything left over on
+// either side.
+func reconcileOrder(o *Order, cur Currency, txns []providerTransaction, now time.Time) []Discrepancy {
+	tolerance := 2 / cur.scale()
+	expected := o.expectedCharges(cur, now)
+	sort.Slice(txns, func(i, j int) bool { return txns[i].Time.Before(txns[j].Time) })
+	matched := matchCharges(expected, txns, tolerance)
+
+	newDiscrepancy := func(kind string) Discrepancy {
+		return Discrepancy{
+			Shop:     o.Shop,
+			OrderID:  o.AgreementID,
+			Event:    o.Event,
+			Kind:     kind,
+			Currency: cur.Code,
+		}
+	}
+
+	var found []Discrepancy
+	used := make([]bool, len(txns))
+	for i, want := range expected {
+		if matched[i] == -1 {
+			if now.Sub(want.Due) > lateAfter {
+				d := newDiscrepancy(discrepancyMissed)
+				d.Expected = cur.value(want.Amount)
+				d.Due = want.Due
+				found = append(found, d)
+			}
+			continue
+		}
+		got := txns[matched[i]]
+		used[matched[i]] = true
+		if math.Abs(got.Amount-want.Amount) > tolerance {
+			d := newDiscrepancy(discrepancyWrongAmount)
+			d.Expected = cur.value(want.Amount)
+			d.Actual = cur.value(got.Amount)
+			d.Due = want.Due
+			d.Charged = got.Time
+			d.TransactionID = got.ID
+			found = append(found, d)
+		}
+		if got.Time.Sub(want.Due) > lateAfter {
+			d := newDiscrepancy(discrepancyLate)
+			d.Expected = cur.value(want.Amount)
+			d.Actual = cur.value(got.Amount)
+			d.Due = want.Due
+			d.Charged = got.Time
+			d.TransactionID = got.ID
+			found = append(found, d)
+		}
+	}
+	for j, got := range txns {
+		if used[j] {
+			continue
+		}
+		d := newDiscrepancy(discrepancyExtra)
+		d.Actual = cur.value(got.Amount)
+		d.Charged = got.Time
+		d.TransactionID = got.ID
+		found = append(found, d)
+	}
+	return found
+}
+
+func reconciliationReportKey(ctx context.Context, shop string, day time.Time) *datastore.Key {
+	return datastore.NewKey(ctx, "ReconciliationReport", shop+":"+day.Format("2006-01-02"), 0, nil)
+}
+
+// serveReconcile is run by cron. It retries every Shopify sync that failed,
+// then compares every active installment order with the transactions PayPal
+// has on record and writes each shop's report for the day.
+func serveReconcile(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if r.Header.Get("X-Appengine-Cron") != "true" {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Pick up Shopify orders and transactions a webhook failed to post,
+	// including for plans that have since been paid off.
+	pending, err := datastore.NewQuery("Order").Filter("ShopifyPending =", true).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		log.Errorf(ctx, "Pending Query Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, key := range pending {
+		if err := syncShopifyOrder(ctx, key.StringID()); err != nil {
+			log.Errorf(ctx, "Sync Shopify Order %s: %s", key.StringID(), err)
+		}
+	}
+
+	var orders []Order
+	if _, err := datastore.NewQuery("Order").Filter("Status =", orderActive).GetAll(ctx, &orders); err != nil {
+		log.Errorf(ctx, "Reconcile Query Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c, err := newPayPalClient(ctx)
+	if err != nil {
+		log.Errorf(ctx, "New Client Error: %s", err)
+		http.Error(w, "PayPal unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	now := time.Now()
+	reports := map[string]*ReconciliationReport{}
+	discrepancies := map[string][]Discrepancy{}
+	checked, total := 0, 0
+	for i := range orders {
+		o := &orders[i]
+		report, ok := reports[o.Shop]
+		if !ok {
+			report = &ReconciliationReport{Shop: o.Shop, Created: now}
+			reports[o.Shop] = report
+		}
+		report.OrdersChecked++
+		checked++
+		cur, err := lookupCurrency(o.Currency)
+		if err != nil {
+			log.Errorf(ctx, "Currency of %s: %s", o.AgreementID, err)
+			report.Errors++
+			continue
+		}
+		txns, err := payPalTransactions(c, o, o.Created.AddDate(0, 0, -1), now)
+		if err != nil {
+			log.Errorf(ctx, "Transactions for %s: %s", o.AgreementID, err)
+			report.Errors++
+			continue
+		}
+		diffs := reconcileOrder(o, cur, txns, now)
+		report.Discrepancies += len(diffs)
+		discrepancies[o.Shop] = append(discrepancies[o.Shop], diffs...)
+	}
+
+	for shop, report := range reports {
+		if err := putReconciliationReport(ctx, report, discrepancies[shop]); err != nil {
+			log.Errorf(ctx, "Put Report for %s Error: %s", shop, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		total += report.Discrepancies
+	}
+	log.Infof(ctx, "Reconciled %d orders in %d shops, %d discrepancies", checked, len(reports), total)
+	w.WriteHeader(http.StatusOK)
+}
+
+// putReconciliationReport stores a shop's report for the day with its
+// discrepancies, replacing an earlier run from the same day.
+func putReconciliationReport(ctx context.Context, report *ReconciliationReport, discrepancies []Discrepancy) error {
+	reportKey := reconciliationReportKey(ctx, report.Shop, report.Created)
+	if _, err := datastore.Put(ctx, reportKey, report); err != nil {
+		return err
+	}
+	if old, err := datastore.NewQuery("Discrepancy").Ancestor(reportKey).KeysOnly().GetAll(ctx, nil); err == nil && len(old) > 0 {
+		datastore.DeleteMulti(ctx, old)
+	}
+	for len(discrepancies) > 0 {
+		// PutMulti takes at most 500 entities per call.
+		n := len(discrepancies)
+		if n > 500 {
+			n = 500
+		}
+		keys := make([]*datastore.Key, n)
+		for i := range keys {
+			keys[i] = datastore.NewIncompleteKey(ctx, "Discrepancy", reportKey)
+		}
+		if _, err := datastore.PutMulti(ctx, keys, discrepancies[:n]); err != nil {
+			return err
+		}
+		discrepancies = discrepancies[n:]
+	}
+	return nil
+}
+
+// serveReconciliation shows the latest reconciliation report for the shop
+// that is logged into the admin.
+func serveReconciliation(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	shop := currentShop(r).Domain
+	tenant := currentShop(r).tenant()
+
+	var reports []ReconciliationReport
+	keys, err := tenant.query("ReconciliationReport").Order("-Created").Limit(1).GetAll(ctx, &reports)
+	if err != nil {
+		log.Errorf(ctx, "Report Query Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type ReconciliationVars struct {
+		Shop          string
+		Report        *ReconciliationReport
+		Discrepancies []Discrepancy
+	}
+	v := ReconciliationVars{Shop: shop}
+	if len(reports) > 0 {
+		v.Report = &reports[0]
+		q := tenant.query("Discrepancy").Ancestor(keys[0])
+		if _, err := q.GetAll(ctx, &v.Discrepancies); err != nil {
+			log.Errorf(ctx, "Discrepancy Query Error: %s", err)
+		}
+	}
+	tpl.ExecuteTemplate(w, "reconciliation.gohtml", v)
+}
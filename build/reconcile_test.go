@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+)
+
+func TestReconcileOrder(t *testing.T) {
+	start := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+	now := start.AddDate(0, 0, 30)
+	week := func(i int) time.Time { return start.AddDate(0, 0, 7*i) }
+	newTestPlan := func() *Order {
+		o := &Order{AgreementID: "I-1", Shop: "shop.myshopify.com", Created: start, Fee: "5.00", Tax: "1.00"}
+		for i := 0; i < 4; i++ {
+			o.Installments = append(o.Installments, Installment{Due: week(i), Amount: "20.00", Status: installmentScheduled})
+		}
+		return o
+	}
+	charge := func(id string, amount float64, at time.Time) providerTransaction {
+		return providerTransaction{ID: id, Amount: amount, Time: at}
+	}
+	onTime := func() []providerTransaction {
+		txns := []providerTransaction{charge("FEE", 5, start)}
+		for i := 0; i < 4; i++ {
+			txns = append(txns, charge("T"+strconv.Itoa(i), 21, week(i).Add(time.Hour)))
+		}
+		return txns
+	}
+
+	tests := []struct {
+		name  string
+		order func(o *Order)
+		txns  func() []providerTransaction
+		want  []string
+	}{
+		{"on time", nil, onTime, nil},
+		{"first installment missed", nil, func() []providerTransaction {
+			txns := onTime()
+			return append(txns[:1], txns[2:]...)
+		}, []string{discrepancyMissed}},
+		{"charged twice", nil, func() []providerTransaction {
+			return append(onTime(), charge("DUP", 21, week(2).Add(2*time.Hour)))
+		}, []string{discrepancyExtra}},
+		{"late", nil, func() []providerTransaction {
+			txns := onTime()
+			txns[3].Time = week(2).Add(5 * 24 * time.Hour)
+			return txns
+		}, []string{discrepancyLate}},
+		{"wrong amount", nil, func() []providerTransaction {
+			txns := onTime()
+			txns[2].Amount = 30
+			return txns
+		}, []string{discrepancyWrongAmount}},
+		{"fee charged after the first installment", nil, func() []providerTransaction {
+			txns := onTime()
+			txns[0].Time = week(0).Add(2 * time.Hour)
+			return txns
+		}, nil},
+		{"balance paid from the pay-now page", func(o *Order) {
+			o.recordPayment("T0", "", week(0))
+			o.recordFailure(week(1))
+			o.recordBalancePayment("CAP", week(1).AddDate(0, 0, 2))
+		}, func() []providerTransaction {
+			txns := onTime()
+			return append(txns[:2], txns[3:]...)
+		}, nil},
+		{"paid early from the portal", func(o *Order) {
+			o.Installments[3].Status = installmentPaid
+			o.Installments[3].TransactionID = "CAP"
+			o.Installments[3].PaidSeparately = true
+		}, func() []providerTransaction {
+			return onTime()[:4]
+		}, nil},
+		{"sale ID ending in the installment number", func(o *Order) {
+			o.Installments[3].Status = installmentPaid
+			o.Installments[3].TransactionID = "SALE-3"
+		}, func() []providerTransaction {
+			return onTime()[:4]
+		}, []string{discrepancyMissed}},
+	}
+	for _, tt := range tests {
+		o := newTestPlan()
+		if tt.order != nil {
+			tt.order(o)
+		}
+		found := reconcileOrder(o, currencies["USD"], tt.txns(), now)
+		var kinds []string
+		for _, d := range found {
+			kinds = append(kinds, d.Kind)
+		}
+		if len(kinds) != len(tt.want) {
+			t.Errorf("%s: found %v, want %v", tt.name, kinds, tt.want)
+			continue
+		}
+		for i := range kinds {
+			if kinds[i] != tt.want[i] {
+				t.Errorf("%s: found %v, want %v", tt.name, kinds, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestReconciliationPerShop(t *testing.T) {
+	inst, done := newTestInstance(t)
+	defer done()
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+
+	// Both shops ran on the same day, the other shop's a moment later.
+	now := time.Now()
+	for _, shop := range []string{"shop.myshopify.com", otherShop} {
+		report := &ReconciliationReport{Shop: shop, Created: now, OrdersChecked: 1, Discrepancies: 1}
+		d := Discrepancy{Shop: shop, OrderID: "I-" + strings.ToUpper(strings.Split(shop, ".")[0]), Kind: "missing"}
+		if err := putReconciliationReport(ctx, report, []Discrepancy{d}); err != nil {
+			t.Fatalf("putReconciliationReport(%s): %s", shop, err)
+		}
+		now = now.Add(time.Second)
+	}
+
+	req := newTestRequest(t, inst, "GET", "/admin/reconciliation", nil)
+	req = req.WithContext(context.WithValue(req.Context(), adminShopKey{}, &AdminShop{Domain: "shop.myshopify.com"}))
+	w := httptest.NewRecorder()
+	serveReconciliation(w, req)
+	if body := w.Body.String(); !strings.Contains(body, "I-SHOP") || strings.Contains(body, "I-OTHER") {
+		t.Errorf("report for shop.myshopify.com:\n%s", body)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// requiredScopes are the Admin API scopes the app asks for on install. The
+// write scopes cover reading as well.
+var requiredScopes = []string{
+	"read_themes",     // the checkout button and pages, shopify.go
+	"write_themes",    // the checkout button and pages, shopify.go
+	"read_products",   // product and variant lookups, cart.go
+	"write_orders",    // orders for approved plans, shopify_orders.go
+	"read_inventory",  // inventory levels, inventory.go
+	"write_inventory", // inventory holds, inventory.go
+}
+
+// missingScopes returns the required scopes that granted doesn't include.
+func missingScopes(granted []string) []string {
+	has := map[string]bool{}
+	for _, s := range granted {
+		has[s] = true
+		if strings.HasPrefix(s, "write_") {
+			has["read_"+strings.TrimPrefix(s, "write_")] = true
+		}
+	}
+	var missing []string
+	for _, s := range requiredScopes {
+		if !has[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+// grantedScopes asks Shopify which scopes token was granted on shop.
+func grantedScopes(ctx context.Context, shop string, token string) ([]string, error) {
+	var scopes struct {
+		AccessScopes []struct {
+			Handle string `json:"handle"`
+		} `json:"access_scopes"`
+	}
+	if err := newShopifyClient(ctx, shop, token).send("GET", "/admin/oauth/access_scopes.json", nil, &scopes); err != nil {
+		return nil, err
+	}
+	granted := make([]string, len(scopes.AccessScopes))
+	for i, s := range scopes.AccessScopes {
+		granted[i] = s.Handle
+	}
+	return granted, nil
+}
+
+// checkScopes makes sure the installed shop has granted every required scope,
+// recording what it has granted if that was never stored. It returns the
+// scopes still missing, which need the merchant to authorize the app again.
+func checkScopes(ctx context.Context, installed *ShopRecord) ([]string, error) {
+	if len(installed.Scopes) == 0 {
+		granted, err := grantedScopes(ctx, installed.Domain, installed.Token)
+		if err != nil {
+			return nil, err
+		}
+		installed.Scopes = granted
+		if err := shops.Put(ctx, installed); err != nil {
+			return nil, err
+		}
+	}
+	return missingScopes(installed.Scopes), nil
+}
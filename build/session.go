@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	sessionCookie = "shopify_app"
+	sessionMaxAge = 7 * 24 * time.Hour
+	// maxSessionCookie keeps cookie sessions under the 4KB browsers allow.
+	maxSessionCookie = 4000
+)
+
+var (
+	errSessionTooLarge = errors.New("session is too large for a cookie")
+	errNoSessionSecret = errors.New("Set SESSION_SECRET")
+)
+
+// Session is one browser's session. Values are only written back when the
+// session is saved.
+type Session struct {
+	ID      string
+	Values  map[string]string
+	Expires time.Time
+}
+
+// SessionStore loads and saves the session of a request. A missing, expired
+// or tampered cookie gives a new empty session rather than an error; errors
+// are only returned when the store itself fails.
+type SessionStore interface {
+	Get(r *http.Request) (*Session, error)
+	Save(w http.ResponseWriter, r *http.Request, s *Session) error
+}
+
+// sessionSecrets returns the comma separated secrets in SESSION_SECRET,
+// newest first. Checkout session tokens are signed with them too.
+func sessionSecrets() [][]byte {
+	var secrets [][]byte
+	for _, s := range strings.Split(os.Getenv("SESSION_SECRET"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			secrets = append(secrets, []byte(s))
+		}
+	}
+	return secrets
+}
+
+// sessionStoreFromEnv returns the store named by SESSION_STORE, sealed with
+// the secrets in SESSION_SECRET.
+func sessionStoreFromEnv() (SessionStore, error) {
+	return newSessionStore(os.Getenv("SESSION_STORE"), sessionSecrets())
+}
+
+// newSessionStore returns the store of the given kind, "cookie", "memory" or
+// "datastore" (the default). Sessions are sealed with the first secret and
+// opened with any of them, so a secret is rotated by putting the new one
+// first and dropping the old one once its sessions have expired.
+func newSessionStore(kind string, secrets [][]byte) (SessionStore, error) {
+	if len(secrets) == 0 {
+		return nil, errNoSessionSecret
+	}
+	codec := &sessionCodec{}
+	for _, s := range secrets {
+		key := sha256.Sum256(s)
+		codec.keys = append(codec.keys, key[:])
+	}
+	switch kind {
+	case "cookie":
+		return &cookieSessionStore{codec: codec}, nil
+	case "memory":
+		return &serverSessionStore{codec: codec, data: newMemorySessionData()}, nil
+	case "", "datastore":
+		return &serverSessionStore{codec: codec, data: datastoreSessionData{}}, nil
+	}
+	return nil, errors.New("SESSION_STORE must be cookie, memory or datastore")
+}
+
+// sessionCodec seals cookie values with the session keys.
+type sessionCodec struct {
+	keys [][]byte
+}
+
+func (c *sessionCodec) seal(v interface{}) (string, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := sealValue(c.keys[0], plain, []byte(sessionCookie))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+func (c *sessionCodec) open(value string, v interface{}) bool {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return false
+	}
+	for _, key := range c.keys {
+		if plain, err := openValue(key, sealed, []byte(sessionCookie)); err == nil {
+			return json.Unmarshal(plain, v) == nil
+		}
+	}
+	return false
+}
+
+// setSessionCookie writes the session cookie with the defaults an embedded app
+// needs: the admin loads it in a cross-site iframe, which only gets cookies
+// that are SameSite=None, and those must be Secure.
+func setSessionCookie(w http.ResponseWriter, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(time.Until(expires).Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+	})
+}
+
+func newSession() *Session {
+	return &Session{Values: map[string]string{}}
+}
+
+// cookieSessionStore keeps the whole session in the cookie.
+type cookieSessionStore struct {
+	codec *sessionCodec
+}
+
+func (store *cookieSessionStore) Get(r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return newSession(), nil
+	}
+	s := newSession()
+	if !store.codec.open(cookie.Value, s) || time.Now().After(s.Expires) {
+		return newSession(), nil
+	}
+	return s, nil
+}
+
+func (store *cookieSessionStore) Save(w http.ResponseWriter, r *http.Request, s *Session) error {
+	s.Expires = time.Now().Add(sessionMaxAge)
+	value, err := store.codec.seal(s)
+	if err != nil {
+		return err
+	}
+	if len(value) > maxSessionCookie {
+		return errSessionTooLarge
+	}
+	setSessionCookie(w, value, s.Expires)
+	return nil
+}
+
+// sessionData holds the values of server side sessions by ID.
+type sessionData interface {
+	get(ctx context.Context, id string) (*Session, error)
+	put(ctx context.Context, s *Session) error
+}
+
+// serverSessionStore keeps sessions in a sessionData, with only the sealed
+// session ID in the cookie.
+type serverSessionStore struct {
+	codec *sessionCodec
+	data  sessionData
+}
+
+func (store *serverSessionStore) Get(r *http.Request) (*Session, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return newSession(), nil
+	}
+	var id string
+	if !store.codec.open(cookie.Value, &id) || id == "" {
+		return newSession(), nil
+	}
+	s, err := store.data.get(appengine.NewContext(r), id)
+	if err == errSessionNotFound {
+		return newSession(), nil
+	} else if err != nil {
+		return nil, err
+	}
+	if time.Now().After(s.Expires) {
+		return newSession(), nil
+	}
+	return s, nil
+}
+
+func (store *serverSessionStore) Save(w http.ResponseWriter, r *http.Request, s *Session) error {
+	if s.ID == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		s.ID = hex.EncodeToString(b)
+	}
+	s.Expires = time.Now().Add(sessionMaxAge)
+	if err := store.data.put(appengine.NewContext(r), s); err != nil {
+		return err
+	}
+	value, err := store.codec.seal(s.ID)
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, value, s.Expires)
+	return nil
+}
+
+var errSessionNotFound = errors.New("session not found")
+
+// AdminSession is a server side session as stored in datastore, keyed by its
+// ID. Shop is the shop logged in with it, so the session is erased with the
+// shop.
+type AdminSession struct {
+	Shop    string
+	Values  []byte `datastore:",noindex"`
+	Expires time.Time
+}
+
+type datastoreSessionData struct{}
+
+func (datastoreSessionData) get(ctx context.Context, id string) (*Session, error) {
+	var stored AdminSession
+	err := datastore.Get(ctx, datastore.NewKey(ctx, "AdminSession", id, 0, nil), &stored)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, errSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	s := &Session{ID: id, Expires: stored.Expires}
+	if err := json.Unmarshal(stored.Values, &s.Values); err != nil || s.Values == nil {
+		s.Values = map[string]string{}
+	}
+	return s, nil
+}
+
+func (datastoreSessionData) put(ctx context.Context, s *Session) error {
+	values, err := json.Marshal(s.Values)
+	if err != nil {
+		return err
+	}
+	stored := AdminSession{Shop: s.Values["current_shop"], Values: values, Expires: s.Expires}
+	if _, err := datastore.Put(ctx, datastore.NewKey(ctx, "AdminSession", s.ID, 0, nil), &stored); err != nil {
+		return err
+	}
+
+	// Sessions that are never used again are left behind when they expire.
+	stale, err := datastore.NewQuery("AdminSession").Filter("Expires <", time.Now()).KeysOnly().Limit(50).GetAll(ctx, nil)
+	if err == nil && len(stale) > 0 {
+		if err := datastore.DeleteMulti(ctx, stale); err != nil {
+			log.Warningf(ctx, "Delete Stale Sessions Error: %s", err)
+		}
+	}
+	return nil
+}
+
+// memorySessionData keeps sessions in memory, for local development.
+type memorySessionData struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+func newMemorySessionData() *memorySessionData {
+	return &memorySessionData{sessions: map[string]Session{}}
+}
+
+func (data *memorySessionData) get(ctx context.Context, id string) (*Session, error) {
+	data.mu.Lock()
+	defer data.mu.Unlock()
+	s, ok := data.sessions[id]
+	if !ok {
+		return nil, errSessionNotFound
+	}
+	values := make(map[string]string, len(s.Values))
+	for k, v := range s.Values {
+		values[k] = v
+	}
+	s.Values = values
+	return &s, nil
+}
+
+func (data *memorySessionData) put(ctx context.Context, s *Session) error {
+	data.mu.Lock()
+	defer data.mu.Unlock()
+	values := make(map[string]string, len(s.Values))
+	for k, v := range s.Values {
+		values[k] = v
+	}
+	data.sessions[s.ID] = Session{ID: s.ID, Values: values, Expires: s.Expires}
+	now := time.Now()
+	for id, stored := range data.sessions {
+		if now.After(stored.Expires) {
+			delete(data.sessions, id)
+		}
+	}
+	return nil
+}
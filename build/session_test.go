@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/appengine/aetest"
+)
+
+// saveTestSession saves a session logged in as shop in store and returns the
+// cookie it set.
+func saveTestSession(t *testing.T, inst aetest.Instance, store SessionStore, shop string) *http.Cookie {
+	w := httptest.NewRecorder()
+	s := newSession()
+	s.Values["current_shop"] = shop
+	if err := store.Save(w, newTestRequest(t, inst, "GET", "/admin", nil), s); err != nil {
+		t.Fatalf("Save: %s", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie {
+		t.Fatalf("Save set cookies %v", cookies)
+	}
+	return cookies[0]
+}
+
+// loadTestSession returns the shop the session in cookie is logged in as.
+func loadTestSession(t *testing.T, inst aetest.Instance, store SessionStore, cookie *http.Cookie) string {
+	req := newTestRequest(t, inst, "GET", "/admin", nil)
+	req.AddCookie(cookie)
+	s, err := store.Get(req)
+	if err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	return s.Values["current_shop"]
+}
+
+func TestSessionStores(t *testing.T) {
+	inst, done := newTestInstance(t)
+	defer done()
+	secrets := [][]byte{[]byte("current-secret")}
+
+	for _, kind := range []string{"cookie", "memory", "datastore"} {
+		store, err := newSessionStore(kind, secrets)
+		if err != nil {
+			t.Fatalf("%s: newSessionStore: %s", kind, err)
+		}
+		cookie := saveTestSession(t, inst, store, "shop.myshopify.com")
+		if got := loadTestSession(t, inst, store, cookie); got != "shop.myshopify.com" {
+			t.Errorf("%s: logged in as %q after a round trip", kind, got)
+		}
+		// The admin is a cross-site iframe, which only gets the cookie back
+		// if it is SameSite=None, and so Secure.
+		if cookie.SameSite != http.SameSiteNoneMode || !cookie.Secure || !cookie.HttpOnly || cookie.Path != "/" {
+			t.Errorf("%s: cookie = %+v, want SameSite=None, Secure, HttpOnly on /", kind, cookie)
+		}
+
+		tampered := *cookie
+		tampered.Value = cookie.Value[:len(cookie.Value)-2] + "AA"
+		if got := loadTestSession(t, inst, store, &tampered); got != "" {
+			t.Errorf("%s: tampered cookie logged in as %q", kind, got)
+		}
+		if got := loadTestSession(t, inst, store, &http.Cookie{Name: sessionCookie, Value: "garbage"}); got != "" {
+			t.Errorf("%s: garbage cookie logged in as %q", kind, got)
+		}
+	}
+
+	if _, err := newSessionStore("datastore", nil); err != errNoSessionSecret {
+		t.Errorf("store without a secret: %v", err)
+	}
+	if _, err := newSessionStore("redis", secrets); err == nil {
+		t.Error("unknown store accepted")
+	}
+}
+
+func TestSessionSecretRotation(t *testing.T) {
+	inst, done := newTestInstance(t)
+	defer done()
+	old := [][]byte{[]byte("old-secret")}
+	rotated := [][]byte{[]byte("new-secret"), []byte("old-secret")}
+	dropped := [][]byte{[]byte("new-secret")}
+
+	for _, kind := range []string{"cookie", "memory"} {
+		before, _ := newSessionStore(kind, old)
+		cookie := saveTestSession(t, inst, before, "shop.myshopify.com")
+
+		// Server side stores share their data across the rotation, as a
+		// redeploy keeps the datastore.
+		after, _ := newSessionStore(kind, rotated)
+		gone, _ := newSessionStore(kind, dropped)
+		if kind == "memory" {
+			data := before.(*serverSessionStore).data
+			after.(*serverSessionStore).data = data
+			gone.(*serverSessionStore).data = data
+		}
+		if got := loadTestSession(t, inst, after, cookie); got != "shop.myshopify.com" {
+			t.Errorf("%s: session sealed with the old secret logged in as %q after rotation", kind, got)
+		}
+		if got := loadTestSession(t, inst, gone, cookie); got != "" {
+			t.Errorf("%s: session opened after its secret was dropped: %q", kind, got)
+		}
+
+		// Sessions saved after the rotation are sealed with the new secret.
+		cookie = saveTestSession(t, inst, after, "shop.myshopify.com")
+		if got := loadTestSession(t, inst, gone, cookie); got != "shop.myshopify.com" {
+			t.Errorf("%s: session saved after rotation not sealed with the new secret", kind)
+		}
+	}
+}
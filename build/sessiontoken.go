@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sessionTokenLeeway allows for a little clock drift between Shopify and us
+// when checking a session token's exp and nbf.
+const sessionTokenLeeway = 5 * time.Second
+
+var errSessionToken = errors.New("invalid session token")
+
+// sessionTokenClaims are the claims App Bridge puts in the session tokens it
+// issues to the embedded admin.
+type sessionTokenClaims struct {
+	Iss  string `json:"iss"`
+	Dest string `json:"dest"`
+	Aud  string `json:"aud"`
+	Sub  string `json:"sub"`
+	Exp  int64  `json:"exp"`
+	Nbf  int64  `json:"nbf"`
+	Iat  int64  `json:"iat"`
+	Jti  string `json:"jti"`
+	Sid  string `json:"sid"`
+}
+
+// shop returns the myshopify.com domain the token was issued for.
+func (c *sessionTokenClaims) shop() string {
+	return strings.TrimPrefix(c.Dest, "https://")
+}
+
+// verifySessionToken checks a session token's HS256 signature against secret,
+// that it was issued to the app with apiKey for a shop, and that it is valid
+// at now.
+func verifySessionToken(token string, apiKey string, secret string, now time.Time) (*sessionTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errSessionToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Typ string `json:"typ"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, errSessionToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errSessionToken
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errSessionToken
+	}
+
+	var claims sessionTokenClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return nil, errSessionToken
+	}
+	if claims.Aud != apiKey {
+		return nil, errSessionToken
+	}
+	if !strings.HasPrefix(claims.Dest, "https://") || !validShopDomain(claims.shop()) {
+		return nil, errSessionToken
+	}
+	// The issuer is the shop's admin, so it has to agree with dest.
+	if claims.Iss != claims.Dest+"/admin" {
+		return nil, errSessionToken
+	}
+	if now.After(time.Unix(claims.Exp, 0).Add(sessionTokenLeeway)) {
+		return nil, errSessionToken
+	}
+	if now.Before(time.Unix(claims.Nbf, 0).Add(-sessionTokenLeeway)) {
+		return nil, errSessionToken
+	}
+	return &claims, nil
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// bearerToken returns the token in r's Authorization header, if it has one.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
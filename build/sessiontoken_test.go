@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// signSessionToken makes a session token the way App Bridge does, with alg
+// in its header, signed with secret.
+func signSessionToken(t *testing.T, alg string, claims sessionTokenClaims, secret string) string {
+	part := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal: %s", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := part(map[string]string{"alg": alg, "typ": "JWT"}) + "." + part(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// testSessionClaims are claims for shop that are valid at now.
+func testSessionClaims(shop string, now time.Time) sessionTokenClaims {
+	return sessionTokenClaims{
+		Iss:  "https://" + shop + "/admin",
+		Dest: "https://" + shop,
+		Aud:  app.APIKey,
+		Sub:  "42",
+		Exp:  now.Add(time.Minute).Unix(),
+		Nbf:  now.Add(-time.Minute).Unix(),
+		Iat:  now.Add(-time.Minute).Unix(),
+		Jti:  "jti",
+		Sid:  "sid",
+	}
+}
+
+func TestVerifySessionToken(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name   string
+		alg    string
+		secret string
+		change func(c *sessionTokenClaims)
+		ok     bool
+	}{
+		{"valid", "HS256", app.APISecret, nil, true},
+		{"signed with another secret", "HS256", "another-secret", nil, false},
+		{"alg none", "none", app.APISecret, nil, false},
+		{"alg HS512", "HS512", app.APISecret, nil, false},
+		{"another app", "HS256", app.APISecret, func(c *sessionTokenClaims) { c.Aud = "another-api-key" }, false},
+		{"http dest", "HS256", app.APISecret, func(c *sessionTokenClaims) {
+			c.Dest = "http://shop.myshopify.com"
+			c.Iss = c.Dest + "/admin"
+		}, false},
+		{"dest not on myshopify.com", "HS256", app.APISecret, func(c *sessionTokenClaims) {
+			c.Dest = "https://shop.example.com"
+			c.Iss = c.Dest + "/admin"
+		}, false},
+		{"issued by another shop", "HS256", app.APISecret, func(c *sessionTokenClaims) { c.Iss = "https://other.myshopify.com/admin" }, false},
+		{"issuer not the admin", "HS256", app.APISecret, func(c *sessionTokenClaims) { c.Iss = c.Dest }, false},
+		{"expired within leeway", "HS256", app.APISecret, func(c *sessionTokenClaims) { c.Exp = now.Add(-4 * time.Second).Unix() }, true},
+		{"expired", "HS256", app.APISecret, func(c *sessionTokenClaims) { c.Exp = now.Add(-6 * time.Second).Unix() }, false},
+		{"not yet valid within leeway", "HS256", app.APISecret, func(c *sessionTokenClaims) { c.Nbf = now.Add(4 * time.Second).Unix() }, true},
+		{"not yet valid", "HS256", app.APISecret, func(c *sessionTokenClaims) { c.Nbf = now.Add(6 * time.Second).Unix() }, false},
+	}
+	for _, tt := range tests {
+		claims := testSessionClaims("shop.myshopify.com", now)
+		if tt.change != nil {
+			tt.change(&claims)
+		}
+		token := signSessionToken(t, tt.alg, claims, tt.secret)
+		got, err := verifySessionToken(token, app.APIKey, app.APISecret, now)
+		if tt.ok && (err != nil || got.shop() != "shop.myshopify.com") {
+			t.Errorf("%s: rejected: %v", tt.name, err)
+		}
+		if !tt.ok && err != errSessionToken {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+
+	for _, token := range []string{"", "a.b", "a.b.c.d", "!!!.???.***"} {
+		if _, err := verifySessionToken(token, app.APIKey, app.APISecret, now); err != errSessionToken {
+			t.Errorf("malformed token %q accepted", token)
+		}
+	}
+}
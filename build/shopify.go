@@ -3,34 +3,15 @@ package main
 import (
   "google.golang.org/appengine"
 	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/datastore"
 	"github.com/dommmel/go-shopify"
-	"github.com/gorilla/sessions"
-	"github.com/dsoprea/goappenginesessioncascade"
-	"github.com/LarryBattle/nonce-golang"
   "net/http"
-	"net/url"
-  "strings"
   "os"
 	"io"
 	"io/ioutil"
+	"time"
 )
 
 var app *shopify.App
-var api *shopify.API
-
-var (
-    sessionSecret = []byte(os.Getenv("SESSION_SECRET"))
-    sessionStore = cascadestore.NewCascadeStore(cascadestore.DistributedBackends, sessionSecret)
-		tokens map[string]string
-		state string
-		assetParams interface{}
-)
-
-type Shop struct {
-	Name string
-	Token string
-}
 
 func init() {
 
@@ -53,78 +34,81 @@ func init() {
 		APIKey:      key,
 		APISecret:   secret,
 	}
-	tokens = map[string]string{}
-}
-
-func getSession(r *http.Request) *sessions.Session {
-	ctx := appengine.NewContext(r)
-	log.Debugf(ctx, "getSession RAN")
-	session, err := sessionStore.Get(r, "shopify_app")
-	if err != nil {
-  	panic(err)
-  }
-	log.Debugf(ctx, "Returning session")
-	return session
 }
 
-func serveInstall(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-	log.Debugf(ctx, "serveInstall RAN")
-	params := r.URL.Query()
-	log.Debugf(ctx, "Params error length: %s", len(params["error"]))
-	if len(params["error"]) == 1 {
-		log.Debugf(ctx, "Install error: %s", params["error"])
-	} else if len(params["code"]) == 1 {
-		log.Debugf(ctx, "No params error")
-		// auth callback from shopify
-		log.Debugf(ctx, "state: %s", state)
-		if app.AdminSignatureOk(r.URL, state) != true {
-			http.Error(w, "Invalid signature", 401)
-			log.Debugf(ctx, "Invalid signature from Shopify")
-			return
-		}
-		log.Debugf(ctx, "Admin Signature is ok")
-		if len(params["shop"]) != 1 {
-			http.Error(w, "Expected 'shop' param", 400)
-			log.Debugf(ctx, "Invalid signature from Shopify")
-			return
-		}
-		log.Debugf(ctx, "Only one shop parameter. Good")
-		shop := params["shop"][0]
-		log.Debugf(ctx, "serveInstall 2nd shop: %s", shop)
-		token, _ := app.AccessToken(ctx, shop, params["code"][0])
-		// persist this token
-		tokens[shop] = token
-		shopEntity := Shop {
-			Name: shop,
-			Token: token,
-		}
-		if _, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "Shop", nil), &shopEntity); err != nil {
-    	http.Error(w, err.Error(), http.StatusInternalServerError)
-      return
-    }
-		log.Debugf(ctx, "Token succesfully stored")
-
-		// log in user
-		session := getSession(r)
-		session.Values["current_shop"] = shop
-		err := session.Save(r, w)
-		if err != nil {
-			panic(err)
+// serveInstall starts and completes the OAuth install, logging the shop in
+// with sessions once it has a token.
+func serveInstall(sessions SessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		log.Debugf(ctx, "serveInstall RAN")
+		params := r.URL.Query()
+		log.Debugf(ctx, "Params error length: %d", len(params["error"]))
+		if len(params["error"]) == 1 {
+			log.Debugf(ctx, "Install error: %s", params["error"])
+		} else if len(params["code"]) == 1 {
+			log.Debugf(ctx, "No params error")
+			// auth callback from shopify
+			if app.AdminSignatureOk(r.URL, params.Get("state")) != true {
+				http.Error(w, "Invalid signature", 401)
+				log.Debugf(ctx, "Invalid signature from Shopify")
+				return
+			}
+			log.Debugf(ctx, "Admin Signature is ok")
+			if len(params["shop"]) != 1 {
+				http.Error(w, "Expected 'shop' param", 400)
+				log.Debugf(ctx, "Invalid signature from Shopify")
+				return
+			}
+			log.Debugf(ctx, "Only one shop parameter. Good")
+			shop := params["shop"][0]
+			log.Debugf(ctx, "serveInstall 2nd shop: %s", shop)
+			// The state must be the one issued for this shop's install, and is
+			// only good once.
+			if err := consumeOAuthState(ctx, params.Get("state"), shop); err != nil {
+				log.Warningf(ctx, "OAuth State Error: %s", err)
+				http.Error(w, errOAuthState.Error(), http.StatusForbidden)
+				return
+			}
+			token, err := app.AccessToken(ctx, shop, params["code"][0])
+			if err != nil {
+				log.Errorf(ctx, "Access Token Error: %s", err)
+				http.Error(w, "Could not complete install", http.StatusBadGateway)
+				return
+			}
+			scopes, err := grantedScopes(ctx, shop, token)
+			if err != nil {
+				log.Warningf(ctx, "Access Scopes Error: %s", err)
+			}
+			// persist this token
+			if err := shops.Put(ctx, &ShopRecord{Domain: shop, Token: token, Scopes: scopes}); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Debugf(ctx, "Token succesfully stored")
+			registerShopifyWebhooks(ctx, Tenant{Shop: shop})
+
+			// log in user
+			if session, err := sessions.Get(r); err != nil {
+				log.Errorf(ctx, "Get Session Error: %s", err)
+			} else {
+				session.Values["current_shop"] = shop
+				if err := sessions.Save(w, r, session); err != nil {
+					log.Errorf(ctx, "Save Session Error: %s", err)
+				}
+			}
+
+			log.Debugf(ctx, "logged in as %s, redirecting to admin", shop)
+			target := "https://" + shop + "/admin/apps/tixpire-payments"
+			http.Redirect(w, r, target, 303)
+
+		} else if len(params["shop"]) == 1 {
+			// install request, redirect to Shopify
+			shop := params["shop"][0] + ".myshopify.com"
+			log.Debugf(ctx, "serveInstall first shop: %s", shop)
+			log.Debugf(ctx, "starting oauth flow")
+			redirectToAuthorize(ctx, w, r, shop)
 		}
-
-		log.Debugf(ctx, "logged in as %s, redirecting to admin", shop)
-		target := "https://" + shop + "/admin/apps/tixpire-payments"
-		http.Redirect(w, r, target, 303)
-
-	} else if len(params["shop"]) == 1 {
-		// install request, redirect to Shopify
-		shop := params["shop"][0] + ".myshopify.com"
-		log.Debugf(ctx, "serveInstall first shop: %s", shop)
-		log.Debugf(ctx, "starting oauth flow")
-		state = nonce.NewToken()
-		log.Debugf(ctx, "state1: %s", state)
-		http.Redirect(w, r, app.AuthorizeURL(shop, "read_themes,write_themes", state), 302)
 	}
 }
 
@@ -142,51 +126,45 @@ func serveAppProxy(w http.ResponseWriter, r *http.Request) {
 func serveAdmin(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 	log.Debugf(ctx, "serveAdmin RAN")
-	session := getSession(r)
-	params := r.URL.Query()
-
-
-	// signed request from Shopify?
-	if app.AdminSignatureOk(r.URL, state) {
-		log.Debugf(ctx, "signed request!")
-		log.Debugf(ctx, "serveAdmin func AdminSignatureOk shop: %s", params["shop"][0])
-		session.Values["current_shop"] = params["shop"][0]
-		session.Save(r, w)
-	} else if _, ok := session.Values["current_shop"]; !ok {
-		log.Debugf(ctx, "no current_shop")
-		// not logged in and not signed request
-		http.Error(w, "Unauthorized", 401)
-		return
-	}
-
-	shop, _ := session.Values["current_shop"].(string)
+	shop := currentShop(r).Domain
+	tenant := currentShop(r).tenant()
 	log.Debugf(ctx, "serveAdmin shop: %s", shop)
-	// if we don't have an access token for the shop, obtain one now.
-	var shopEntity []Shop
-	if _, ok := tokens[shop]; !ok {
-		log.Debugf(ctx, "No token stored interally. Checking datastore...")
-		q := datastore.NewQuery("Shop").Filter("Name =", shop)
-		_, err := q.GetAll(ctx, &shopEntity)
-		log.Debugf(ctx, "shopEntity: %s", shopEntity)
-		if err != nil || len(shopEntity) == 0 {
-			// Handle error.
-			state := nonce.NewToken()
-			log.Debugf(ctx, "No access token")
-			http.Redirect(w, r, app.AuthorizeURL(shop, "read_themes,write_themes", state), 302)
-			return
-		}
-		tokens[shop] = shopEntity[0].Token
-		log.Debugf(ctx, "shopEntity token: %s", shopEntity[0].Token)
-	}
-	log.Debugf(ctx, "shopEntity: %s", shopEntity)
 	// they're logged in
 	log.Debugf(ctx, "Access token found. They're logged in")
+	var orders []Order
+	if _, err := tenant.query("Order").Filter("InDunning =", true).GetAll(ctx, &orders); err != nil {
+		log.Debugf(ctx, "Dunning Query Error: %s", err)
+	}
+	var cancellations []Order
+	if _, err := tenant.query("Order").Filter("CancelRequested >", time.Time{}).GetAll(ctx, &cancellations); err != nil {
+		log.Debugf(ctx, "Cancellation Query Error: %s", err)
+	}
+	funnels, err := checkoutFunnels(ctx, tenant, time.Now().Add(-metricsWindow))
+	if err != nil {
+		log.Debugf(ctx, "Checkout Funnel Query Error: %s", err)
+	}
+	cfg, err := tenant.vendorConfig(ctx)
+	if err != nil {
+		log.Debugf(ctx, "Get Vendor Config Error: %s", err)
+		cfg = defaultVendorConfig(shop)
+	}
+	dataRequests, err := customerDataRequests(ctx, tenant)
+	if err != nil {
+		log.Debugf(ctx, "Data Request Query Error: %s", err)
+	}
 	type AdminVars struct {
 		Shop   string
 		APIKey string
 		AppName string
+		Dunning []Order
+		Policy DunningPolicy
+		Cancellations []Order
+		Funnels []CheckoutFunnel
+		ResumeHours int
+		DataRequests []dataRequestRow
+		Vendor *VendorConfig
 	}
-	v := AdminVars{Shop: shop, APIKey: app.APIKey, AppName: "Tixpire Payments"}
+	v := AdminVars{Shop: shop, APIKey: app.APIKey, AppName: "Tixpire Payments", Dunning: orders, Policy: dunningPolicy, Cancellations: cancellations, Funnels: funnels, ResumeHours: int(resumeDelay.Hours()), DataRequests: dataRequests, Vendor: cfg}
 
 	tpl.ExecuteTemplate(w, "admin.gohtml", v)
 }
@@ -194,63 +172,21 @@ func serveAdmin(w http.ResponseWriter, r *http.Request) {
 func serveUpdate(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 	log.Debugf(ctx, "update RAN")
-	session := getSession(r)
-	params := r.URL.Query()
-
-	shop := params["shop"][0]
-	session.Values["current_shop"] = shop
-	err := session.Save(r, w)
+	tenant := currentShop(r).tenant()
+	api := currentShop(r).API
+	themeId, err := currentShop(r).mainTheme()
 	if err != nil {
-		panic(err)
-	}
-
-	var shopEntity []Shop
-	if _, ok := tokens[shop]; !ok {
-		log.Debugf(ctx, "No token stored interally. Checking datastore...")
-		q := datastore.NewQuery("Shop").Filter("Name =", shop)
-		_, err := q.GetAll(ctx, &shopEntity)
-		log.Debugf(ctx, "shopEntity: %s", shopEntity)
-		if err != nil || len(shopEntity) == 0 {
-			// Handle error.
-			state := nonce.NewToken()
-			log.Debugf(ctx, "No access token")
-			http.Redirect(w, r, app.AuthorizeURL(shop, "read_themes,write_themes", state), 302)
-			return
-		}
-		tokens[shop] = shopEntity[0].Token
-		log.Debugf(ctx, "shopEntity token: %s", shopEntity[0].Token)
-	}
-	uri := "https://" + shop
-	api = &shopify.API {
-		URI: uri,
-		Token: tokens[shop],
-		Secret: os.Getenv("SHOPIFY_API_SECRET"),
-		Context: ctx,
-	}
-	log.Debugf(ctx, "api initialized: %s", api)
-
-	themes, themesErr := api.Themes()
-	log.Debugf(ctx, "themes api called")
-	var themeId int64
-	if themesErr != nil {
-		log.Debugf(ctx, "Themes Error: %s", themesErr)
-		http.Error(w, themesErr.Error(), http.StatusInternalServerError)
-	}
-
-	for i := 0; i < len(themes); i++ {
-		if (themes[i].Role == "main") {
-			themeId = themes[i].Id
-		}
+		log.Debugf(ctx, "Themes Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	log.Debugf(ctx, "Theme id: %s", themeId)
+	log.Debugf(ctx, "Theme id: %d", themeId)
 
-	assetParams := url.Values{}
-	assetParams.Set("asset[key]", "snippets/ajax-cart-template.liquid")
-
-	asset, assetErr := api.Asset(themeId, assetParams)
+	asset, assetErr := api.asset(themeId, "snippets/ajax-cart-template.liquid")
 	if assetErr != nil {
 		log.Debugf(ctx, "Asset Err: %s", assetErr)
 		http.Error(w, assetErr.Error(), http.StatusInternalServerError)
+		return
 	}
 	assetValue := asset.Value
 
@@ -259,27 +195,20 @@ func serveUpdate(w http.ResponseWriter, r *http.Request) {
 		log.Debugf(ctx, "Error reading checkout.liquid file: %s", dataErr)
 	}
 	button := string(assetData)
-	var indexTop int
-	var indexBottom int
-	if shop == "tasteoftravel.myshopify.com" {
-		indexTop = strings.Index(assetValue, "</button>\n\n{% endif %}\n<!-- end Bold code -->")
-		indexTop = indexTop + len("</button>\n\n{% endif %}\n<!-- end Bold code -->")
-		indexBottom = strings.Index(assetValue, "</div>\n            </form>\n\n          </div>\n\n          <div class=\"product-single__description rte\" itemprop=\"description\">\n            {{ product.description }}\n          </div>")
-	} else {
-		indexTop = strings.Index(assetValue, "{% endif %}\n              </div>")
-		indexTop = indexTop + len("{% endif %}\n              </div>")
-		indexBottom = strings.Index(assetValue, "{% endform %}\n\n          </div>")
+	cfg, err := tenant.vendorConfig(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Get Vendor Config Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	newAsset, err := cfg.injectButton(assetValue, button)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
 	}
-
-	indexBottom = indexBottom - 1
-	newAsset := assetValue[:indexTop] + button + assetValue[indexBottom:]
 	//assetValue := strings.Replace(asset.Value, "Tixpire Payments", "PAY OVER TIME", 1)
 
-	assetChange := api.NewAsset()
-	assetChange.Key = "snippets/ajax-cart-template.liquid"
-	assetChange.ThemeId = themeId
-	assetChange.Value = newAsset
-	assetChangeErr := assetChange.Save()
+	assetChangeErr := api.putAsset(themeId, "snippets/ajax-cart-template.liquid", newAsset)
 	if assetChangeErr != nil {
   	log.Debugf(ctx, "Error saving asset: %s", assetChangeErr)
 	}
@@ -290,66 +219,21 @@ func serveUpdate(w http.ResponseWriter, r *http.Request) {
 func serveAddCheckout(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 	log.Debugf(ctx, "update RAN")
-	session := getSession(r)
-	params := r.URL.Query()
-
-	shop := params["shop"][0]
-	session.Values["current_shop"] = shop
-	err := session.Save(r, w)
+	api := currentShop(r).API
+	themeId, err := currentShop(r).mainTheme()
 	if err != nil {
-		panic(err)
-	}
-
-	var shopEntity []Shop
-	if _, ok := tokens[shop]; !ok {
-		log.Debugf(ctx, "No token stored interally. Checking datastore...")
-		q := datastore.NewQuery("Shop").Filter("Name =", shop)
-		_, err := q.GetAll(ctx, &shopEntity)
-		log.Debugf(ctx, "shopEntity: %s", shopEntity)
-		if err != nil || len(shopEntity) == 0 {
-			// Handle error.
-			state := nonce.NewToken()
-			log.Debugf(ctx, "No access token")
-			http.Redirect(w, r, app.AuthorizeURL(shop, "read_themes,write_themes", state), 302)
-			return
-		}
-		tokens[shop] = shopEntity[0].Token
-		log.Debugf(ctx, "shopEntity token: %s", shopEntity[0].Token)
-	}
-	uri := "https://" + shop
-	api = &shopify.API {
-		URI: uri,
-		Token: tokens[shop],
-		Secret: os.Getenv("SHOPIFY_API_SECRET"),
-		Context: ctx,
-	}
-	log.Debugf(ctx, "api initialized: %s", api)
-
-	themes, themesErr := api.Themes()
-	log.Debugf(ctx, "themes api called")
-	var themeId int64
-	if themesErr != nil {
-		log.Debugf(ctx, "Themes Error: %s", themesErr)
-		http.Error(w, themesErr.Error(), http.StatusInternalServerError)
-	}
-
-	for i := 0; i < len(themes); i++ {
-		if (themes[i].Role == "main") {
-			themeId = themes[i].Id
-		}
+		log.Debugf(ctx, "Themes Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	log.Debugf(ctx, "Theme id: %s", themeId)
+	log.Debugf(ctx, "Theme id: %d", themeId)
 
 	assetData, dataErr := ioutil.ReadFile("checkout.liquid")
 	if dataErr != nil {
 		log.Debugf(ctx, "Error reading checkout.liquid file: %s", dataErr)
 	}
 
-	asset := api.NewAsset()
-	asset.Key = "templates/page.checkout.liquid"
-	asset.ThemeId = themeId
-	asset.Value = string(assetData)
-	assetErr := asset.Save()
+	assetErr := api.putAsset(themeId, "templates/page.checkout.liquid", string(assetData))
 	if assetErr != nil {
   	log.Debugf(ctx, "Error saving asset: %s", assetErr)
 	}
@@ -360,63 +244,21 @@ func serveAddCheckout(w http.ResponseWriter, r *http.Request) {
 func serveAddProduct(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 	log.Debugf(ctx, "update RAN")
-	session := getSession(r)
-	params := r.URL.Query()
-
-	shop := params["shop"][0]
-	session.Values["current_shop"] = shop
-	err := session.Save(r, w)
+	tenant := currentShop(r).tenant()
+	api := currentShop(r).API
+	themeId, err := currentShop(r).mainTheme()
 	if err != nil {
-		panic(err)
-	}
-
-	var shopEntity []Shop
-	if _, ok := tokens[shop]; !ok {
-		log.Debugf(ctx, "No token stored interally. Checking datastore...")
-		q := datastore.NewQuery("Shop").Filter("Name =", shop)
-		_, err := q.GetAll(ctx, &shopEntity)
-		log.Debugf(ctx, "shopEntity: %s", shopEntity)
-		if err != nil || len(shopEntity) == 0 {
-			// Handle error.
-			state := nonce.NewToken()
-			log.Debugf(ctx, "No access token")
-			http.Redirect(w, r, app.AuthorizeURL(shop, "read_themes,write_themes", state), 302)
-			return
-		}
-		tokens[shop] = shopEntity[0].Token
-		log.Debugf(ctx, "shopEntity token: %s", shopEntity[0].Token)
-	}
-	uri := "https://" + shop
-	api = &shopify.API {
-		URI: uri,
-		Token: tokens[shop],
-		Secret: os.Getenv("SHOPIFY_API_SECRET"),
-		Context: ctx,
-	}
-	log.Debugf(ctx, "api initialized: %s", api)
-
-	themes, themesErr := api.Themes()
-	log.Debugf(ctx, "themes api called")
-	var themeId int64
-	if themesErr != nil {
-		log.Debugf(ctx, "Themes Error: %s", themesErr)
-		http.Error(w, themesErr.Error(), http.StatusInternalServerError)
-	}
-
-	for i := 0; i < len(themes); i++ {
-		if (themes[i].Role == "main") {
-			themeId = themes[i].Id
-		}
+		log.Debugf(ctx, "Themes Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	log.Debugf(ctx, "Theme id: %s", themeId)
-
-	assetParams := url.Values{}
-	assetParams.Set("asset[key]", "sections/product-template.liquid")
+	log.Debugf(ctx, "Theme id: %d", themeId)
 
-	asset, assetErr := api.Asset(themeId, assetParams)
+	asset, assetErr := api.asset(themeId, "sections/product-template.liquid")
 	if assetErr != nil {
 		log.Debugf(ctx, "Asset Err: %s", assetErr)
 		http.Error(w, assetErr.Error(), http.StatusInternalServerError)
+		return
 	}
 	assetValue := asset.Value
 
@@ -425,27 +267,20 @@ func serveAddProduct(w http.ResponseWriter, r *http.Request) {
 		log.Debugf(ctx, "Error reading checkout.liquid file: %s", dataErr)
 	}
 	button := string(assetData)
-	var indexTop int
-	var indexBottom int
-	if shop == "tasteoftravel.myshopify.com" {
-		indexTop = strings.Index(assetValue, "</button>\n\n{% endif %}\n<!-- end Bold code -->")
-		indexTop = indexTop + len("</button>\n\n{% endif %}\n<!-- end Bold code -->")
-		indexBottom = strings.Index(assetValue, "</div>\n            </form>\n\n          </div>\n\n          <div class=\"product-single__description rte\" itemprop=\"description\">\n            {{ product.description }}\n          </div>")
-	} else {
-		indexTop = strings.Index(assetValue, "{% endif %}\n              </div>")
-		indexTop = indexTop + len("{% endif %}\n              </div>")
-		indexBottom = strings.Index(assetValue, "{% endform %}\n\n          </div>")
+	cfg, err := tenant.vendorConfig(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Get Vendor Config Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	newAsset, err := cfg.injectButton(assetValue, button)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
 	}
-
-	indexBottom = indexBottom - 1
-	newAsset := assetValue[:indexTop] + button + assetValue[indexBottom:]
 
 
-	assetChange := api.NewAsset()
-	assetChange.Key = "sections/product-template.liquid"
-	assetChange.ThemeId = themeId
-	assetChange.Value = newAsset
-	assetChangeErr := assetChange.Save()
+	assetChangeErr := api.putAsset(themeId, "sections/product-template.liquid", newAsset)
 	if assetChangeErr != nil {
   	log.Debugf(ctx, "Error saving asset: %s", assetChangeErr)
 	}
@@ -458,63 +293,20 @@ func serveAddProduct(w http.ResponseWriter, r *http.Request) {
 func serveGetTemplate(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 	log.Debugf(ctx, "update RAN")
-	session := getSession(r)
-	params := r.URL.Query()
-
-	shop := params["shop"][0]
-	session.Values["current_shop"] = shop
-	err := session.Save(r, w)
+	api := currentShop(r).API
+	themeId, err := currentShop(r).mainTheme()
 	if err != nil {
-		panic(err)
-	}
-
-	var shopEntity []Shop
-	if _, ok := tokens[shop]; !ok {
-		log.Debugf(ctx, "No token stored interally. Checking datastore...")
-		q := datastore.NewQuery("Shop").Filter("Name =", shop)
-		_, err := q.GetAll(ctx, &shopEntity)
-		log.Debugf(ctx, "shopEntity: %s", shopEntity)
-		if err != nil || len(shopEntity) == 0 {
-			// Handle error.
-			state := nonce.NewToken()
-			log.Debugf(ctx, "No access token")
-			http.Redirect(w, r, app.AuthorizeURL(shop, "read_themes,write_themes", state), 302)
-			return
-		}
-		tokens[shop] = shopEntity[0].Token
-		log.Debugf(ctx, "shopEntity token: %s", shopEntity[0].Token)
-	}
-	uri := "https://" + shop
-	api = &shopify.API {
-		URI: uri,
-		Token: tokens[shop],
-		Secret: os.Getenv("SHOPIFY_API_SECRET"),
-		Context: ctx,
-	}
-	log.Debugf(ctx, "api initialized: %s", api)
-
-	themes, themesErr := api.Themes()
-	log.Debugf(ctx, "themes api called")
-	var themeId int64
-	if themesErr != nil {
-		log.Debugf(ctx, "Themes Error: %s", themesErr)
-		http.Error(w, themesErr.Error(), http.StatusInternalServerError)
-	}
-
-	for i := 0; i < len(themes); i++ {
-		if (themes[i].Role == "main") {
-			themeId = themes[i].Id
-		}
+		log.Debugf(ctx, "Themes Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	log.Debugf(ctx, "Theme id: %s", themeId)
+	log.Debugf(ctx, "Theme id: %d", themeId)
 
-	assetParams := url.Values{}
-	assetParams.Set("asset[key]", "sections/product-template.liquid")
-
-	asset, assetErr := api.Asset(themeId, assetParams)
+	asset, assetErr := api.asset(themeId, "sections/product-template.liquid")
 	if assetErr != nil {
 		log.Debugf(ctx, "Asset Err: %s", assetErr)
 		http.Error(w, assetErr.Error(), http.StatusInternalServerError)
+		return
 	}
 	w.Header().Set("Content-Type", "text/plain")
 	io.WriteString(w, asset.Value)
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine/urlfetch"
+)
+
+// shopifyAPIVersion is the Admin REST API version the app is written against.
+const shopifyAPIVersion = "2026-07"
+
+const (
+	// shopifyBucketSize and shopifyLeakRate are the REST API's leaky bucket
+	// for a shop on a standard plan: 40 calls, emptying at 2 a second.
+	// Shops on larger plans report their own size, which replaces this.
+	shopifyBucketSize = 40
+	shopifyLeakRate   = 2.0
+	// shopifyMaxRetries is how many times a throttled or failed call is
+	// tried again. Only throttled POSTs are retried: one that failed on
+	// Shopify's side may still have created the order or adjusted the stock.
+	shopifyMaxRetries = 4
+	// shopifyMaxWait caps any one wait, whatever Retry-After asks for.
+	shopifyMaxWait = 30 * time.Second
+)
+
+// shopifyError is a response from the Admin API that wasn't a success.
+type shopifyError struct {
+	Method string
+	Path   string
+	Status int
+	Body   []byte
+}
+
+func (e *shopifyError) Error() string {
+	return fmt.Sprintf("shopify: %s %s: %d %s", e.Method, e.Path, e.Status, e.Body)
+}
+
+// shopifyClient calls one shop's Admin API. It keeps below the shop's rate
+// limit and retries calls that are throttled or fail on Shopify's side.
+type shopifyClient struct {
+	Shop    string
+	Token   string
+	Version string
+	// BaseURL is where the shop's API is, and can be pointed at a test
+	// server.
+	BaseURL string
+	HTTP    *http.Client
+	// Sleep waits between calls, and can be replaced in tests.
+	Sleep func(time.Duration)
+}
+
+// shopifyBaseURL returns where a shop's API is. Tests point it at a fake.
+var shopifyBaseURL = func(shop string) string {
+	return "https://" + shop
+}
+
+func newShopifyClient(ctx context.Context, shop string, token string) *shopifyClient {
+	return &shopifyClient{
+		Shop:    shop,
+		Token:   token,
+		Version: shopifyAPIVersion,
+		BaseURL: shopifyBaseURL(shop),
+		HTTP:    urlfetch.Client(ctx),
+		Sleep:   time.Sleep,
+	}
+}
+
+// do calls path under the pinned API version with body encoded as JSON and
+// decodes the response into v.
+func (c *shopifyClient) do(method string, path string, body interface{}, v interface{}) error {
+	return c.send(method, "/admin/api/"+c.Version+path, body, v)
+}
+
+// send calls path on the shop, which is given in full, as the OAuth endpoints
+// aren't versioned.
+func (c *shopifyClient) send(method string, path string, body interface{}, v interface{}) error {
+	var encoded []byte
+	if body != nil {
+		var err error
+		if encoded, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	bucket := shopifyBucketFor(c.Shop)
+	for attempt := 0; ; attempt++ {
+		if wait := bucket.take(time.Now()); wait > 0 {
+			c.Sleep(wait)
+		}
+		var payload io.Reader
+		if encoded != nil {
+			payload = bytes.NewReader(encoded)
+		}
+		req, err := http.NewRequest(method, c.BaseURL+path, payload)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Shopify-Access-Token", c.Token)
+		req.Header.Set("Accept", "application/json")
+		if encoded != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := c.HTTP.Do(req)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		bucket.observe(resp.Header.Get("X-Shopify-Shop-Api-Call-Limit"), time.Now())
+
+		retry := resp.StatusCode == http.StatusTooManyRequests || (resp.StatusCode >= 500 && method != "POST")
+		if retry && attempt < shopifyMaxRetries {
+			c.Sleep(retryAfter(resp.Header.Get("Retry-After"), attempt))
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			return &shopifyError{Method: method, Path: path, Status: resp.StatusCode, Body: data}
+		}
+		if v == nil {
+			return nil
+		}
+		return json.Unmarshal(data, v)
+	}
+}
+
+// retryAfter is how long to wait before trying a call again: what Shopify
+// asked for, or else a backoff that doubles from a second.
+func retryAfter(header string, attempt int) time.Duration {
+	wait := time.Second << uint(attempt)
+	if secs, err := strconv.ParseFloat(strings.TrimSpace(header), 64); err == nil && secs >= 0 {
+		wait = time.Duration(secs * float64(time.Second))
+	}
+	if wait > shopifyMaxWait {
+		wait = shopifyMaxWait
+	}
+	return wait
+}
+
+// shopifyBucket estimates how full a shop's rate limit bucket is. Each
+// instance keeps its own estimate, and the call limit header Shopify returns
+// corrects it after every call.
+type shopifyBucket struct {
+	mu   sync.Mutex
+	used float64
+	size float64
+	at   time.Time
+}
+
+var shopifyBuckets = struct {
+	sync.Mutex
+	m map[string]*shopifyBucket
+}{m: map[string]*shopifyBucket{}}
+
+func shopifyBucketFor(shop string) *shopifyBucket {
+	shopifyBuckets.Lock()
+	defer shopifyBuckets.Unlock()
+	b, ok := shopifyBuckets.m[shop]
+	if !ok {
+		b = &shopifyBucket{size: shopifyBucketSize}
+		shopifyBuckets.m[shop] = b
+	}
+	return b
+}
+
+// take counts a call against the bucket and returns how long to wait before
+// making it so the bucket doesn't overflow.
+func (b *shopifyBucket) take(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.leak(now)
+	b.used++
+	if b.used <= b.size {
+		return 0
+	}
+	return time.Duration((b.used - b.size) / shopifyLeakRate * float64(time.Second))
+}
+
+func (b *shopifyBucket) leak(now time.Time) {
+	if !b.at.IsZero() {
+		b.used -= now.Sub(b.at).Seconds() * shopifyLeakRate
+		if b.used < 0 {
+			b.used = 0
+		}
+	}
+	b.at = now
+}
+
+// observe takes the bucket's level from a "used/size" call limit header.
+func (b *shopifyBucket) observe(header string, now time.Time) {
+	parts := strings.Split(header, "/")
+	if len(parts) != 2 {
+		return
+	}
+	used, err1 := strconv.Atoi(parts[0])
+	size, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || size <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used = float64(used)
+	b.size = float64(size)
+	b.at = now
+}
+
+type shopifyTheme struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type shopifyAsset struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func (c *shopifyClient) themes() ([]shopifyTheme, error) {
+	var resp struct {
+		Themes []shopifyTheme `json:"themes"`
+	}
+	err := c.do("GET", "/themes.json", nil, &resp)
+	return resp.Themes, err
+}
+
+func (c *shopifyClient) asset(themeID int64, key string) (*shopifyAsset, error) {
+	var resp struct {
+		Asset shopifyAsset `json:"asset"`
+	}
+	path := "/themes/" + strconv.FormatInt(themeID, 10) + "/assets.json?asset%5Bkey%5D=" + url.QueryEscape(key)
+	if err := c.do("GET", path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Asset, nil
+}
+
+func (c *shopifyClient) putAsset(themeID int64, key string, value string) error {
+	body := map[string]shopifyAsset{"asset": {Key: key, Value: value}}
+	return c.do("PUT", "/themes/"+strconv.FormatInt(themeID, 10)+"/assets.json", body, nil)
+}
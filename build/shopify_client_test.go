@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShopifyBucket(t *testing.T) {
+	b := &shopifyBucket{size: shopifyBucketSize}
+	now := time.Now()
+	for i := 0; i < shopifyBucketSize; i++ {
+		if wait := b.take(now); wait != 0 {
+			t.Fatalf("call %d waited %s with room in the bucket", i+1, wait)
+		}
+	}
+	if wait := b.take(now); wait != 500*time.Millisecond {
+		t.Errorf("call over the limit waits %s, want 500ms", wait)
+	}
+
+	// A second later two calls have leaked out, one of them taken above.
+	now = now.Add(time.Second)
+	if wait := b.take(now); wait != 0 {
+		t.Errorf("call after leaking waited %s", wait)
+	}
+
+	// Shopify's count replaces the estimate, including a larger bucket.
+	b.observe("10/80", now)
+	for i := 0; i < 70; i++ {
+		if wait := b.take(now); wait != 0 {
+			t.Fatalf("call %d waited %s after Shopify reported room", i+11, wait)
+		}
+	}
+	if wait := b.take(now); wait == 0 {
+		t.Error("call over the reported size didn't wait")
+	}
+	b.observe("garbage", now)
+	if b.size != 80 {
+		t.Errorf("unreadable header changed the size to %v", b.size)
+	}
+}
+
+// shopifyClientTest serves each call with the next of statuses, or 200 once
+// they run out, and records the calls and waits the client makes.
+type shopifyClientTest struct {
+	statuses   []int
+	retryAfter string
+	paths      []string
+	waits      []time.Duration
+}
+
+func (st *shopifyClientTest) client(shop string) (*shopifyClient, func()) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st.paths = append(st.paths, r.Method+" "+r.URL.Path)
+		status := http.StatusOK
+		if n := len(st.paths); n <= len(st.statuses) {
+			status = st.statuses[n-1]
+		}
+		w.Header().Set("X-Shopify-Shop-Api-Call-Limit", "1/40")
+		if status == http.StatusTooManyRequests && st.retryAfter != "" {
+			w.Header().Set("Retry-After", st.retryAfter)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(`{"shop":{"currency":"USD"}}`))
+	}))
+	c := &shopifyClient{
+		Shop:    shop,
+		Token:   "test-token",
+		Version: shopifyAPIVersion,
+		BaseURL: ts.URL,
+		HTTP:    ts.Client(),
+		Sleep:   func(d time.Duration) { st.waits = append(st.waits, d) },
+	}
+	return c, ts.Close
+}
+
+func TestShopifyClientRetryAfter(t *testing.T) {
+	st := &shopifyClientTest{statuses: []int{429}, retryAfter: "2.0"}
+	c, stop := st.client("retry-after.myshopify.com")
+	defer stop()
+
+	if err := c.do("GET", "/shop.json", nil, nil); err != nil {
+		t.Fatalf("do: %s", err)
+	}
+	if len(st.paths) != 2 || st.paths[0] != "GET /admin/api/"+shopifyAPIVersion+"/shop.json" {
+		t.Errorf("calls = %v, want two to the pinned version", st.paths)
+	}
+	if len(st.waits) != 1 || st.waits[0] != 2*time.Second {
+		t.Errorf("waits = %v, want [2s]", st.waits)
+	}
+}
+
+func TestShopifyClientBackoff(t *testing.T) {
+	st := &shopifyClientTest{statuses: []int{503, 502, 500}}
+	c, stop := st.client("backoff.myshopify.com")
+	defer stop()
+
+	if err := c.do("GET", "/shop.json", nil, nil); err != nil {
+		t.Fatalf("do: %s", err)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	if len(st.waits) != len(want) {
+		t.Fatalf("waits = %v, want %v", st.waits, want)
+	}
+	for i := range want {
+		if st.waits[i] != want[i] {
+			t.Errorf("wait %d = %s, want %s", i+1, st.waits[i], want[i])
+		}
+	}
+}
+
+func TestShopifyClientGivesUp(t *testing.T) {
+	st := &shopifyClientTest{statuses: []int{503, 503, 503, 503, 503, 503}}
+	c, stop := st.client("gives-up.myshopify.com")
+	defer stop()
+
+	err := c.do("GET", "/shop.json", nil, nil)
+	if e, ok := err.(*shopifyError); !ok || e.Status != http.StatusServiceUnavailable {
+		t.Errorf("do = %v, want a 503", err)
+	}
+	if len(st.paths) != shopifyMaxRetries+1 {
+		t.Errorf("made %d calls, want %d", len(st.paths), shopifyMaxRetries+1)
+	}
+	if retryAfter("", 10) != shopifyMaxWait || retryAfter("3600", 0) != shopifyMaxWait {
+		t.Errorf("waits aren't capped at %s", shopifyMaxWait)
+	}
+}
+
+func TestShopifyClientPostRetries(t *testing.T) {
+	for _, status := range []int{500, 502, 503, 504} {
+		st := &shopifyClientTest{statuses: []int{status}}
+		c, stop := st.client("post-" + strconv.Itoa(status) + ".myshopify.com")
+		err := c.do("POST", "/orders.json", map[string]string{"order": "x"}, nil)
+		stop()
+		// The order may have been created, so trying again could make two.
+		if e, ok := err.(*shopifyError); !ok || e.Status != status {
+			t.Errorf("POST answered %d: err = %v", status, err)
+		}
+		if len(st.paths) != 1 {
+			t.Errorf("POST answered %d was made %d times", status, len(st.paths))
+		}
+	}
+
+	// A throttled call never reached Shopify, so it is safe to repeat.
+	st := &shopifyClientTest{statuses: []int{429}, retryAfter: "1"}
+	c, stop := st.client("post-429.myshopify.com")
+	defer stop()
+	if err := c.do("POST", "/orders.json", map[string]string{"order": "x"}, nil); err != nil {
+		t.Errorf("throttled POST: %s", err)
+	}
+	if len(st.paths) != 2 {
+		t.Errorf("throttled POST was made %d times, want 2", len(st.paths))
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	shopifyPlanTag      = "tixpire-plan"
+	shopifyPayInFullTag = "tixpire"
+)
+
+// shopifyClaimTTL is how long one request may spend syncing an order to
+// Shopify before another is allowed to try.
+const shopifyClaimTTL = 5 * time.Minute
+
+type shopifyLineItem struct {
+	VariantID int64  `json:"variant_id,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Price     string `json:"price,omitempty"`
+	Quantity  int    `json:"quantity"`
+}
+
+type shopifyTransaction struct {
+	ID            int64  `json:"id,omitempty"`
+	Kind          string `json:"kind"`
+	Status        string `json:"status"`
+	Amount        string `json:"amount"`
+	Currency      string `json:"currency,omitempty"`
+	Gateway       string `json:"gateway"`
+	Authorization string `json:"authorization,omitempty"`
+}
+
+type shopifyOrder struct {
+	ID                 int64                `json:"id,omitempty"`
+	Email              string               `json:"email,omitempty"`
+	Currency           string               `json:"currency,omitempty"`
+	FinancialStatus    string               `json:"financial_status,omitempty"`
+	Tags               string               `json:"tags,omitempty"`
+	Note               string               `json:"note,omitempty"`
+	LineItems          []shopifyLineItem    `json:"line_items,omitempty"`
+	Transactions       []shopifyTransaction `json:"transactions,omitempty"`
+	SendReceipt        bool                 `json:"send_receipt"`
+	InventoryBehaviour string               `json:"inventory_behaviour,omitempty"`
+}
+
+// shopifyShare is the part of the order total that installment i pays off in
+// Shopify. Plan fees and tax are collected by the payment provider on top of
+// the price, so only the price is split across installments.
+func (o *Order) shopifyShare(cur Currency, i int) float64 {
+	total, _ := strconv.ParseFloat(o.Total, 64)
+	n := len(o.Installments)
+	share := cur.round(total / float64(n))
+	if i == n-1 {
+		return cur.round(total - share*float64(n-1))
+	}
+	return share
+}
+
+func (o *Order) shopifyGateway() string {
+	if o.Provider == "stripe" {
+		return "Stripe"
+	}
+	return "PayPal"
+}
+
+// needsShopifySync reports whether the order or any of its payments has not
+// made it into Shopify yet.
+func (o *Order) needsShopifySync() bool {
+	if o.ShopifyOrderID == 0 {
+		return true
+	}
+	for _, inst := range o.Installments {
+		if inst.Status == installmentPaid && inst.ShopifyTransactionID == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Order) shopifyTransaction(cur Currency, i int) shopifyTransaction {
+	inst := o.Installments[i]
+	return shopifyTransaction{
+		Kind:          "sale",
+		Status:        "success",
+		Amount:        cur.value(o.shopifyShare(cur, i)),
+		Currency:      o.Currency,
+		Gateway:       o.shopifyGateway(),
+		Authorization: inst.TransactionID,
+	}
+}
+
+// newShopifyOrder builds the order to create in the merchant's store, with a
+// transaction for every installment already paid.
+func (o *Order) newShopifyOrder(cur Currency) (shopifyOrder, []int) {
+	item := shopifyLineItem{VariantID: o.VariantID, Quantity: o.Qty}
+	if item.Quantity == 0 {
+		item.Quantity = 1
+	}
+	if o.VariantID == 0 {
+		// Orders from before carts were looked up in Shopify only know the
+		// title and price.
+		item.Title = o.Event
+		if o.Variant != "" {
+			item.Title += " - " + o.Variant
+		}
+		total, _ := strconv.ParseFloat(o.Total, 64)
+		item.Price = cur.value(total / float64(item.Quantity))
+	}
+	so := shopifyOrder{
+		Email:              o.Email,
+		Currency:           o.Currency,
+		FinancialStatus:    "partially_paid",
+		Tags:               shopifyPlanTag,
+		Note:               "Tixpire payment plan " + o.AgreementID,
+		LineItems:          []shopifyLineItem{item},
+		SendReceipt:        false,
+		InventoryBehaviour: "decrement_obeying_policy",
+	}
+	if o.PayInFull {
+		so.Tags = shopifyPayInFullTag
+		so.Note = "Paid in full through Tixpire " + o.AgreementID
+	}
+	var posted []int
+	for i, inst := range o.Installments {
+		if inst.Status == installmentPaid {
+			so.Transactions = append(so.Transactions, o.shopifyTransaction(cur, i))
+			posted = append(posted, i)
+		}
+	}
+	if len(posted) == len(o.Installments) {
+		so.FinancialStatus = "paid"
+	}
+	return so, posted
+}
+
+// claimShopifyOrder marks the order as being synced to Shopify so that the
+// thank-you page and a webhook arriving at the same time don't both create the
+// order or post the same payment. Passing release clears the claim.
+func claimShopifyOrder(ctx context.Context, agreementID string, release bool) (bool, error) {
+	claimed := false
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		o, err := getOrder(tc, agreementID)
+		if err != nil {
+			return err
+		}
+		if release {
+			o.ShopifyClaimed = time.Time{}
+			return putOrder(tc, o)
+		}
+		if time.Since(o.ShopifyClaimed) < shopifyClaimTTL {
+			return nil
+		}
+		o.ShopifyClaimed = time.Now()
+		claimed = true
+		return putOrder(tc, o)
+	}, nil)
+	return claimed, err
+}
+
+// syncShopifyOrder creates the Shopify order for an approved plan if it
+// doesn't exist yet and posts any installments paid since. The order's
+// inventory hold is brought up to date first. It is safe to call as often as
+// needed.
+func syncShopifyOrder(ctx context.Context, agreementID string) error {
+	o, err := getOrder(ctx, agreementID)
+	if err != nil {
+		return err
+	}
+	tenant := Tenant{Shop: o.Shop}
+	// There's no token to write with once the shop uninstalls the app.
+	if _, err := tenant.token(ctx); err == errShopNotFound {
+		log.Debugf(ctx, "Not syncing %s, %s has uninstalled the app", agreementID, o.Shop)
+		return nil
+	}
+	if err := syncInventoryHold(ctx, agreementID); err != nil {
+		log.Errorf(ctx, "Sync Inventory Hold Error: %s", err)
+	}
+	if !o.needsShopifySync() || len(o.Installments) == 0 {
+		return nil
+	}
+	cur, err := lookupCurrency(o.Currency)
+	if err != nil {
+		return err
+	}
+	claimed, err := claimShopifyOrder(ctx, agreementID, false)
+	if err != nil || !claimed {
+		return err
+	}
+	defer claimShopifyOrder(ctx, agreementID, true)
+	// Reload now that the order is ours, in case another sync just finished.
+	if o, err = getOrder(ctx, agreementID); err != nil {
+		return err
+	}
+
+	if o.ShopifyOrderID == 0 {
+		so, posted := o.newShopifyOrder(cur)
+		if _, _, err := inventoryHoldForOrder(ctx, agreementID); err == nil {
+			// The stock was already taken when the hold was placed.
+			so.InventoryBehaviour = "bypass"
+		}
+		var resp struct {
+			Order struct {
+				ID           int64                `json:"id"`
+				Transactions []shopifyTransaction `json:"transactions"`
+			} `json:"order"`
+		}
+		if err := tenant.shopifyRequest(ctx, "POST", "/orders.json", map[string]interface{}{"order": so}, &resp); err != nil {
+			return err
+		}
+		ids := map[string]int64{}
+		for _, i := range posted {
+			// The order was created with these payments, so they must never
+			// be posted again even if Shopify doesn't echo them back.
+			ids[o.Installments[i].TransactionID] = -1
+		}
+		for _, t := range resp.Order.Transactions {
+			if _, ok := ids[t.Authorization]; ok && t.ID != 0 {
+				ids[t.Authorization] = t.ID
+			}
+		}
+		if o, err = markShopifyOrder(ctx, agreementID, resp.Order.ID, ids); err != nil {
+			return err
+		}
+		log.Infof(ctx, "Created Shopify order %d for %s", o.ShopifyOrderID, agreementID)
+	}
+
+	for i, inst := range o.Installments {
+		if inst.Status != installmentPaid || inst.ShopifyTransactionID != 0 {
+			continue
+		}
+		var resp struct {
+			Transaction shopifyTransaction `json:"transaction"`
+		}
+		path := "/orders/" + strconv.FormatInt(o.ShopifyOrderID, 10) + "/transactions.json"
+		// Each installment is its own sale. A capture would need the
+		// authorization it settles as parent_id, and there is none.
+		t := o.shopifyTransaction(cur, i)
+		if err := tenant.shopifyRequest(ctx, "POST", path, map[string]interface{}{"transaction": t}, &resp); err != nil {
+			return err
+		}
+		id := resp.Transaction.ID
+		if id == 0 {
+			id = -1
+		}
+		// Save after every transaction so a failure part way through doesn't
+		// post the earlier ones twice.
+		if _, err := markShopifyOrder(ctx, agreementID, o.ShopifyOrderID, map[string]int64{inst.TransactionID: id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markShopifyOrder records the Shopify order ID and the Shopify transactions
+// posted for the given payment transaction IDs. It reloads the order inside a
+// transaction so payments recorded by a webhook in the meantime are kept.
+func markShopifyOrder(ctx context.Context, agreementID string, shopifyOrderID int64, transactions map[string]int64) (*Order, error) {
+	var o *Order
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		var err error
+		if o, err = getOrder(tc, agreementID); err != nil {
+			return err
+		}
+		o.ShopifyOrderID = shopifyOrderID
+		for i := range o.Installments {
+			if id, ok := transactions[o.Installments[i].TransactionID]; ok {
+				o.Installments[i].ShopifyTransactionID = id
+			}
+		}
+		return putOrder(tc, o)
+	}, nil)
+	return o, err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+)
+
+func TestSyncShopifyOrder(t *testing.T) {
+	shop, stop := useShopifyFake("sync.myshopify.com")
+	defer stop()
+	inst, done := newTestInstance(t)
+	defer done()
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+
+	o := putTestOrder(t, inst, "sync.myshopify.com", "I-SYNC")
+	o.Total = "93.75"
+	o.recordPayment("PAY-0", "", time.Now())
+	if err := putOrder(ctx, o); err != nil {
+		t.Fatalf("putOrder: %s", err)
+	}
+
+	if err := syncShopifyOrder(ctx, "I-SYNC"); err != nil {
+		t.Fatalf("syncShopifyOrder: %s", err)
+	}
+	if len(shop.Orders) != 1 {
+		t.Fatalf("Shopify got %d orders, want 1", len(shop.Orders))
+	}
+	so := shop.Orders[0]
+	if so.FinancialStatus != "partially_paid" || len(so.Transactions) != 1 || so.Transactions[0].Amount != "31.25" {
+		t.Errorf("Shopify order = %+v, want partially paid with one 31.25 payment", so)
+	}
+
+	// The next installment is posted to the order as a sale of its own.
+	o = loadTestOrder(t, inst, "I-SYNC")
+	o.recordPayment("PAY-1", "", time.Now())
+	if err := putOrder(ctx, o); err != nil {
+		t.Fatalf("putOrder: %s", err)
+	}
+	if err := syncShopifyOrder(ctx, "I-SYNC"); err != nil {
+		t.Fatalf("second syncShopifyOrder: %s", err)
+	}
+	if len(shop.Transactions) != 1 {
+		t.Fatalf("Shopify got %d transactions, want 1", len(shop.Transactions))
+	}
+	if txn := shop.Transactions[0]; txn.Kind != "sale" || txn.Status != "success" || txn.Authorization != "PAY-1" || txn.Amount != "31.25" {
+		t.Errorf("transaction = %+v, want a successful 31.25 sale for PAY-1", txn)
+	}
+
+	// Syncing again posts nothing twice.
+	if err := syncShopifyOrder(ctx, "I-SYNC"); err != nil {
+		t.Fatalf("third syncShopifyOrder: %s", err)
+	}
+	if len(shop.Orders) != 1 || len(shop.Transactions) != 1 {
+		t.Errorf("resync made %d orders and %d transactions", len(shop.Orders), len(shop.Transactions))
+	}
+}
+
+func TestReconcileRetriesShopifySync(t *testing.T) {
+	_, stopPayPal := usePayPalFake()
+	defer stopPayPal()
+	shop, stop := useShopifyFake("sync.myshopify.com")
+	defer stop()
+	inst, done := newTestInstance(t)
+	defer done()
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+
+	// A plan paid off in full whose Shopify order couldn't be created.
+	o := putTestOrder(t, inst, "sync.myshopify.com", "I-PAIDOFF")
+	o.Total = "93.75"
+	for _, id := range []string{"PAY-0", "PAY-1", "PAY-2"} {
+		o.recordPayment(id, "", time.Now())
+	}
+	if err := putOrder(ctx, o); err != nil {
+		t.Fatalf("putOrder: %s", err)
+	}
+	shop.FailOrders = true
+	if err := syncShopifyOrder(ctx, "I-PAIDOFF"); err == nil {
+		t.Fatal("syncShopifyOrder succeeded with Shopify down")
+	}
+	if o := loadTestOrder(t, inst, "I-PAIDOFF"); o.Status != orderCompleted || !o.ShopifyPending {
+		t.Fatalf("order = %s, pending %v; want completed and pending", o.Status, o.ShopifyPending)
+	}
+
+	shop.FailOrders = false
+	req := newTestRequest(t, inst, "GET", "/tasks/reconcile", nil)
+	req.Header.Set("X-Appengine-Cron", "true")
+	w := httptest.NewRecorder()
+	serveReconcile(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("reconcile returned %d: %s", w.Code, w.Body)
+	}
+	if len(shop.Orders) != 1 || shop.Orders[0].FinancialStatus != "paid" {
+		t.Errorf("Shopify orders = %+v, want one paid", shop.Orders)
+	}
+	if o := loadTestOrder(t, inst, "I-PAIDOFF"); o.ShopifyPending || o.ShopifyOrderID == 0 {
+		t.Errorf("order after reconcile: pending %v, Shopify order %d", o.ShopifyPending, o.ShopifyOrderID)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/logpacker/PayPal-Go-SDK"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// shopifyWebhookPath receives every webhook topic the app subscribes to. The
+// app/uninstalled subscription is made on install; the GDPR topics are set up
+// in the Partner Dashboard and point here too.
+const shopifyWebhookPath = "/webhooks/shopify"
+
+// shopifyWebhookPayload holds the fields of the GDPR webhooks the app uses.
+type shopifyWebhookPayload struct {
+	ShopDomain string `json:"shop_domain"`
+	// MyshopifyDomain is set instead on app/uninstalled, whose payload is
+	// the shop itself.
+	MyshopifyDomain string `json:"myshopify_domain"`
+	Customer        struct {
+		ID    int64  `json:"id"`
+		Email string `json:"email"`
+	} `json:"customer"`
+	OrdersRequested []int64 `json:"orders_requested"`
+	OrdersToRedact  []int64 `json:"orders_to_redact"`
+	DataRequest     struct {
+		ID int64 `json:"id"`
+	} `json:"data_request"`
+}
+
+// CustomerDataRequest is an export of what we hold on a buyer, made when the
+// merchant asks for it through Shopify. It is keyed by the shop and Shopify's
+// request ID and shown to the merchant in the admin.
+type CustomerDataRequest struct {
+	Shop    string
+	Email   string
+	Data    []byte `datastore:",noindex"`
+	Created time.Time
+}
+
+// customerData is what a CustomerDataRequest exports.
+type customerData struct {
+	Email     string            `json:"email"`
+	Orders    []Order           `json:"orders"`
+	Checkouts []CheckoutSession `json:"checkouts"`
+}
+
+// verifyShopifyWebhook reports whether signature, the base64
+// X-Shopify-Hmac-Sha256 header, is the HMAC of body under secret.
+func verifyShopifyWebhook(body []byte, signature string, secret string) bool {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// registerShopifyWebhooks subscribes the app to the webhooks it handles for
+// the tenant. Reinstalls find the subscription already there, which is fine.
+func registerShopifyWebhooks(ctx context.Context, t Tenant) {
+	body := map[string]interface{}{
+		"webhook": map[string]string{
+			"topic":   "app/uninstalled",
+			"address": appURL + shopifyWebhookPath,
+			"format":  "json",
+		},
+	}
+	if err := t.shopifyRequest(ctx, "POST", "/webhooks.json", body, nil); err != nil {
+		log.Warningf(ctx, "Register Webhooks Error: %s", err)
+	}
+}
+
+func shopifyWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Could not read body", http.StatusBadRequest)
+		return
+	}
+	if !verifyShopifyWebhook(body, r.Header.Get("X-Shopify-Hmac-Sha256"), app.APISecret) {
+		log.Warningf(ctx, "Invalid webhook signature from Shopify")
+		http.Error(w, "Invalid signature", 401)
+		return
+	}
+	topic := r.Header.Get("X-Shopify-Topic")
+	shop := r.Header.Get("X-Shopify-Shop-Domain")
+	if !validShopDomain(shop) {
+		http.Error(w, "Invalid shop", http.StatusBadRequest)
+		return
+	}
+	var payload shopifyWebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+	// Only the body is signed, so when it names the shop the header must
+	// agree, or a body replayed under another shop's header would act on that
+	// shop's data.
+	tenant := Tenant{Shop: shop}
+	for _, named := range []string{payload.ShopDomain, payload.MyshopifyDomain} {
+		if named == "" {
+			continue
+		}
+		if err := tenant.owns(named); err != nil {
+			log.Warningf(ctx, "Shopify webhook for %s names %s", shop, named)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	log.Debugf(ctx, "Shopify webhook %s for %s", topic, shop)
+
+	// Each of these is safe to repeat, so redeliveries need no bookkeeping.
+	switch topic {
+	case "app/uninstalled":
+		err = uninstallShop(ctx, tenant)
+	case "customers/data_request":
+		err = exportCustomerData(ctx, tenant, &payload)
+	case "customers/redact":
+		err = redactCustomer(ctx, tenant, &payload)
+	case "shop/redact":
+		err = redactShop(ctx, tenant)
+	default:
+		log.Debugf(ctx, "Ignoring Shopify webhook topic %s", topic)
+	}
+	if err != nil {
+		log.Errorf(ctx, "Handle Shopify Webhook %s Error: %s", topic, err)
+		// Shopify redelivers on non-2xx responses.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// uninstallShop forgets the tenant's access token, which Shopify has revoked.
+// Its plans keep charging through PayPal, but stop syncing to the store.
+func uninstallShop(ctx context.Context, t Tenant) error {
+	if err := shops.Delete(ctx, t.Shop); err != nil {
+		return err
+	}
+	log.Infof(ctx, "%s uninstalled the app", t.Shop)
+	return nil
+}
+
+// customerOrders returns the keys and orders the tenant holds for a buyer,
+// found by email and by the Shopify orders named in the webhook.
+func customerOrders(ctx context.Context, t Tenant, email string, shopifyIDs []int64) ([]*datastore.Key, []Order, error) {
+	var keys []*datastore.Key
+	var orders []Order
+	seen := map[string]bool{}
+	add := func(q *datastore.Query) error {
+		var found []Order
+		k, err := q.GetAll(ctx, &found)
+		if err != nil {
+			return err
+		}
+		for i := range k {
+			if seen[k[i].StringID()] {
+				continue
+			}
+			seen[k[i].StringID()] = true
+			keys = append(keys, k[i])
+			orders = append(orders, found[i])
+		}
+		return nil
+	}
+	if email != "" {
+		if err := add(t.query("Order").Filter("Email =", email)); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, id := range shopifyIDs {
+		if err := add(t.query("Order").Filter("ShopifyOrderID =", id)); err != nil {
+			return nil, nil, err
+		}
+	}
+	return keys, orders, nil
+}
+
+func customerCheckouts(ctx context.Context, t Tenant, email string) ([]*datastore.Key, []CheckoutSession, error) {
+	var sessions []CheckoutSession
+	if email == "" {
+		return nil, nil, nil
+	}
+	keys, err := t.query("CheckoutSession").Filter("Email =", email).GetAll(ctx, &sessions)
+	return keys, sessions, err
+}
+
+// exportCustomerData stores everything the tenant holds on the buyer in the
+// webhook for the merchant to download from the admin.
+func exportCustomerData(ctx context.Context, t Tenant, payload *shopifyWebhookPayload) error {
+	email := payload.Customer.Email
+	_, orders, err := customerOrders(ctx, t, email, payload.OrdersRequested)
+	if err != nil {
+		return err
+	}
+	_, checkouts, err := customerCheckouts(ctx, t, email)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(customerData{Email: email, Orders: orders, Checkouts: checkouts})
+	if err != nil {
+		return err
+	}
+	req := CustomerDataRequest{
+		Shop:    t.Shop,
+		Email:   email,
+		Data:    data,
+		Created: time.Now(),
+	}
+	key := datastore.NewKey(ctx, "CustomerDataRequest", t.Shop+":"+strconv.FormatInt(payload.DataRequest.ID, 10), 0, nil)
+	_, err = datastore.Put(ctx, key, &req)
+	return err
+}
+
+// redactCustomer erases a buyer's details from the tenant's orders and deletes their
+// checkouts, the provider events for their orders and any export made of them. Orders themselves are kept, as the
+// payments on them still have to be accounted for.
+func redactCustomer(ctx context.Context, t Tenant, payload *shopifyWebhookPayload) error {
+	email := payload.Customer.Email
+	keys, orders, err := customerOrders(ctx, t, email, payload.OrdersToRedact)
+	if err != nil {
+		return err
+	}
+	for i := range orders {
+		orders[i].Email = ""
+		orders[i].CancelReason = ""
+		orders[i].Updated = time.Now()
+	}
+	if err := putAll(ctx, keys, orders); err != nil {
+		return err
+	}
+	checkoutKeys, _, err := customerCheckouts(ctx, t, email)
+	if err != nil {
+		return err
+	}
+	if err := deleteAll(ctx, checkoutKeys); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		events, err := t.query("WebhookEvent").Filter("OrderID =", key.StringID()).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := deleteAll(ctx, events); err != nil {
+			return err
+		}
+	}
+	if email == "" {
+		return nil
+	}
+	exports, err := t.query("CustomerDataRequest").Filter("Email =", email).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	return deleteAll(ctx, exports)
+}
+
+// redactShop deletes everything held for the tenant, which Shopify asks for two
+// days after it uninstalls the app. Plans still running are cancelled first
+// so no buyer goes on paying for an order nobody has a record of. A plan that
+// can't be cancelled doesn't stop the rest being erased; it is logged for
+// someone to cancel by hand.
+func redactShop(ctx context.Context, t Tenant) error {
+	var orders []Order
+	orderKeys, err := t.query("Order").GetAll(ctx, &orders)
+	if err != nil {
+		return err
+	}
+	var c *paypalsdk.Client
+	for i := range orders {
+		o := &orders[i]
+		if o.PayInFull || (o.Status != orderActive && o.Status != orderSuspended) {
+			continue
+		}
+		if c == nil {
+			if c, err = newPayPalClient(ctx); err != nil {
+				return err
+			}
+		}
+		if err := cancelPayPalOrder(c, o, "The store has closed its account."); err != nil && !payPalOrderEnded(c, o) {
+			log.Errorf(ctx, "Cancel Subscription %s for Redacted Shop %s Error: %s", o.AgreementID, t.Shop, err)
+		}
+	}
+	if err := deleteAll(ctx, orderKeys); err != nil {
+		return err
+	}
+
+	for _, kind := range []string{"CheckoutSession", "InventoryHold", "Discrepancy", "ReconciliationReport", "OAuthState", "CustomerDataRequest", "PayPalProduct", "PayPalPlan", "WebhookEvent", "AdminSession", "Slug"} {
+		keys, err := t.query(kind).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := deleteAll(ctx, keys); err != nil {
+			return err
+		}
+	}
+	for _, key := range []*datastore.Key{shopSecretKey(ctx, t.Shop), vendorConfigKey(ctx, t.Shop)} {
+		if err := datastore.Delete(ctx, key); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+	if err := shops.Delete(ctx, t.Shop); err != nil {
+		return err
+	}
+	log.Infof(ctx, "Erased %s and %d orders", t.Shop, len(orderKeys))
+	return nil
+}
+
+// payPalOrderEnded reports whether PayPal already has o's subscription or
+// agreement as cancelled or expired, which is why cancelling it again fails.
+func payPalOrderEnded(c *paypalsdk.Client, o *Order) bool {
+	status, err := payPalOrderStatus(c, o)
+	return err == nil && (status == "CANCELLED" || status == "EXPIRED")
+}
+
+// putAll and deleteAll work through keys in batches of 500, the most one
+// datastore call takes.
+func putAll(ctx context.Context, keys []*datastore.Key, orders []Order) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 500 {
+			n = 500
+		}
+		if _, err := datastore.PutMulti(ctx, keys[:n], orders[:n]); err != nil {
+			return err
+		}
+		keys, orders = keys[n:], orders[n:]
+	}
+	return nil
+}
+
+func deleteAll(ctx context.Context, keys []*datastore.Key) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 500 {
+			n = 500
+		}
+		if err := datastore.DeleteMulti(ctx, keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// dataRequestRow is a CustomerDataRequest as listed in the admin.
+type dataRequestRow struct {
+	ID      string
+	Email   string
+	Created time.Time
+}
+
+// customerDataRequests lists the tenant's latest data requests, newest first.
+func customerDataRequests(ctx context.Context, t Tenant) ([]dataRequestRow, error) {
+	var reqs []CustomerDataRequest
+	keys, err := t.query("CustomerDataRequest").Order("-Created").Limit(50).GetAll(ctx, &reqs)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]dataRequestRow, len(reqs))
+	for i := range reqs {
+		rows[i] = dataRequestRow{
+			ID:      strings.TrimPrefix(keys[i].StringID(), t.Shop+":"),
+			Email:   reqs[i].Email,
+			Created: reqs[i].Created,
+		}
+	}
+	return rows, nil
+}
+
+// serveDataRequest downloads one of the logged in shop's data exports.
+func serveDataRequest(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	id := r.URL.Path[len("/admin/data-requests/"):]
+	req, err := currentShop(r).tenant().dataRequest(ctx, id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="data-request-`+id+`.json"`)
+	w.Write(req.Data)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+
+	"tixpire/paypalfake"
+)
+
+// The fixtures in testdata/shopify are deliveries for this shop.
+const (
+	fixtureShop  = "tickets.myshopify.com"
+	fixtureBuyer = "buyer@example.com"
+)
+
+// fixtureEvent is the ID of the event in testdata/paypal/payment_sale_completed.json.
+const fixtureEvent = "WH-2WR32451HC0233532-67976317FL4543714"
+
+func webhookEventKey(ctx context.Context, id string) *datastore.Key {
+	return datastore.NewKey(ctx, "WebhookEvent", id, 0, nil)
+}
+
+func signShopifyWebhook(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(app.APISecret))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func postShopifyWebhook(t *testing.T, inst aetest.Instance, topic string, shop string, body []byte, signature string) int {
+	req := newTestRequest(t, inst, "POST", shopifyWebhookPath, bytes.NewReader(body))
+	req.Header.Set("X-Shopify-Topic", topic)
+	req.Header.Set("X-Shopify-Shop-Domain", shop)
+	req.Header.Set("X-Shopify-Hmac-Sha256", signature)
+	w := httptest.NewRecorder()
+	shopifyWebhook(w, req)
+	return w.Code
+}
+
+// putBuyerOrder stores an order placed with shop by email.
+func putBuyerOrder(t *testing.T, inst aetest.Instance, shop string, id string, email string, shopifyOrderID int64) *Order {
+	o := putTestOrder(t, inst, shop, id)
+	o.Email = email
+	o.ShopifyOrderID = shopifyOrderID
+	o.CancelReason = "Can't make it"
+	if err := putOrder(appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil)), o); err != nil {
+		t.Fatalf("putOrder: %s", err)
+	}
+	return o
+}
+
+func TestShopifyWebhookSignature(t *testing.T) {
+	inst, done := newTestInstance(t)
+	defer done()
+	body := fixture(t, "shopify/shop_redact.json")
+
+	if code := postShopifyWebhook(t, inst, "shop/redact", fixtureShop, body, ""); code != http.StatusUnauthorized {
+		t.Errorf("unsigned webhook returned %d, want %d", code, http.StatusUnauthorized)
+	}
+	tampered := bytes.Replace(body, []byte("548380009"), []byte("548380010"), 1)
+	if code := postShopifyWebhook(t, inst, "shop/redact", fixtureShop, tampered, signShopifyWebhook(body)); code != http.StatusUnauthorized {
+		t.Errorf("tampered webhook returned %d, want %d", code, http.StatusUnauthorized)
+	}
+	// The body names the shop, so it can't be replayed against another.
+	if code := postShopifyWebhook(t, inst, "shop/redact", "other.myshopify.com", body, signShopifyWebhook(body)); code != http.StatusForbidden {
+		t.Errorf("webhook replayed for another shop returned %d, want %d", code, http.StatusForbidden)
+	}
+}
+
+func TestShopifyWebhookUninstalled(t *testing.T) {
+	inst, done := newTestInstance(t)
+	defer done()
+	shops.Put(context.Background(), &ShopRecord{Domain: fixtureShop, Token: "test-token"})
+	defer shops.Delete(context.Background(), fixtureShop)
+
+	body := fixture(t, "shopify/app_uninstalled.json")
+	if code := postShopifyWebhook(t, inst, "app/uninstalled", fixtureShop, body, signShopifyWebhook(body)); code != http.StatusOK {
+		t.Fatalf("webhook returned %d", code)
+	}
+	if _, err := shops.Get(context.Background(), fixtureShop); err != errShopNotFound {
+		t.Errorf("shop after uninstall: %v, want %v", err, errShopNotFound)
+	}
+	if code := postShopifyWebhook(t, inst, "app/uninstalled", fixtureShop, body, signShopifyWebhook(body)); code != http.StatusOK {
+		t.Errorf("redelivery returned %d", code)
+	}
+}
+
+func TestShopifyWebhookDataRequest(t *testing.T) {
+	inst, done := newTestInstance(t)
+	defer done()
+	putBuyerOrder(t, inst, fixtureShop, "I-BYEMAIL", fixtureBuyer, 0)
+	putBuyerOrder(t, inst, fixtureShop, "I-BYORDER", "", 450789469)
+	putBuyerOrder(t, inst, "other.myshopify.com", "I-OTHERSHOP", fixtureBuyer, 450789470)
+
+	body := fixture(t, "shopify/customers_data_request.json")
+	if code := postShopifyWebhook(t, inst, "customers/data_request", fixtureShop, body, signShopifyWebhook(body)); code != http.StatusOK {
+		t.Fatalf("webhook returned %d", code)
+	}
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+	req, err := Tenant{Shop: fixtureShop}.dataRequest(ctx, "9999")
+	if err != nil {
+		t.Fatalf("dataRequest: %s", err)
+	}
+	var data customerData
+	if err := json.Unmarshal(req.Data, &data); err != nil {
+		t.Fatalf("export: %s", err)
+	}
+	var ids []string
+	for _, o := range data.Orders {
+		ids = append(ids, o.AgreementID)
+	}
+	if len(ids) != 2 || ids[0] != "I-BYEMAIL" || ids[1] != "I-BYORDER" {
+		t.Errorf("exported orders %v, want I-BYEMAIL and I-BYORDER", ids)
+	}
+	if _, err := (Tenant{Shop: "other.myshopify.com"}).dataRequest(ctx, "9999"); err != datastore.ErrNoSuchEntity {
+		t.Errorf("another shop found the export: %v", err)
+	}
+}
+
+func TestShopifyWebhookCustomerRedact(t *testing.T) {
+	_, stop := usePayPalFake()
+	defer stop()
+	inst, done := newTestInstance(t)
+	defer done()
+	putBuyerOrder(t, inst, fixtureShop, "I-BYEMAIL", fixtureBuyer, 0)
+	putBuyerOrder(t, inst, fixtureShop, fixtureSubscription, fixtureBuyer, 0)
+	if code := postPayPalWebhook(t, inst, fixture(t, "paypal/payment_sale_completed.json")); code != http.StatusOK {
+		t.Fatalf("PayPal webhook returned %d", code)
+	}
+	putBuyerOrder(t, inst, fixtureShop, "I-BYORDER", "", 450789470)
+	putBuyerOrder(t, inst, "other.myshopify.com", "I-OTHERSHOP", fixtureBuyer, 450789470)
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+	for id, shop := range map[string]string{"session": fixtureShop, "other-session": "other.myshopify.com"} {
+		if err := putCheckoutSession(ctx, id, &CheckoutSession{Shop: shop, Email: fixtureBuyer}); err != nil {
+			t.Fatalf("putCheckoutSession: %s", err)
+		}
+	}
+
+	body := fixture(t, "shopify/customers_redact.json")
+	if code := postShopifyWebhook(t, inst, "customers/redact", fixtureShop, body, signShopifyWebhook(body)); code != http.StatusOK {
+		t.Fatalf("webhook returned %d", code)
+	}
+	for _, id := range []string{"I-BYEMAIL", "I-BYORDER"} {
+		if o := loadTestOrder(t, inst, id); o.Email != "" || o.CancelReason != "" {
+			t.Errorf("%s kept %q, %q", id, o.Email, o.CancelReason)
+		}
+	}
+	if _, err := getCheckoutSession(ctx, "session"); err != datastore.ErrNoSuchEntity {
+		t.Errorf("checkout kept: %v", err)
+	}
+	if err := datastore.Get(ctx, webhookEventKey(ctx, fixtureEvent), &WebhookEvent{}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("PayPal event kept: %v", err)
+	}
+	if o := loadTestOrder(t, inst, "I-OTHERSHOP"); o.Email != fixtureBuyer {
+		t.Errorf("another shop's order was redacted")
+	}
+	if _, err := getCheckoutSession(ctx, "other-session"); err != nil {
+		t.Errorf("another shop's checkout: %v", err)
+	}
+}
+
+func TestShopifyWebhookShopRedact(t *testing.T) {
+	fake, stop := usePayPalFake()
+	defer stop()
+	inst, done := newTestInstance(t)
+	defer done()
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+	shops.Put(context.Background(), &ShopRecord{Domain: fixtureShop, Token: "test-token"})
+	defer shops.Delete(context.Background(), fixtureShop)
+
+	// One plan is running, one PayPal has already cancelled, and one PayPal
+	// won't cancel. None of them stop the shop being erased.
+	fake.Subscriptions["I-RUNNING"] = &paypalfake.Subscription{ID: "I-RUNNING", Status: "ACTIVE"}
+	fake.Subscriptions["I-ENDED"] = &paypalfake.Subscription{ID: "I-ENDED", Status: "CANCELLED"}
+	for _, id := range []string{"I-RUNNING", "I-ENDED", "I-UNKNOWN", fixtureSubscription} {
+		putTestOrder(t, inst, fixtureShop, id)
+	}
+	if code := postPayPalWebhook(t, inst, fixture(t, "paypal/payment_sale_completed.json")); code != http.StatusOK {
+		t.Fatalf("PayPal webhook returned %d", code)
+	}
+	planKey := datastore.NewKey(ctx, "PayPalPlan", "P-TICKETS", 0, nil)
+	if _, err := datastore.Put(ctx, planKey, &PayPalPlan{Shop: fixtureShop}); err != nil {
+		t.Fatalf("Put PayPalPlan: %s", err)
+	}
+	admin := &Session{ID: "admin", Values: map[string]string{"current_shop": fixtureShop}, Expires: time.Now().Add(time.Hour)}
+	if err := (datastoreSessionData{}).put(ctx, admin); err != nil {
+		t.Fatalf("put session: %s", err)
+	}
+	putTestOrder(t, inst, "other.myshopify.com", "I-OTHERSHOP")
+	c := defaultVendorConfig(fixtureShop)
+	c.Slug = "tickets-co"
+	if err := putVendorConfig(ctx, fixtureShop, c); err != nil {
+		t.Fatalf("putVendorConfig: %s", err)
+	}
+	if _, err := signingShopSecret(ctx, fixtureShop); err != nil {
+		t.Fatalf("signingShopSecret: %s", err)
+	}
+
+	body := fixture(t, "shopify/shop_redact.json")
+	if code := postShopifyWebhook(t, inst, "shop/redact", fixtureShop, body, signShopifyWebhook(body)); code != http.StatusOK {
+		t.Fatalf("webhook returned %d", code)
+	}
+	if got := fake.Subscriptions["I-RUNNING"].Status; got != "CANCELLED" {
+		t.Errorf("running subscription = %s, want CANCELLED", got)
+	}
+	if n, _ := datastore.NewQuery("Order").Filter("Shop =", fixtureShop).Count(ctx); n != 0 {
+		t.Errorf("%d orders kept", n)
+	}
+	if err := datastore.Get(ctx, vendorConfigKey(ctx, fixtureShop), &VendorConfig{}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("vendor config kept: %v", err)
+	}
+	if err := datastore.Get(ctx, slugKey(ctx, "tickets-co"), &Slug{}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("slug kept: %v", err)
+	}
+	if err := datastore.Get(ctx, shopSecretKey(ctx, fixtureShop), &ShopSecret{}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("shop secret kept: %v", err)
+	}
+	if _, err := shops.Get(ctx, fixtureShop); err != errShopNotFound {
+		t.Errorf("shop kept: %v", err)
+	}
+	if err := datastore.Get(ctx, webhookEventKey(ctx, fixtureEvent), &WebhookEvent{}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("PayPal event kept: %v", err)
+	}
+	if err := datastore.Get(ctx, planKey, &PayPalPlan{}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("PayPal plan kept: %v", err)
+	}
+	if _, err := (datastoreSessionData{}).get(ctx, "admin"); err != errSessionNotFound {
+		t.Errorf("admin session kept: %v", err)
+	}
+	loadTestOrder(t, inst, "I-OTHERSHOP")
+
+	if code := postShopifyWebhook(t, inst, "shop/redact", fixtureShop, body, signShopifyWebhook(body)); code != http.StatusOK {
+		t.Errorf("redelivery returned %d", code)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeVariant is a variant as the Admin API returns it, with its stock
+// settings.
+type fakeVariant struct {
+	ID                  int64  `json:"id"`
+	ProductID           int64  `json:"product_id"`
+	Title               string `json:"title"`
+	Price               string `json:"price"`
+	InventoryItemID     int64  `json:"inventory_item_id"`
+	InventoryManagement string `json:"inventory_management"`
+	InventoryPolicy     string `json:"inventory_policy"`
+}
+
+// fakeShopify is an in-memory stand-in for the parts of a shop's Admin API
+// the app calls. It starts with one event ticket in stock: product 100,
+// variant 200, at 62.50 USD.
+type fakeShopify struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	nextID      int64
+	Currency    string
+	Products    map[int64]shopifyProduct
+	Variants    map[int64]*fakeVariant
+	EventDates  map[int64]string
+	Levels      []shopifyInventoryLevel
+	Adjustments []int
+	// SoldElsewhere is taken off the stock just before the next adjustment,
+	// as if another sale landed between reading the level and adjusting it.
+	SoldElsewhere int
+	// FailOrders makes creating an order answer with a server error.
+	FailOrders   bool
+	Orders       []shopifyOrder
+	Transactions []shopifyTransaction
+	Calls        []string
+}
+
+var fakeShopifyPath = regexp.MustCompile(`^/admin/api/[^/]+`)
+
+func newFakeShopify() *fakeShopify {
+	f := &fakeShopify{
+		nextID:     1000,
+		Currency:   "USD",
+		Products:   map[int64]shopifyProduct{100: {ID: 100, Title: "Event", Vendor: "vendor"}},
+		Variants:   map[int64]*fakeVariant{200: {ID: 200, ProductID: 100, Title: "General", Price: "62.50", InventoryItemID: 300, InventoryManagement: "shopify", InventoryPolicy: "deny"}},
+		EventDates: map[int64]string{100: time.Now().AddDate(0, 0, 90).Format("2006-01-02")},
+		Levels:     []shopifyInventoryLevel{{InventoryItemID: 300, LocationID: 400, Available: 10}},
+	}
+	f.Server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeShopify) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := fakeShopifyPath.ReplaceAllString(r.URL.Path, "")
+	f.Calls = append(f.Calls, r.Method+" "+path)
+	parts := strings.Split(strings.TrimSuffix(strings.Trim(path, "/"), ".json"), "/")
+	id := func(i int) int64 {
+		n, _ := strconv.ParseInt(parts[i], 10, 64)
+		return n
+	}
+	reply := func(v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+
+	switch {
+	case r.Method == "GET" && parts[0] == "shop":
+		reply(map[string]interface{}{"shop": map[string]string{"currency": f.Currency}})
+	case r.Method == "GET" && parts[0] == "variants" && len(parts) == 2:
+		v, ok := f.Variants[id(1)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		reply(map[string]interface{}{"variant": v})
+	case r.Method == "GET" && parts[0] == "products" && len(parts) == 2:
+		p, ok := f.Products[id(1)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		reply(map[string]interface{}{"product": p})
+	case r.Method == "GET" && parts[0] == "products" && len(parts) == 3 && parts[2] == "metafields":
+		var fields []shopifyMetafield
+		if date, ok := f.EventDates[id(1)]; ok {
+			fields = append(fields, shopifyMetafield{Namespace: eventDateNamespace, Key: eventDateKey, Value: date})
+		}
+		reply(map[string]interface{}{"metafields": fields})
+	case r.Method == "GET" && parts[0] == "inventory_levels":
+		reply(map[string]interface{}{"inventory_levels": f.Levels})
+	case r.Method == "POST" && path == "/inventory_levels/adjust.json":
+		var req struct {
+			ItemID     int64 `json:"inventory_item_id"`
+			LocationID int64 `json:"location_id"`
+			By         int   `json:"available_adjustment"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		for i := range f.Levels {
+			if f.Levels[i].InventoryItemID == req.ItemID && f.Levels[i].LocationID == req.LocationID {
+				f.Levels[i].Available -= f.SoldElsewhere
+				f.SoldElsewhere = 0
+				f.Levels[i].Available += req.By
+				f.Adjustments = append(f.Adjustments, req.By)
+				reply(map[string]interface{}{"inventory_level": f.Levels[i]})
+				return
+			}
+		}
+		http.NotFound(w, r)
+	case r.Method == "POST" && path == "/orders.json" && f.FailOrders:
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	case r.Method == "POST" && path == "/orders.json":
+		var req struct {
+			Order shopifyOrder `json:"order"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.nextID++
+		req.Order.ID = f.nextID
+		for i := range req.Order.Transactions {
+			f.nextID++
+			req.Order.Transactions[i].ID = f.nextID
+		}
+		f.Orders = append(f.Orders, req.Order)
+		reply(req)
+	case r.Method == "POST" && parts[0] == "orders" && len(parts) == 3 && parts[2] == "transactions":
+		var req struct {
+			Transaction shopifyTransaction `json:"transaction"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		f.nextID++
+		req.Transaction.ID = f.nextID
+		f.Transactions = append(f.Transactions, req.Transaction)
+		reply(req)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// available returns the stock left of the fake's one inventory item.
+func (f *fakeShopify) available() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Levels[0].Available
+}
+
+// useShopifyFake installs shop and sends its Admin API calls to a fake. The
+// returned function uninstalls the shop and shuts the fake down.
+func useShopifyFake(shop string) (*fakeShopify, func()) {
+	f := newFakeShopify()
+	oldBase := shopifyBaseURL
+	shopifyBaseURL = func(string) string { return f.URL }
+	shops.Put(context.Background(), &ShopRecord{Domain: shop, Token: "test-token"})
+	return f, func() {
+		shops.Delete(context.Background(), shop)
+		shopifyBaseURL = oldBase
+		f.Close()
+	}
+}
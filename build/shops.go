@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+var errShopNotFound = errors.New("shop is not installed")
+
+// ShopRecord is an installed shop, the access token the app uses for it and
+// the scopes the token was granted.
+type ShopRecord struct {
+	Domain    string
+	Token     string
+	Scopes    []string
+	Installed time.Time
+	Updated   time.Time
+}
+
+// ShopRepository stores installed shops by their myshopify.com domain. Put
+// replaces whatever is stored for the domain, so reinstalling a shop never
+// leaves a second record behind. Get returns errShopNotFound for shops that
+// aren't installed.
+type ShopRepository interface {
+	Get(ctx context.Context, domain string) (*ShopRecord, error)
+	Put(ctx context.Context, shop *ShopRecord) error
+	Delete(ctx context.Context, domain string) error
+}
+
+// shops is the repository the handlers use.
+var shops ShopRepository
+
+func init() {
+	// Local development can run without a key by keeping shops in memory.
+	if os.Getenv("SHOP_STORE") == "memory" {
+		shops = newMemoryShopRepository()
+		return
+	}
+	encoded := os.Getenv("SHOP_TOKEN_KEY")
+	if encoded == "" {
+		panic("Set SHOP_TOKEN_KEY")
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		panic("SHOP_TOKEN_KEY must be 32 bytes, base64 encoded")
+	}
+	shops = newCachedShopRepository(&datastoreShopRepository{key: key})
+}
+
+// Shop is how a shop is stored in datastore, keyed by its domain. The token
+// is sealed with a key of its own, which is in turn sealed with the app's
+// SHOP_TOKEN_KEY, so rotating SHOP_TOKEN_KEY only means rewrapping the keys.
+// Shops installed before this was keyed by domain were stored under
+// incomplete keys with the token in Token, and are moved over the first time
+// they are read.
+type Shop struct {
+	Name        string
+	Token       string   `datastore:",noindex"`
+	SealedToken []byte   `datastore:",noindex"`
+	WrappedKey  []byte   `datastore:",noindex"`
+	Scopes      []string `datastore:",noindex"`
+	Installed   time.Time
+	Updated     time.Time
+}
+
+type datastoreShopRepository struct {
+	key []byte
+}
+
+func (repo *datastoreShopRepository) shopKey(ctx context.Context, domain string) *datastore.Key {
+	return datastore.NewKey(ctx, "Shop", domain, 0, nil)
+}
+
+func (repo *datastoreShopRepository) Get(ctx context.Context, domain string) (*ShopRecord, error) {
+	var s Shop
+	err := datastore.Get(ctx, repo.shopKey(ctx, domain), &s)
+	if err == datastore.ErrNoSuchEntity {
+		return repo.migrate(ctx, domain)
+	} else if err != nil {
+		return nil, err
+	}
+	dataKey, err := openValue(repo.key, s.WrappedKey, []byte(domain))
+	if err != nil {
+		return nil, err
+	}
+	token, err := openValue(dataKey, s.SealedToken, []byte(domain))
+	if err != nil {
+		return nil, err
+	}
+	return &ShopRecord{
+		Domain:    domain,
+		Token:     string(token),
+		Scopes:    s.Scopes,
+		Installed: s.Installed,
+		Updated:   s.Updated,
+	}, nil
+}
+
+func (repo *datastoreShopRepository) Put(ctx context.Context, shop *ShopRecord) error {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	sealed, err := sealValue(dataKey, []byte(shop.Token), []byte(shop.Domain))
+	if err != nil {
+		return err
+	}
+	wrapped, err := sealValue(repo.key, dataKey, []byte(shop.Domain))
+	if err != nil {
+		return err
+	}
+	key := repo.shopKey(ctx, shop.Domain)
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		var existing Shop
+		err := datastore.Get(tc, key, &existing)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		now := time.Now()
+		s := Shop{
+			Name:        shop.Domain,
+			SealedToken: sealed,
+			WrappedKey:  wrapped,
+			Scopes:      shop.Scopes,
+			Installed:   existing.Installed,
+			Updated:     now,
+		}
+		if s.Installed.IsZero() {
+			s.Installed = now
+		}
+		_, err = datastore.Put(tc, key, &s)
+		return err
+	}, nil)
+}
+
+func (repo *datastoreShopRepository) Delete(ctx context.Context, domain string) error {
+	err := datastore.Delete(ctx, repo.shopKey(ctx, domain))
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+// migrate moves a shop stored under an incomplete key to its domain key,
+// encrypting the token on the way, and deletes the old records. Reinstalls
+// used to add a record each time, so the newest token wins.
+func (repo *datastoreShopRepository) migrate(ctx context.Context, domain string) (*ShopRecord, error) {
+	var legacy []Shop
+	keys, err := datastore.NewQuery("Shop").Filter("Name =", domain).GetAll(ctx, &legacy)
+	if err != nil {
+		return nil, err
+	}
+	var old []*datastore.Key
+	var token string
+	for i, k := range keys {
+		if k.StringID() != "" {
+			continue
+		}
+		old = append(old, k)
+		if legacy[i].Token != "" {
+			token = legacy[i].Token
+		}
+	}
+	if token == "" {
+		return nil, errShopNotFound
+	}
+	shop := &ShopRecord{Domain: domain, Token: token}
+	if err := repo.Put(ctx, shop); err != nil {
+		return nil, err
+	}
+	if err := datastore.DeleteMulti(ctx, old); err != nil {
+		log.Warningf(ctx, "Delete Legacy Shop Error: %s", err)
+	}
+	log.Infof(ctx, "Moved %s to an encrypted shop record", domain)
+	return repo.Get(ctx, domain)
+}
+
+// sealValue encrypts plaintext with AES-GCM under key, binding it to data so a
+// token can't be copied onto another shop's record.
+func sealValue(key []byte, plaintext []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, data), nil
+}
+
+func openValue(key []byte, sealed []byte, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed value too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], data)
+}
+
+// memoryShopRepository keeps shops in memory, for local development.
+type memoryShopRepository struct {
+	mu    sync.Mutex
+	shops map[string]ShopRecord
+}
+
+func newMemoryShopRepository() *memoryShopRepository {
+	return &memoryShopRepository{shops: map[string]ShopRecord{}}
+}
+
+func (repo *memoryShopRepository) Get(ctx context.Context, domain string) (*ShopRecord, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	shop, ok := repo.shops[domain]
+	if !ok {
+		return nil, errShopNotFound
+	}
+	return &shop, nil
+}
+
+func (repo *memoryShopRepository) Put(ctx context.Context, shop *ShopRecord) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	now := time.Now()
+	s := *shop
+	s.Installed = repo.shops[shop.Domain].Installed
+	if s.Installed.IsZero() {
+		s.Installed = now
+	}
+	s.Updated = now
+	repo.shops[shop.Domain] = s
+	return nil
+}
+
+func (repo *memoryShopRepository) Delete(ctx context.Context, domain string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	delete(repo.shops, domain)
+	return nil
+}
+
+// shopCacheTTL is how long an instance trusts its cached copy of a shop.
+// Other instances reinstalling or uninstalling the shop only invalidate their
+// own cache, so this bounds how long a stale token can be used.
+const shopCacheTTL = time.Minute
+
+// cachedShopRepository keeps shops read from another repository in memory for
+// shopCacheTTL. Writes through it invalidate the cached copy; Invalidate drops
+// a shop that was changed some other way.
+type cachedShopRepository struct {
+	next  ShopRepository
+	mu    sync.RWMutex
+	cache map[string]cachedShop
+	// now tells the time, and can be replaced in tests.
+	now func() time.Time
+}
+
+type cachedShop struct {
+	ShopRecord
+	fetched time.Time
+}
+
+func newCachedShopRepository(next ShopRepository) *cachedShopRepository {
+	return &cachedShopRepository{next: next, cache: map[string]cachedShop{}, now: time.Now}
+}
+
+func (repo *cachedShopRepository) Get(ctx context.Context, domain string) (*ShopRecord, error) {
+	repo.mu.RLock()
+	shop, ok := repo.cache[domain]
+	repo.mu.RUnlock()
+	if ok && repo.now().Sub(shop.fetched) < shopCacheTTL {
+		return &shop.ShopRecord, nil
+	}
+	fetched, err := repo.next.Get(ctx, domain)
+	if err == errShopNotFound {
+		repo.Invalidate(domain)
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	repo.mu.Lock()
+	repo.cache[domain] = cachedShop{*fetched, repo.now()}
+	repo.mu.Unlock()
+	return fetched, nil
+}
+
+func (repo *cachedShopRepository) Put(ctx context.Context, shop *ShopRecord) error {
+	repo.Invalidate(shop.Domain)
+	err := repo.next.Put(ctx, shop)
+	// Drop anything a concurrent Get cached while the write was in flight.
+	repo.Invalidate(shop.Domain)
+	return err
+}
+
+func (repo *cachedShopRepository) Delete(ctx context.Context, domain string) error {
+	repo.Invalidate(domain)
+	err := repo.next.Delete(ctx, domain)
+	repo.Invalidate(domain)
+	return err
+}
+
+// Invalidate drops domain from the cache so the next Get reads it again.
+func (repo *cachedShopRepository) Invalidate(domain string) {
+	repo.mu.Lock()
+	delete(repo.cache, domain)
+	repo.mu.Unlock()
+}
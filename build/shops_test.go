@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestCachedShopRepositoryExpires(t *testing.T) {
+	ctx := context.Background()
+	stored := newMemoryShopRepository()
+	repo := newCachedShopRepository(stored)
+	now := time.Now()
+	repo.now = func() time.Time { return now }
+
+	if err := repo.Put(ctx, &ShopRecord{Domain: "cache.myshopify.com", Token: "first"}); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	if shop, err := repo.Get(ctx, "cache.myshopify.com"); err != nil || shop.Token != "first" {
+		t.Fatalf("Get = %v, %v", shop, err)
+	}
+
+	// Another instance reinstalls the shop, which this cache doesn't see.
+	stored.Put(ctx, &ShopRecord{Domain: "cache.myshopify.com", Token: "second"})
+	if shop, _ := repo.Get(ctx, "cache.myshopify.com"); shop.Token != "first" {
+		t.Errorf("token = %s before the cache expired, want first", shop.Token)
+	}
+	now = now.Add(shopCacheTTL)
+	if shop, _ := repo.Get(ctx, "cache.myshopify.com"); shop.Token != "second" {
+		t.Errorf("token = %s after the cache expired, want second", shop.Token)
+	}
+
+	// And then uninstalls it.
+	stored.Delete(ctx, "cache.myshopify.com")
+	now = now.Add(shopCacheTTL)
+	if _, err := repo.Get(ctx, "cache.myshopify.com"); err != errShopNotFound {
+		t.Errorf("Get after uninstall = %v, want %v", err, errShopNotFound)
+	}
+}
+
+func TestCachedShopRepositoryWriteThrough(t *testing.T) {
+	ctx := context.Background()
+	repo := newCachedShopRepository(newMemoryShopRepository())
+
+	repo.Put(ctx, &ShopRecord{Domain: "cache.myshopify.com", Token: "first"})
+	repo.Get(ctx, "cache.myshopify.com")
+	repo.Put(ctx, &ShopRecord{Domain: "cache.myshopify.com", Token: "second"})
+	if shop, err := repo.Get(ctx, "cache.myshopify.com"); err != nil || shop.Token != "second" {
+		t.Errorf("Get after Put = %v, %v; want second", shop, err)
+	}
+	repo.Delete(ctx, "cache.myshopify.com")
+	if _, err := repo.Get(ctx, "cache.myshopify.com"); err != errShopNotFound {
+		t.Errorf("Get after Delete = %v, want %v", err, errShopNotFound)
+	}
+}
+
+func newTestShopRepository() *datastoreShopRepository {
+	return &datastoreShopRepository{key: []byte("0123456789abcdef0123456789abcdef")}
+}
+
+func TestDatastoreShopRepository(t *testing.T) {
+	ctx, _, done := newTestContext(t)
+	defer done()
+	repo := newTestShopRepository()
+
+	if err := repo.Put(ctx, &ShopRecord{Domain: "sealed.myshopify.com", Token: "shpat_secret", Scopes: requiredScopes}); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	shop, err := repo.Get(ctx, "sealed.myshopify.com")
+	if err != nil || shop.Token != "shpat_secret" || len(shop.Scopes) != len(requiredScopes) {
+		t.Fatalf("Get = %+v, %v", shop, err)
+	}
+	var stored Shop
+	if err := datastore.Get(ctx, repo.shopKey(ctx, "sealed.myshopify.com"), &stored); err != nil {
+		t.Fatalf("get stored shop: %s", err)
+	}
+	if stored.Token != "" || bytes.Contains(stored.SealedToken, []byte("shpat_secret")) {
+		t.Errorf("token stored in the clear: %+v", stored)
+	}
+
+	// Reinstalling replaces the token but keeps when the shop was installed.
+	if err := repo.Put(ctx, &ShopRecord{Domain: "sealed.myshopify.com", Token: "shpat_new"}); err != nil {
+		t.Fatalf("second Put: %s", err)
+	}
+	if again, err := repo.Get(ctx, "sealed.myshopify.com"); err != nil || again.Token != "shpat_new" || !again.Installed.Equal(shop.Installed) {
+		t.Errorf("Get after reinstall = %+v, %v", again, err)
+	}
+
+	// Without the app's key the token can't be opened.
+	if _, err := (&datastoreShopRepository{key: []byte("fedcba9876543210fedcba9876543210")}).Get(ctx, "sealed.myshopify.com"); err == nil {
+		t.Error("token opened with another key")
+	}
+
+	if err := repo.Delete(ctx, "sealed.myshopify.com"); err != nil {
+		t.Fatalf("Delete: %s", err)
+	}
+	if _, err := repo.Get(ctx, "sealed.myshopify.com"); err != errShopNotFound {
+		t.Errorf("Get after Delete = %v, want %v", err, errShopNotFound)
+	}
+}
+
+func TestDatastoreShopRepositoryCopiedRecord(t *testing.T) {
+	ctx, _, done := newTestContext(t)
+	defer done()
+	repo := newTestShopRepository()
+	repo.Put(ctx, &ShopRecord{Domain: "victim.myshopify.com", Token: "shpat_victim"})
+
+	// A record copied onto another shop's key is bound to the domain it was
+	// sealed for, so it doesn't open.
+	var stored Shop
+	if err := datastore.Get(ctx, repo.shopKey(ctx, "victim.myshopify.com"), &stored); err != nil {
+		t.Fatalf("get stored shop: %s", err)
+	}
+	stored.Name = "attacker.myshopify.com"
+	if _, err := datastore.Put(ctx, repo.shopKey(ctx, "attacker.myshopify.com"), &stored); err != nil {
+		t.Fatalf("put copied shop: %s", err)
+	}
+	if shop, err := repo.Get(ctx, "attacker.myshopify.com"); err == nil {
+		t.Errorf("copied record opened as %+v", shop)
+	}
+}
+
+func TestDatastoreShopRepositoryMigratesLegacy(t *testing.T) {
+	ctx, _, done := newTestContext(t)
+	defer done()
+	repo := newTestShopRepository()
+	legacy, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "Shop", nil), &Shop{Name: "legacy.myshopify.com", Token: "shpat_legacy"})
+	if err != nil {
+		t.Fatalf("put legacy shop: %s", err)
+	}
+	other, _ := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "Shop", nil), &Shop{Name: "other.myshopify.com", Token: "shpat_other"})
+
+	shop, err := repo.Get(ctx, "legacy.myshopify.com")
+	if err != nil || shop.Token != "shpat_legacy" {
+		t.Fatalf("Get legacy shop = %+v, %v", shop, err)
+	}
+	var stored Shop
+	if err := datastore.Get(ctx, legacy, &stored); err != datastore.ErrNoSuchEntity {
+		t.Errorf("legacy record left behind: %v", err)
+	}
+	if err := datastore.Get(ctx, repo.shopKey(ctx, "legacy.myshopify.com"), &stored); err != nil || stored.Token != "" || len(stored.SealedToken) == 0 {
+		t.Errorf("migrated record = %+v, %v; want the token sealed", stored, err)
+	}
+	if err := datastore.Get(ctx, other, &stored); err != nil || stored.Token != "shpat_other" {
+		t.Errorf("another shop's legacy record = %+v, %v; want it left alone", stored, err)
+	}
+	if again, err := repo.Get(ctx, "legacy.myshopify.com"); err != nil || again.Token != "shpat_legacy" {
+		t.Errorf("Get after migration = %+v, %v", again, err)
+	}
+}
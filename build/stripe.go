@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+)
+
+const stripeAPIBase = "https://api.stripe.com"
+
+// stripeWebhookTolerance is how far a signed Stripe webhook's timestamp may be
+// from our clock before we treat it as a replay.
+const stripeWebhookTolerance = 5 * time.Minute
+
+// stripeEnabled reports whether pay-in-full can be offered through Stripe.
+func stripeEnabled() bool {
+	return os.Getenv("STRIPE_SECRET_KEY") != ""
+}
+
+type stripeCheckoutSession struct {
+	ID                string `json:"id"`
+	URL               string `json:"url"`
+	PaymentStatus     string `json:"payment_status"`
+	PaymentIntent     string `json:"payment_intent"`
+	ClientReferenceID string `json:"client_reference_id"`
+	AmountTotal       int64  `json:"amount_total"`
+	Currency          string `json:"currency"`
+	CustomerDetails   *struct {
+		Email string `json:"email"`
+	} `json:"customer_details"`
+}
+
+type stripeError struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func stripeRequest(ctx context.Context, method string, path string, form url.Values, v interface{}) error {
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	req, err := http.NewRequest(method, stripeAPIBase+path, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(os.Getenv("STRIPE_SECRET_KEY"), "")
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := urlfetch.Client(ctx).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var e stripeError
+		json.Unmarshal(data, &e)
+		return fmt.Errorf("stripe: %s %s: %d %s", method, path, resp.StatusCode, e.Error.Message)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// createStripeCheckout starts a Stripe Checkout payment for amount.
+func createStripeCheckout(ctx context.Context, reference string, description string, amount float64, cur Currency, successURL string, cancelURL string) (*stripeCheckoutSession, error) {
+	form := url.Values{}
+	form.Set("mode", "payment")
+	form.Set("client_reference_id", reference)
+	form.Set("success_url", successURL)
+	form.Set("cancel_url", cancelURL)
+	form.Set("line_items[0][quantity]", "1")
+	form.Set("line_items[0][price_data][currency]", strings.ToLower(cur.Code))
+	form.Set("line_items[0][price_data][unit_amount]", strconv.FormatInt(int64(math.Round(amount*cur.scale())), 10))
+	form.Set("line_items[0][price_data][product_data][name]", description)
+	s := &stripeCheckoutSession{}
+	if err := stripeRequest(ctx, "POST", "/v1/checkout/sessions", form, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func getStripeCheckout(ctx context.Context, id string) (*stripeCheckoutSession, error) {
+	s := &stripeCheckoutSession{}
+	if err := stripeRequest(ctx, "GET", "/v1/checkout/sessions/"+url.PathEscape(id), nil, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// verifyStripeSignature checks a Stripe-Signature header of the form
+// "t=...,v1=...,v1=..." against the endpoint secret.
+func verifyStripeSignature(header string, body []byte, secret string, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return errors.New("malformed Stripe-Signature header")
+	}
+	// Clocks drift both ways, but a timestamp far in the future is as
+	// suspect as an old one.
+	if skew := now.Sub(time.Unix(t, 0)); skew > stripeWebhookTolerance || skew < -stripeWebhookTolerance {
+		return errors.New("Stripe webhook timestamp is outside the tolerance")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	for _, sig := range signatures {
+		if hmac.Equal([]byte(sig), []byte(expected)) {
+			return nil
+		}
+	}
+	return errors.New("Stripe signature mismatch")
+}
+
+type stripeEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+func stripeWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Without a secret anyone could sign an event, so nothing is accepted.
+	secret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+	if secret == "" {
+		log.Errorf(ctx, "Stripe webhook received but STRIPE_WEBHOOK_SECRET is not set")
+		http.Error(w, "Stripe webhooks are not configured", http.StatusServiceUnavailable)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Could not read body", http.StatusBadRequest)
+		return
+	}
+	if err := verifyStripeSignature(r.Header.Get("Stripe-Signature"), body, secret, time.Now()); err != nil {
+		log.Warningf(ctx, "Invalid Stripe webhook: %s", err)
+		http.Error(w, "Invalid signature", 401)
+		return
+	}
+	var event stripeEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.ID == "" {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	log.Debugf(ctx, "Stripe webhook %s: %s", event.ID, event.Type)
+
+	var orderID string
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		key := datastore.NewKey(tc, "WebhookEvent", "stripe:"+event.ID, 0, nil)
+		var stored WebhookEvent
+		if err := datastore.Get(tc, key, &stored); err == nil {
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		o, err := applyStripeEvent(tc, &event)
+		if err != nil {
+			return err
+		}
+		if o != nil {
+			orderID = o.AgreementID
+		}
+		_, err = datastore.Put(tc, key, newWebhookEvent(event.Type, o))
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		log.Errorf(ctx, "Handle Stripe Event Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if orderID != "" {
+		if err := syncShopifyOrder(ctx, orderID); err != nil {
+			log.Errorf(ctx, "Sync Shopify Order Error: %s", err)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// applyStripeEvent records a completed Stripe payment and returns the order it
+// paid for, or nil if there was nothing to record.
+func applyStripeEvent(ctx context.Context, event *stripeEvent) (*Order, error) {
+	if event.Type != "checkout.session.completed" {
+		log.Debugf(ctx, "Ignoring Stripe event type %s", event.Type)
+		return nil, nil
+	}
+	var s stripeCheckoutSession
+	if err := json.Unmarshal(event.Data.Object, &s); err != nil {
+		return nil, err
+	}
+	if s.PaymentStatus != "paid" {
+		return nil, nil
+	}
+	o, err := recordPayInFull(ctx, s.ClientReferenceID, stripePayment(&s))
+	if err == errPaymentMismatch {
+		// Already logged; retrying the delivery won't change the payment.
+		return nil, nil
+	}
+	return o, err
+}
+
+// stripePayment describes a paid Stripe checkout. Stripe reports amounts in
+// minor units.
+func stripePayment(s *stripeCheckoutSession) payInFullPayment {
+	p := payInFullPayment{
+		ID:            s.ID,
+		Provider:      "stripe",
+		TransactionID: s.PaymentIntent,
+		Currency:      s.Currency,
+		Email:         stripeEmail(s),
+	}
+	if cur, err := lookupCurrency(s.Currency); err == nil {
+		p.Amount = cur.value(float64(s.AmountTotal) / cur.scale())
+	}
+	return p
+}
+
+func stripeEmail(s *stripeCheckoutSession) string {
+	if s.CustomerDetails == nil {
+		return ""
+	}
+	return s.CustomerDetails.Email
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signStripe(body []byte, secret string, at time.Time) string {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyStripeSignature(t *testing.T) {
+	body := []byte(`{"id":"evt_1"}`)
+	now := time.Unix(1760000000, 0)
+	tests := []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{"valid", signStripe(body, "whsec", now), true},
+		{"slightly ahead", signStripe(body, "whsec", now.Add(time.Minute)), true},
+		{"too old", signStripe(body, "whsec", now.Add(-stripeWebhookTolerance-time.Second)), false},
+		{"too far ahead", signStripe(body, "whsec", now.Add(stripeWebhookTolerance+time.Second)), false},
+		{"other secret", signStripe(body, "other", now), false},
+		{"malformed", "v1=abc", false},
+	}
+	for _, tt := range tests {
+		err := verifyStripeSignature(tt.header, body, "whsec", now)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestStripeWebhookWithoutSecret(t *testing.T) {
+	restore := setEnv(map[string]string{"STRIPE_WEBHOOK_SECRET": ""})
+	defer restore()
+	inst, done := newTestInstance(t)
+	defer done()
+
+	// An empty secret is a valid HMAC key, so this would verify if the
+	// handler didn't refuse it.
+	body := []byte(`{"id":"evt_1","type":"checkout.session.completed","data":{"object":{}}}`)
+	req := newTestRequest(t, inst, "POST", "/webhooks/stripe", bytes.NewReader(body))
+	req.Header.Set("Stripe-Signature", signStripe(body, "", time.Now()))
+	w := httptest.NewRecorder()
+	stripeWebhook(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("webhook returned %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestRecordPayInFullChecksPayment(t *testing.T) {
+	paid := payInFullPayment{ID: "PAY-1", Provider: "paypal", TransactionID: "CAP-1", Amount: "62.50", Currency: "USD"}
+	tests := []struct {
+		name   string
+		change func(p *payInFullPayment)
+		ok     bool
+	}{
+		{"matching", func(p *payInFullPayment) {}, true},
+		{"same amount written differently", func(p *payInFullPayment) { p.Amount = "62.5" }, true},
+		{"other payment", func(p *payInFullPayment) { p.ID = "PAY-2" }, false},
+		{"short", func(p *payInFullPayment) { p.Amount = "0.01" }, false},
+		{"other currency", func(p *payInFullPayment) { p.Currency = "CAD" }, false},
+		{"unknown currency", func(p *payInFullPayment) { p.Currency = "XYZ" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, _, done := newTestContext(t)
+			defer done()
+			session := &CheckoutSession{
+				Shop:      "shop.myshopify.com",
+				Event:     "Event",
+				Variant:   "General",
+				TotalDue:  "62.50",
+				Qty:       "1",
+				Currency:  "USD",
+				PlanID:    payInFull,
+				PaymentID: "PAY-1",
+				State:     checkoutRedirected,
+			}
+			if err := putCheckoutSession(ctx, "session", session); err != nil {
+				t.Fatalf("putCheckoutSession: %s", err)
+			}
+
+			p := paid
+			tt.change(&p)
+			_, err := recordPayInFull(ctx, "session", p)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("recordPayInFull: %s", err)
+				}
+				o, err := getOrder(ctx, "PAY-1")
+				if err != nil {
+					t.Fatalf("getOrder: %s", err)
+				}
+				if o.Status != orderCompleted || o.Installments[0].TransactionID != "CAP-1" {
+					t.Errorf("order = %s paid by %s, want completed by CAP-1", o.Status, o.Installments[0].TransactionID)
+				}
+				return
+			}
+			if err != errPaymentMismatch {
+				t.Fatalf("recordPayInFull = %v, want %v", err, errPaymentMismatch)
+			}
+			if _, err := getOrder(ctx, p.ID); err == nil {
+				t.Error("order was created for a mismatched payment")
+			}
+		})
+	}
+}
+
+func TestStripePayment(t *testing.T) {
+	s := &stripeCheckoutSession{ID: "cs_1", PaymentIntent: "pi_1", AmountTotal: 6250, Currency: "usd"}
+	if p := stripePayment(s); p.Amount != "62.50" || p.ID != "cs_1" || p.TransactionID != "pi_1" {
+		t.Errorf("stripePayment = %+v", p)
+	}
+	s = &stripeCheckoutSession{ID: "cs_2", AmountTotal: 1250, Currency: "jpy"}
+	if p := stripePayment(s); p.Amount != "1250" {
+		t.Errorf("stripePayment(JPY) amount = %s, want 1250", p.Amount)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"google.golang.org/appengine/datastore"
+)
+
+var errOtherShop = errors.New("That belongs to another store.")
+
+// Tenant is the shop a request acts for. Records a shop owns, its token and
+// its Admin API are reached through its Tenant, which only finds that shop's
+// records and refuses to store one that belongs to another shop, so an ID or
+// shop name taken from a request can't reach into another store.
+//
+// A Tenant is made from whatever authenticated the request: the admin
+// session (AdminShop.tenant), the vendor of a signed link (vendorTenant), a
+// verified webhook's shop, or the Shop of a record already loaded.
+//
+// PayPal and Stripe webhooks, and the plan and pay-now links emailed to
+// buyers, name an order or checkout but no shop. The provider's signature or
+// the record's own ID is what authenticates them, so they act for the shop of
+// the record they name: orderTenant and checkoutSessionTenant load it and
+// return that shop's Tenant for everything that follows. The cron jobs work
+// across every shop and use no Tenant.
+type Tenant struct {
+	Shop string
+}
+
+// vendorTenant is the Tenant for the vendor segment of a link that has been
+// verified with verifyLink.
+func vendorTenant(ctx context.Context, vendor string) Tenant {
+	return Tenant{Shop: vendorShop(ctx, vendor)}
+}
+
+// owns returns errOtherShop unless shop is the tenant's.
+func (t Tenant) owns(shop string) error {
+	if t.Shop == "" || shop != t.Shop {
+		return errOtherShop
+	}
+	return nil
+}
+
+// query starts a query over the tenant's entities of kind, all of which carry
+// the shop they belong to in Shop.
+func (t Tenant) query(kind string) *datastore.Query {
+	return datastore.NewQuery(kind).Filter("Shop =", t.Shop)
+}
+
+// orderTenant loads the order named by a request that carries no shop, and
+// returns it with the Tenant it belongs to.
+func orderTenant(ctx context.Context, id string) (*Order, Tenant, error) {
+	o, err := getOrder(ctx, id)
+	if err != nil {
+		return nil, Tenant{}, err
+	}
+	return o, Tenant{Shop: o.Shop}, nil
+}
+
+// checkoutSessionTenant is orderTenant for a checkout session.
+func checkoutSessionTenant(ctx context.Context, id string) (*CheckoutSession, Tenant, error) {
+	s, err := getCheckoutSession(ctx, id)
+	if err != nil {
+		return nil, Tenant{}, err
+	}
+	return s, Tenant{Shop: s.Shop}, nil
+}
+
+func (t Tenant) order(ctx context.Context, id string) (*Order, error) {
+	o, err := getOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.owns(o.Shop); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (t Tenant) putOrder(ctx context.Context, o *Order) error {
+	if err := t.owns(o.Shop); err != nil {
+		return err
+	}
+	return putOrder(ctx, o)
+}
+
+func (t Tenant) checkoutSession(ctx context.Context, id string) (*CheckoutSession, error) {
+	s, err := getCheckoutSession(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.owns(s.Shop); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (t Tenant) checkoutSessionForSubscription(ctx context.Context, subscriptionID string) (*CheckoutSession, error) {
+	s, err := checkoutSessionForSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.owns(s.Shop); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (t Tenant) vendorConfig(ctx context.Context) (*VendorConfig, error) {
+	return getVendorConfig(ctx, t.Shop)
+}
+
+func (t Tenant) putVendorConfig(ctx context.Context, c *VendorConfig) error {
+	return putVendorConfig(ctx, t.Shop, c)
+}
+
+// dataRequest returns one of the tenant's customer data exports. The key
+// includes the shop, so another shop's export is never found.
+func (t Tenant) dataRequest(ctx context.Context, id string) (*CustomerDataRequest, error) {
+	var req CustomerDataRequest
+	if err := datastore.Get(ctx, datastore.NewKey(ctx, "CustomerDataRequest", t.Shop+":"+id, 0, nil), &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// token returns the tenant's stored access token.
+func (t Tenant) token(ctx context.Context) (string, error) {
+	installed, err := shops.Get(ctx, t.Shop)
+	if err != nil {
+		return "", err
+	}
+	return installed.Token, nil
+}
+
+// shopifyGet fetches path from the tenant's Admin API and decodes the JSON
+// body into v.
+func (t Tenant) shopifyGet(ctx context.Context, path string, v interface{}) error {
+	return t.shopifyRequest(ctx, "GET", path, nil, v)
+}
+
+// shopifyRequest calls the tenant's Admin API with body encoded as JSON and
+// decodes the response into v. A 404 means the item is gone.
+func (t Tenant) shopifyRequest(ctx context.Context, method string, path string, body interface{}, v interface{}) error {
+	token, err := t.token(ctx)
+	if err != nil {
+		return err
+	}
+	err = newShopifyClient(ctx, t.Shop, token).do(method, path, body, v)
+	if e, ok := err.(*shopifyError); ok && e.Status == http.StatusNotFound {
+		return errCartUnavailable
+	}
+	return err
+}
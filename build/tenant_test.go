@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+const otherShop = "other.myshopify.com"
+
+func TestTenantOrder(t *testing.T) {
+	inst, done := newTestInstance(t)
+	defer done()
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+	putTestOrder(t, inst, "shop.myshopify.com", "I-TENANT")
+	mine, other := Tenant{Shop: "shop.myshopify.com"}, Tenant{Shop: otherShop}
+
+	if _, err := mine.order(ctx, "I-TENANT"); err != nil {
+		t.Errorf("own order: %s", err)
+	}
+	for _, tenant := range []Tenant{other, {}} {
+		if _, err := tenant.order(ctx, "I-TENANT"); err != errOtherShop {
+			t.Errorf("%q read another shop's order: %v", tenant.Shop, err)
+		}
+	}
+
+	o := loadTestOrder(t, inst, "I-TENANT")
+	o.Email = "taken@example.com"
+	if err := other.putOrder(ctx, o); err != errOtherShop {
+		t.Errorf("stored another shop's order: %v", err)
+	}
+	o.Shop = otherShop
+	if err := mine.putOrder(ctx, o); err != errOtherShop {
+		t.Errorf("moved an order to another shop: %v", err)
+	}
+	if got := loadTestOrder(t, inst, "I-TENANT"); got.Email != "" || got.Shop != "shop.myshopify.com" {
+		t.Errorf("order changed to %s, %s", got.Shop, got.Email)
+	}
+}
+
+func TestTenantCheckoutSession(t *testing.T) {
+	ctx, _, done := newTestContext(t)
+	defer done()
+	s := &CheckoutSession{Shop: "shop.myshopify.com", SubscriptionID: "I-SESSION", Expires: time.Now().Add(time.Hour)}
+	if err := putCheckoutSession(ctx, "session", s); err != nil {
+		t.Fatalf("putCheckoutSession: %s", err)
+	}
+	mine, other := Tenant{Shop: "shop.myshopify.com"}, Tenant{Shop: otherShop}
+
+	if _, err := mine.checkoutSession(ctx, "session"); err != nil {
+		t.Errorf("own checkout: %s", err)
+	}
+	if _, err := other.checkoutSession(ctx, "session"); err != errOtherShop {
+		t.Errorf("read another shop's checkout: %v", err)
+	}
+	if _, err := mine.checkoutSessionForSubscription(ctx, "I-SESSION"); err != nil {
+		t.Errorf("own subscription's checkout: %s", err)
+	}
+	if _, err := other.checkoutSessionForSubscription(ctx, "I-SESSION"); err != errOtherShop {
+		t.Errorf("read another shop's checkout by subscription: %v", err)
+	}
+}
+
+func TestTenantDataRequest(t *testing.T) {
+	ctx, _, done := newTestContext(t)
+	defer done()
+	key := datastore.NewKey(ctx, "CustomerDataRequest", "shop.myshopify.com:7", 0, nil)
+	if _, err := datastore.Put(ctx, key, &CustomerDataRequest{Shop: "shop.myshopify.com", Created: time.Now()}); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+
+	if _, err := (Tenant{Shop: "shop.myshopify.com"}).dataRequest(ctx, "7"); err != nil {
+		t.Errorf("own export: %s", err)
+	}
+	for _, id := range []string{"7", "shop.myshopify.com:7"} {
+		if _, err := (Tenant{Shop: otherShop}).dataRequest(ctx, id); err != datastore.ErrNoSuchEntity {
+			t.Errorf("found another shop's export as %q: %v", id, err)
+		}
+	}
+}
+
+// relink signs the thank-you link target was sent back to again for vendor,
+// as another shop could for a checkout of its own.
+func relink(t *testing.T, inst aetest.Instance, target string, vendor string) string {
+	u, err := url.Parse(strings.TrimPrefix(target, appURL))
+	if err != nil {
+		t.Fatalf("Parse: %s", err)
+	}
+	path := strings.Split(strings.TrimPrefix(u.Path, "/thank-you/"), "/")
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+	params, err := verifyLink(ctx, linkThankYou, path[0], path[1])
+	if err != nil {
+		t.Fatalf("verifyLink: %s", err)
+	}
+	params.Del("expires")
+	params.Del("nonce")
+	segment, err := signLink(ctx, linkThankYou, vendor, params)
+	if err != nil {
+		t.Fatalf("signLink: %s", err)
+	}
+	return "/thank-you/" + vendor + "/" + segment + "?" + u.RawQuery
+}
+
+func TestThankYouOtherShop(t *testing.T) {
+	fake, stopPayPal := usePayPalFake()
+	defer stopPayPal()
+	_, stopShopify := useShopifyFake(roundTripShop)
+	defer stopShopify()
+	shops.Put(context.Background(), &ShopRecord{Domain: otherShop, Token: "test-token"})
+	defer shops.Delete(context.Background(), otherShop)
+	inst, done := newTestInstance(t)
+	defer done()
+
+	// A subscription checked out with roundTripShop.
+	session, plans := openCheckout(t, inst)
+	w := serve(t, inst, order, "POST", "/order", url.Values{"checkout-session": {session}, "payment-plan": {plans[0]}})
+	if w.Code != http.StatusFound {
+		t.Fatalf("order returned %d: %s", w.Code, w.Body)
+	}
+	var subscriptionID string
+	for id := range fake.Subscriptions {
+		subscriptionID = id
+	}
+	back := approve(t, fake.URL+"/checkoutnow?token="+subscriptionID)
+	if w := serve(t, inst, thankyou, "GET", relink(t, inst, back, "other"), nil); w.Code != http.StatusForbidden {
+		t.Errorf("another shop's thank-you for the subscription returned %d, want %d", w.Code, http.StatusForbidden)
+	}
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+	if _, err := getOrder(ctx, subscriptionID); err != datastore.ErrNoSuchEntity {
+		t.Errorf("order created through another shop: %v", err)
+	}
+
+	// A checkout paid in full with roundTripShop.
+	session, _ = openCheckout(t, inst)
+	w = serve(t, inst, order, "POST", "/order", url.Values{"checkout-session": {session}, "payment-plan": {payInFull}})
+	if w.Code != http.StatusFound {
+		t.Fatalf("order returned %d: %s", w.Code, w.Body)
+	}
+	back = approve(t, w.Header().Get("Location"))
+	if w := serve(t, inst, thankyou, "GET", relink(t, inst, back, "other"), nil); w.Code != http.StatusForbidden {
+		t.Errorf("another shop's thank-you for the payment returned %d, want %d", w.Code, http.StatusForbidden)
+	}
+	for id, paid := range fake.Orders {
+		if paid.Status == "COMPLETED" {
+			t.Errorf("payment %s captured through another shop", id)
+		}
+	}
+}
+
+func TestShopifyWebhookOtherShop(t *testing.T) {
+	inst, done := newTestInstance(t)
+	defer done()
+	putBuyerOrder(t, inst, fixtureShop, "I-KEPT", fixtureBuyer, 450789469)
+
+	// A delivery for one shop, replayed with another's header, is refused
+	// before it touches either shop's data.
+	for _, topic := range []string{"app/uninstalled", "customers/data_request", "customers/redact", "shop/redact"} {
+		body := fixture(t, "shopify/"+strings.Replace(topic, "/", "_", 1)+".json")
+		if code := postShopifyWebhook(t, inst, topic, otherShop, body, signShopifyWebhook(body)); code != http.StatusForbidden {
+			t.Errorf("%s for %s returned %d, want %d", topic, otherShop, code, http.StatusForbidden)
+		}
+	}
+
+	// A body that doesn't name the shop acts on the header's shop only.
+	body := []byte(`{"customer":{"email":"buyer@example.com"},"orders_to_redact":[450789469]}`)
+	if code := postShopifyWebhook(t, inst, "customers/redact", otherShop, body, signShopifyWebhook(body)); code != http.StatusOK {
+		t.Errorf("redact for %s returned %d", otherShop, code)
+	}
+	if o := loadTestOrder(t, inst, "I-KEPT"); o.Email != fixtureBuyer {
+		t.Errorf("%s's buyer redacted by %s", fixtureShop, otherShop)
+	}
+}
+
+func TestRecordPayInFullOtherShop(t *testing.T) {
+	inst, done := newTestInstance(t)
+	defer done()
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+	putTestOrder(t, inst, otherShop, "PAY-OTHER")
+	s := &CheckoutSession{Shop: "shop.myshopify.com", PlanID: payInFull, PaymentID: "PAY-OTHER", TotalDue: "93.75", Currency: "USD"}
+	if err := putCheckoutSession(ctx, "session", s); err != nil {
+		t.Fatalf("putCheckoutSession: %s", err)
+	}
+
+	// The payment is the checkout's, but its ID is another shop's order.
+	_, err := recordPayInFull(ctx, "session", payInFullPayment{ID: "PAY-OTHER", Provider: "paypal", TransactionID: "CAP-1", Amount: "93.75", Currency: "USD"})
+	if err != errPaymentMismatch {
+		t.Errorf("recordPayInFull = %v, want %v", err, errPaymentMismatch)
+	}
+	if o := loadTestOrder(t, inst, "PAY-OTHER"); o.Shop != otherShop || o.Installments[0].Status != installmentScheduled {
+		t.Errorf("another shop's order changed: %s, %s", o.Shop, o.Installments[0].Status)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+var (
+	errAnchorNotFound = errors.New("The theme doesn't contain the configured anchors. Check them under Settings.")
+	errSlugTaken      = errors.New("That slug is already used by another store.")
+)
+
+var (
+	slugPattern  = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+	colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+)
+
+// VendorConfig is how the app behaves for one shop: what buyers see, which
+// plans are offered and what they cost, and where the checkout button goes in
+// the theme. It is keyed by the shop's domain. Shops without one get
+// defaultVendorConfig.
+type VendorConfig struct {
+	DisplayName string
+	// Slug names the shop in checkout, plan and payment links.
+	Slug string
+	// PreviousSlugs are slugs the shop used before. Links already sent out
+	// with them keep working, and no other shop can take them.
+	PreviousSlugs []string
+	Timezone      string
+
+	// PlanTypes are the schedules offered, see createPlans.
+	PlanTypes          []string `datastore:",noindex"`
+	MinDaysBeforeEvent int
+	FeePercent         float64
+	SingleFeePercent   float64
+	TaxPercent         float64
+
+	// DateFormat is a Go time layout for event dates shown to buyers.
+	DateFormat string `datastore:",noindex"`
+
+	// The checkout button replaces whatever is between these in the theme.
+	AnchorAfter  string `datastore:",noindex"`
+	AnchorBefore string `datastore:",noindex"`
+
+	LogoURL     string `datastore:",noindex"`
+	AccentColor string `datastore:",noindex"`
+
+	Updated time.Time
+}
+
+// legacyAnchors are the theme anchors of shops whose themes were customized
+// before anchors could be configured, as {after, before}.
+var legacyAnchors = map[string][2]string{
+	"tasteoftravel.myshopify.com": {
+		"</button>\n\n{% endif %}\n<!-- end Bold code -->",
+		"</div>\n            </form>\n\n          </div>\n\n          <div class=\"product-single__description rte\" itemprop=\"description\">\n            {{ product.description }}\n          </div>",
+	},
+}
+
+// defaultVendorConfig is what every shop got before shops could be configured.
+func defaultVendorConfig(shop string) *VendorConfig {
+	c := &VendorConfig{
+		Slug:               strings.TrimSuffix(shop, ".myshopify.com"),
+		Timezone:           "UTC",
+		PlanTypes:          []string{"1:3", "4:4", "4-4"},
+		MinDaysBeforeEvent: 30,
+		FeePercent:         0.07,
+		SingleFeePercent:   0.03,
+		TaxPercent:         0.0825,
+		DateFormat:         checkoutDateLayout,
+		AnchorAfter:        "{% endif %}\n              </div>",
+		AnchorBefore:       "{% endform %}\n\n          </div>",
+	}
+	if anchors, ok := legacyAnchors[shop]; ok {
+		c.AnchorAfter, c.AnchorBefore = anchors[0], anchors[1]
+	}
+	return c
+}
+
+func vendorConfigKey(ctx context.Context, shop string) *datastore.Key {
+	return datastore.NewKey(ctx, "VendorConfig", shop, 0, nil)
+}
+
+// Slug reserves a vendor slug, current or previous, for one shop. It is keyed
+// by the slug and written in the same transaction as the shop's config, so
+// two shops saving the same slug at once can't both get it.
+type Slug struct {
+	Shop    string
+	Created time.Time
+}
+
+func slugKey(ctx context.Context, slug string) *datastore.Key {
+	return datastore.NewKey(ctx, "Slug", slug, 0, nil)
+}
+
+// reserveSlug reserves slug for shop, or returns errSlugTaken if another shop
+// has it. It must run in a transaction.
+func reserveSlug(tc context.Context, shop string, slug string) error {
+	var reserved Slug
+	err := datastore.Get(tc, slugKey(tc, slug), &reserved)
+	if err == nil {
+		if reserved.Shop != shop {
+			return errSlugTaken
+		}
+		return nil
+	} else if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	_, err = datastore.Put(tc, slugKey(tc, slug), &Slug{Shop: shop, Created: time.Now()})
+	return err
+}
+
+// getVendorConfig returns shop's configuration, or the defaults if it has
+// never been saved.
+func getVendorConfig(ctx context.Context, shop string) (*VendorConfig, error) {
+	var c VendorConfig
+	err := datastore.Get(ctx, vendorConfigKey(ctx, shop), &c)
+	if err == datastore.ErrNoSuchEntity {
+		return defaultVendorConfig(shop), nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// putVendorConfig validates c and saves it for shop. A slug the shop stops
+// using is kept in PreviousSlugs, and stays reserved.
+func putVendorConfig(ctx context.Context, shop string, c *VendorConfig) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	// Slugs saved before they were reserved are only found by querying.
+	for _, field := range []string{"Slug =", "PreviousSlugs ="} {
+		keys, err := datastore.NewQuery("VendorConfig").Filter(field, c.Slug).KeysOnly().GetAll(ctx, nil)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if k.StringID() != shop {
+				return errSlugTaken
+			}
+		}
+	}
+	// A slug that is another store's own name would take over its links.
+	if own := c.Slug + ".myshopify.com"; own != shop {
+		if _, err := shops.Get(ctx, own); err != errShopNotFound {
+			return errSlugTaken
+		}
+	}
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		var stored VendorConfig
+		err := datastore.Get(tc, vendorConfigKey(tc, shop), &stored)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err := reserveSlug(tc, shop, c.Slug); err != nil {
+			return err
+		}
+		// The shop's myshopify.com name always resolves, so it needn't be
+		// kept. A slug from before reservations is reserved as it is
+		// retired.
+		previous := stored.PreviousSlugs
+		if stored.Slug != "" && stored.Slug != c.Slug && stored.Slug+".myshopify.com" != shop {
+			if err := reserveSlug(tc, shop, stored.Slug); err != nil {
+				return err
+			}
+			previous = append(previous, stored.Slug)
+		}
+		c.PreviousSlugs = nil
+		for _, slug := range previous {
+			if slug != c.Slug {
+				c.PreviousSlugs = append(c.PreviousSlugs, slug)
+			}
+		}
+		c.Updated = time.Now()
+		_, err = datastore.Put(tc, vendorConfigKey(tc, shop), c)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+func (c *VendorConfig) validate() error {
+	if !slugPattern.MatchString(c.Slug) || len(c.Slug) > 60 {
+		return errors.New("The slug may only use lowercase letters, numbers and dashes.")
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		return errors.New("Unknown timezone " + strconv.Quote(c.Timezone) + ".")
+	}
+	if len(c.PlanTypes) == 0 {
+		return errors.New("Offer at least one plan.")
+	}
+	for _, p := range c.PlanTypes {
+		if !validPlanType(p) {
+			return errors.New("Plan " + strconv.Quote(p) + " should look like 1:3, 4-4 or 4,2.")
+		}
+	}
+	if c.MinDaysBeforeEvent < 0 {
+		return errors.New("Days before the event can't be negative.")
+	}
+	for _, pct := range []float64{c.FeePercent, c.SingleFeePercent, c.TaxPercent} {
+		if pct < 0 || pct >= 1 {
+			return errors.New("Fees and tax must be between 0 and 100 percent.")
+		}
+	}
+	// A layout without any of the reference date's parts formats every date
+	// the same.
+	if c.DateFormat == "" || time.Date(2019, 11, 12, 0, 0, 0, 0, time.UTC).Format(c.DateFormat) == time.Date(2020, 12, 13, 0, 0, 0, 0, time.UTC).Format(c.DateFormat) {
+		return errors.New("The date format should be written as Jan 2, 2006 would appear.")
+	}
+	if c.AnchorAfter == "" || c.AnchorBefore == "" {
+		return errors.New("Both theme anchors are needed.")
+	}
+	if c.LogoURL != "" && !strings.HasPrefix(c.LogoURL, "https://") {
+		return errors.New("The logo must be an https:// URL.")
+	}
+	if c.AccentColor != "" && !colorPattern.MatchString(c.AccentColor) {
+		return errors.New("The accent color should look like #1a2b3c.")
+	}
+	return nil
+}
+
+func validPlanType(p string) bool {
+	for _, sep := range []string{":", "-", ","} {
+		nums := strings.Split(p, sep)
+		if len(nums) != 2 {
+			continue
+		}
+		low, err1 := strconv.Atoi(nums[0])
+		high, err2 := strconv.Atoi(nums[1])
+		if err1 != nil || err2 != nil || low < 1 || high < 1 {
+			return false
+		}
+		// A fixed schedule is cycles,interval; the others are ranges.
+		return sep == "," || high >= low
+	}
+	return false
+}
+
+// location is the shop's timezone, which plan dates are worked out in.
+func (c *VendorConfig) location() *time.Location {
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// injectButton puts button into a theme asset between the configured
+// anchors, replacing whatever was there.
+func (c *VendorConfig) injectButton(asset string, button string) (string, error) {
+	top := strings.Index(asset, c.AnchorAfter)
+	if top < 0 {
+		return "", errAnchorNotFound
+	}
+	top += len(c.AnchorAfter)
+	bottom := strings.Index(asset[top:], c.AnchorBefore)
+	if bottom < 0 {
+		return "", errAnchorNotFound
+	}
+	bottom += top
+	// Keep the line break before the closing anchor.
+	if bottom > top {
+		bottom--
+	}
+	return asset[:top] + button + asset[bottom:], nil
+}
+
+// vendorShop returns the shop a link's vendor segment names: the shop whose
+// configured slug, or former slug, it is, or else the shop it is the
+// myshopify.com name of.
+func vendorShop(ctx context.Context, vendor string) string {
+	var reserved Slug
+	if err := datastore.Get(ctx, slugKey(ctx, vendor), &reserved); err == nil {
+		return reserved.Shop
+	} else if err != datastore.ErrNoSuchEntity {
+		log.Errorf(ctx, "Get Slug Error: %s", err)
+	}
+	for _, field := range []string{"Slug =", "PreviousSlugs ="} {
+		keys, err := datastore.NewQuery("VendorConfig").Filter(field, vendor).KeysOnly().Limit(1).GetAll(ctx, nil)
+		if err != nil {
+			log.Errorf(ctx, "Vendor Slug Query Error: %s", err)
+		} else if len(keys) > 0 {
+			return keys[0].StringID()
+		}
+	}
+	return vendor + ".myshopify.com"
+}
+
+// vendorSlug returns the vendor segment new links for shop are made with.
+func vendorSlug(ctx context.Context, shop string) string {
+	c, err := getVendorConfig(ctx, shop)
+	if err != nil {
+		log.Errorf(ctx, "Get Vendor Config Error: %s", err)
+		return strings.TrimSuffix(shop, ".myshopify.com")
+	}
+	return c.Slug
+}
+
+// vendorConfigFromForm reads the admin's settings form over a copy of c.
+// Percentages are entered as percent and stored as fractions.
+func vendorConfigFromForm(c *VendorConfig, form url.Values) (*VendorConfig, error) {
+	next := *c
+	next.DisplayName = strings.TrimSpace(form.Get("display-name"))
+	next.Slug = strings.ToLower(strings.TrimSpace(form.Get("slug")))
+	next.Timezone = strings.TrimSpace(form.Get("timezone"))
+	next.PlanTypes = nil
+	for _, p := range strings.Split(form.Get("plan-types"), " ") {
+		if p = strings.TrimSpace(p); p != "" {
+			next.PlanTypes = append(next.PlanTypes, p)
+		}
+	}
+	var err error
+	if next.MinDaysBeforeEvent, err = strconv.Atoi(strings.TrimSpace(form.Get("min-days"))); err != nil {
+		return nil, errors.New("Days before the event must be a whole number.")
+	}
+	for field, dst := range map[string]*float64{"fee": &next.FeePercent, "single-fee": &next.SingleFeePercent, "tax": &next.TaxPercent} {
+		pct, err := strconv.ParseFloat(strings.TrimSpace(form.Get(field)), 64)
+		if err != nil {
+			return nil, errors.New("Fees and tax must be numbers.")
+		}
+		*dst = pct / 100
+	}
+	next.DateFormat = strings.TrimSpace(form.Get("date-format"))
+	// Browsers send textarea line breaks as \r\n; themes use \n.
+	next.AnchorAfter = strings.Replace(form.Get("anchor-after"), "\r\n", "\n", -1)
+	next.AnchorBefore = strings.Replace(form.Get("anchor-before"), "\r\n", "\n", -1)
+	next.LogoURL = strings.TrimSpace(form.Get("logo-url"))
+	next.AccentColor = strings.TrimSpace(form.Get("accent-color"))
+	return &next, nil
+}
+
+// serveVendorConfig saves the settings form posted from the admin.
+func serveVendorConfig(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenant := currentShop(r).tenant()
+	c, err := tenant.vendorConfig(ctx)
+	if err != nil {
+		log.Errorf(ctx, "Get Vendor Config Error: %s", err)
+		http.Error(w, "Could not load settings", http.StatusInternalServerError)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Could not read settings", http.StatusBadRequest)
+		return
+	}
+	next, err := vendorConfigFromForm(c, r.PostForm)
+	if err == nil {
+		err = tenant.putVendorConfig(ctx, next)
+	}
+	if err != nil {
+		log.Debugf(ctx, "Save Vendor Config Error: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte("Settings saved."))
+}
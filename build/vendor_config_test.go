@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDefaultVendorConfigValid(t *testing.T) {
+	if err := defaultVendorConfig("shop.myshopify.com").validate(); err != nil {
+		t.Errorf("default config: %s", err)
+	}
+	for _, layout := range []string{"Jan 2, 2006", "02/01/2006", "Monday"} {
+		c := defaultVendorConfig("shop.myshopify.com")
+		c.DateFormat = layout
+		if err := c.validate(); err != nil {
+			t.Errorf("date format %q: %s", layout, err)
+		}
+	}
+	for _, layout := range []string{"", "soon", "15:04"} {
+		c := defaultVendorConfig("shop.myshopify.com")
+		c.DateFormat = layout
+		if err := c.validate(); err == nil {
+			t.Errorf("date format %q accepted", layout)
+		}
+	}
+}
+
+func TestLegacyAnchors(t *testing.T) {
+	theme := "<form>\n<!-- Bold code -->\n<button>Buy</button>\n\n{% endif %}\n<!-- end Bold code -->\nOLD BUTTON\n" +
+		"</div>\n            </form>\n\n          </div>\n\n          <div class=\"product-single__description rte\" itemprop=\"description\">\n            {{ product.description }}\n          </div>"
+	got, err := defaultVendorConfig("tasteoftravel.myshopify.com").injectButton(theme, "NEW BUTTON")
+	if err != nil {
+		t.Fatalf("injectButton: %s", err)
+	}
+	if strings.Contains(got, "OLD BUTTON") || !strings.Contains(got, "<!-- end Bold code -->NEW BUTTON\n</div>") {
+		t.Errorf("injected theme:\n%s", got)
+	}
+	if _, err := defaultVendorConfig("shop.myshopify.com").injectButton(theme, "NEW BUTTON"); err != errAnchorNotFound {
+		t.Errorf("other shops matched the Bold anchors: %v", err)
+	}
+}
+
+func TestSlugChangeKeepsLinks(t *testing.T) {
+	const shop, other = "slugs.myshopify.com", "taker.myshopify.com"
+	shops.Put(context.Background(), &ShopRecord{Domain: shop, Token: "test-token"})
+	defer shops.Delete(context.Background(), shop)
+	ctx, _, done := newTestContext(t)
+	defer done()
+
+	c := defaultVendorConfig(shop)
+	c.Slug = "first"
+	if err := putVendorConfig(ctx, shop, c); err != nil {
+		t.Fatalf("putVendorConfig: %s", err)
+	}
+	segment, err := signLink(ctx, linkCheckout, "first", url.Values{"product": {"1"}})
+	if err != nil {
+		t.Fatalf("signLink: %s", err)
+	}
+
+	c.Slug = "second"
+	if err := putVendorConfig(ctx, shop, c); err != nil {
+		t.Fatalf("putVendorConfig: %s", err)
+	}
+	if _, err := verifyLink(ctx, linkCheckout, "first", segment); err != nil {
+		t.Errorf("link with the old slug: %s", err)
+	}
+	for _, vendor := range []string{"first", "second", "slugs"} {
+		if got := vendorShop(ctx, vendor); got != shop {
+			t.Errorf("vendorShop(%s) = %s, want %s", vendor, got, shop)
+		}
+	}
+
+	taker := defaultVendorConfig(other)
+	taker.Slug = "first"
+	if err := putVendorConfig(ctx, other, taker); err != errSlugTaken {
+		t.Errorf("another shop took an old slug: %v", err)
+	}
+
+	// Going back to an old slug leaves the one after it behind.
+	c.Slug = "first"
+	if err := putVendorConfig(ctx, shop, c); err != nil {
+		t.Fatalf("putVendorConfig: %s", err)
+	}
+	stored, err := getVendorConfig(ctx, shop)
+	if err != nil {
+		t.Fatalf("getVendorConfig: %s", err)
+	}
+	if len(stored.PreviousSlugs) != 1 || stored.PreviousSlugs[0] != "second" {
+		t.Errorf("previous slugs = %v, want [second]", stored.PreviousSlugs)
+	}
+}
+
+func TestSlugReservedConcurrently(t *testing.T) {
+	ctx, _, done := newTestContext(t)
+	defer done()
+
+	// Several shops save the same new slug at once.
+	shopNames := []string{"one.myshopify.com", "two.myshopify.com", "three.myshopify.com"}
+	errs := make([]error, len(shopNames))
+	var wg sync.WaitGroup
+	for i, shop := range shopNames {
+		wg.Add(1)
+		go func(i int, shop string) {
+			defer wg.Done()
+			c := defaultVendorConfig(shop)
+			c.Slug = "contested"
+			errs[i] = putVendorConfig(ctx, shop, c)
+		}(i, shop)
+	}
+	wg.Wait()
+
+	var winner string
+	for i, err := range errs {
+		switch err {
+		case nil:
+			if winner != "" {
+				t.Errorf("both %s and %s got the slug", winner, shopNames[i])
+			}
+			winner = shopNames[i]
+		case errSlugTaken:
+		default:
+			t.Errorf("%s: putVendorConfig: %s", shopNames[i], err)
+		}
+	}
+	if winner == "" {
+		t.Fatal("no shop got the slug")
+	}
+	if got := vendorShop(ctx, "contested"); got != winner {
+		t.Errorf("vendorShop(contested) = %s, want %s", got, winner)
+	}
+	for _, shop := range shopNames {
+		if c, _ := getVendorConfig(ctx, shop); shop != winner && c.Slug == "contested" {
+			t.Errorf("%s saved the slug reserved for %s", shop, winner)
+		}
+	}
+}
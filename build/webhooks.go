@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// PayPalEvent is a webhook notification as posted by PayPal.
+type PayPalEvent struct {
+	ID           string          `json:"id"`
+	EventType    string          `json:"event_type"`
+	ResourceType string          `json:"resource_type"`
+	Summary      string          `json:"summary"`
+	CreateTime   string          `json:"create_time"`
+	Resource     json.RawMessage `json:"resource"`
+}
+
+// WebhookEvent records a PayPal or Stripe event that was applied. It is keyed
+// by the event ID so redelivered events are only applied once. The payload
+// itself isn't kept, as it carries the payer's name and address.
+type WebhookEvent struct {
+	EventType string
+	Shop      string
+	OrderID   string
+	Received  time.Time
+}
+
+// newWebhookEvent records an event of eventType that changed o, which is nil
+// if it changed nothing.
+func newWebhookEvent(eventType string, o *Order) *WebhookEvent {
+	e := &WebhookEvent{EventType: eventType, Received: time.Now()}
+	if o != nil {
+		e.Shop = o.Shop
+		e.OrderID = o.AgreementID
+	}
+	return e
+}
+
+type saleResource struct {
+	ID                 string `json:"id"`
+	State              string `json:"state"`
+	BillingAgreementID string `json:"billing_agreement_id"`
+	CreateTime         string `json:"create_time"`
+	Amount             struct {
+		Total    string `json:"total"`
+		Currency string `json:"currency"`
+	} `json:"amount"`
+}
+
+type captureResource struct {
+	ID                string      `json:"id"`
+	CustomID          string      `json:"custom_id"`
+	Amount            payPalMoney `json:"amount"`
+	SupplementaryData struct {
+		RelatedIDs struct {
+			OrderID string `json:"order_id"`
+		} `json:"related_ids"`
+	} `json:"supplementary_data"`
+}
+
+type subscriptionResource struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+}
+
+func paypalWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Could not read body", http.StatusBadRequest)
+		return
+	}
+
+	c, err := newPayPalClient(ctx)
+	if err != nil {
+		log.Errorf(ctx, "New Client Error: %s", err)
+		http.Error(w, "PayPal unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	ok, err := verifyWebhookSignature(c, r.Header, body)
+	if err != nil {
+		log.Errorf(ctx, "Verify Webhook Signature Error: %s", err)
+		http.Error(w, "Could not verify signature", http.StatusServiceUnavailable)
+		return
+	}
+	if !ok {
+		log.Warningf(ctx, "Invalid webhook signature from PayPal")
+		http.Error(w, "Invalid signature", 401)
+		return
+	}
+
+	var event PayPalEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.ID == "" {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	log.Debugf(ctx, "PayPal webhook %s: %s", event.ID, event.EventType)
+
+	orderID, err := handlePayPalEvent(ctx, &event)
+	if err != nil {
+		log.Errorf(ctx, "Handle PayPal Event Error: %s", err)
+		// PayPal redelivers on non-2xx responses.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if orderID != "" {
+		// A failed sync leaves the order ShopifyPending for the
+		// reconciliation job to pick up, so it doesn't fail the webhook.
+		if err := syncShopifyOrder(ctx, orderID); err != nil {
+			log.Errorf(ctx, "Sync Shopify Order Error: %s", err)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handlePayPalEvent records event and applies it to the matching order in a
+// single transaction. Events that were already recorded are skipped. It
+// returns the ID of the order that changed, if any.
+func handlePayPalEvent(ctx context.Context, event *PayPalEvent) (string, error) {
+	var orderID string
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		key := datastore.NewKey(tc, "WebhookEvent", event.ID, 0, nil)
+		var stored WebhookEvent
+		err := datastore.Get(tc, key, &stored)
+		if err == nil {
+			log.Debugf(ctx, "PayPal event %s already processed", event.ID)
+			return nil
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		o, err := applyPayPalEvent(tc, event)
+		if err != nil {
+			return err
+		}
+		if o != nil {
+			orderID = o.AgreementID
+		}
+		_, err = datastore.Put(tc, key, newWebhookEvent(event.EventType, o))
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	return orderID, err
+}
+
+// applyPayPalEvent updates the order event refers to and returns it, or nil
+// if no order was changed.
+func applyPayPalEvent(ctx context.Context, event *PayPalEvent) (*Order, error) {
+	var agreementID string
+	var sale saleResource
+	var sub subscriptionResource
+	var capture captureResource
+	switch event.EventType {
+	case "PAYMENT.CAPTURE.COMPLETED":
+		// One-off payments for orders paid in full.
+		if err := json.Unmarshal(event.Resource, &capture); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(capture.CustomID, payNowPrefix) {
+			o, tenant, err := orderTenant(ctx, strings.TrimPrefix(capture.CustomID, payNowPrefix))
+			if err != nil {
+				log.Warningf(ctx, "No order for balance payment %s: %s", capture.ID, err)
+				return nil, nil
+			}
+			o.recordBalancePayment(capture.ID, time.Now())
+			return o, tenant.putOrder(ctx, o)
+		}
+		if strings.HasPrefix(capture.CustomID, payEarlyPrefix) {
+			o, tenant, err := orderTenant(ctx, strings.TrimPrefix(capture.CustomID, payEarlyPrefix))
+			if err != nil {
+				log.Warningf(ctx, "No order for early payoff %s: %s", capture.ID, err)
+				return nil, nil
+			}
+			o.recordEarlyPayoff(capture.ID, time.Now())
+			return o, tenant.putOrder(ctx, o)
+		}
+		if capture.CustomID == "" || capture.SupplementaryData.RelatedIDs.OrderID == "" {
+			return nil, nil
+		}
+		o, err := recordPayInFull(ctx, capture.CustomID, payInFullPayment{
+			ID:            capture.SupplementaryData.RelatedIDs.OrderID,
+			Provider:      "paypal",
+			TransactionID: capture.ID,
+			Amount:        capture.Amount.Value,
+			Currency:      capture.Amount.CurrencyCode,
+		})
+		if err == errPaymentMismatch {
+			// Already logged; redelivery won't change the payment.
+			return nil, nil
+		}
+		return o, err
+	case "PAYMENT.CAPTURE.DENIED":
+		if err := json.Unmarshal(event.Resource, &capture); err != nil {
+			return nil, err
+		}
+		agreementID = capture.SupplementaryData.RelatedIDs.OrderID
+	case "PAYMENT.SALE.COMPLETED", "PAYMENT.SALE.DENIED":
+		if err := json.Unmarshal(event.Resource, &sale); err != nil {
+			return nil, err
+		}
+		agreementID = sale.BillingAgreementID
+	case "BILLING.SUBSCRIPTION.SUSPENDED", "BILLING.SUBSCRIPTION.ACTIVATED", "BILLING.SUBSCRIPTION.CANCELLED", "BILLING.SUBSCRIPTION.PAYMENT.FAILED":
+		if err := json.Unmarshal(event.Resource, &sub); err != nil {
+			return nil, err
+		}
+		agreementID = sub.ID
+	default:
+		log.Debugf(ctx, "Ignoring PayPal event type %s", event.EventType)
+		return nil, nil
+	}
+	if agreementID == "" {
+		log.Debugf(ctx, "PayPal event %s has no agreement", event.ID)
+		return nil, nil
+	}
+
+	o, tenant, err := orderTenant(ctx, agreementID)
+	if err == datastore.ErrNoSuchEntity {
+		log.Warningf(ctx, "No order for agreement %s", agreementID)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch event.EventType {
+	case "PAYMENT.SALE.COMPLETED":
+		paid, err := time.Parse(time.RFC3339, sale.CreateTime)
+		if err != nil {
+			paid = time.Now()
+		}
+		o.recordSale(sale.ID, sale.Amount.Total, paid)
+	case "PAYMENT.CAPTURE.DENIED":
+		// The related ID is a PayPal order, which only pay-in-full orders
+		// are stored under. Those have no installments to retry, so a
+		// denied capture is not a failed installment.
+		if o.PayInFull {
+			log.Warningf(ctx, "Capture %s denied for order paid in full %s", capture.ID, agreementID)
+			return nil, nil
+		}
+		o.recordFailure(time.Now())
+	case "PAYMENT.SALE.DENIED", "BILLING.SUBSCRIPTION.PAYMENT.FAILED":
+		o.recordFailure(time.Now())
+	case "BILLING.SUBSCRIPTION.SUSPENDED":
+		// Plans are suspended while they are paid off early, and may be
+		// complete by the time the event arrives.
+		if o.Status == orderActive {
+			o.Status = orderSuspended
+		}
+	case "BILLING.SUBSCRIPTION.ACTIVATED":
+		// Sent when an early payoff falls through and the plan resumes.
+		if o.Status == orderSuspended {
+			o.Status = orderActive
+		}
+	case "BILLING.SUBSCRIPTION.CANCELLED":
+		// Plans paid off early are cancelled with PayPal once they are
+		// complete.
+		if o.Status != orderCompleted {
+			o.Status = orderCancelled
+		}
+	}
+	return o, tenant.putOrder(ctx, o)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+)
+
+// The fixtures in testdata/paypal are recorded deliveries for this
+// subscription.
+const fixtureSubscription = "I-BW452GLLEP1G"
+
+func putTestOrder(t *testing.T, inst aetest.Instance, shop string, id string) *Order {
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+	var dates []string
+	for i := 0; i < 3; i++ {
+		dates = append(dates, time.Now().AddDate(0, 0, 7*i).Format(time.UnixDate))
+	}
+	o := newOrder(shop, "vendor", "Event", "General", "2030-01-02", id, "31.25", dates)
+	o.Currency = "USD"
+	if err := putOrder(ctx, o); err != nil {
+		t.Fatalf("putOrder: %s", err)
+	}
+	return o
+}
+
+func loadTestOrder(t *testing.T, inst aetest.Instance, id string) *Order {
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+	o, err := getOrder(ctx, id)
+	if err != nil {
+		t.Fatalf("getOrder(%s): %s", id, err)
+	}
+	return o
+}
+
+func postPayPalWebhook(t *testing.T, inst aetest.Instance, body []byte) int {
+	req := newTestRequest(t, inst, "POST", "/webhooks/paypal", bytes.NewReader(body))
+	req.Header.Set("PAYPAL-TRANSMISSION-ID", "b2384410-f8d2-11e9-8056-f5fa4a1e9d7f")
+	req.Header.Set("PAYPAL-TRANSMISSION-SIG", "recorded-signature")
+	w := httptest.NewRecorder()
+	paypalWebhook(w, req)
+	return w.Code
+}
+
+func TestPayPalWebhook(t *testing.T) {
+	tests := []struct {
+		fixture string
+		check   func(t *testing.T, o *Order)
+	}{
+		{"payment_sale_completed.json", func(t *testing.T, o *Order) {
+			inst := o.Installments[0]
+			if inst.Status != installmentPaid || inst.TransactionID != "80021663DE681814L" || inst.Amount != "31.25" {
+				t.Errorf("first installment = %+v, want paid by 80021663DE681814L", inst)
+			}
+			if o.Installments[1].Status != installmentScheduled {
+				t.Errorf("second installment = %s, want %s", o.Installments[1].Status, installmentScheduled)
+			}
+		}},
+		{"billing_subscription_payment_failed.json", func(t *testing.T, o *Order) {
+			if o.Installments[0].Status != installmentFailed || o.Installments[0].Failures != 1 {
+				t.Errorf("first installment = %+v, want one failure", o.Installments[0])
+			}
+			if !o.InDunning {
+				t.Error("order is not in dunning")
+			}
+		}},
+		{"billing_subscription_suspended.json", func(t *testing.T, o *Order) {
+			if o.Status != orderSuspended {
+				t.Errorf("status = %s, want %s", o.Status, orderSuspended)
+			}
+		}},
+		{"billing_subscription_cancelled.json", func(t *testing.T, o *Order) {
+			if o.Status != orderCancelled {
+				t.Errorf("status = %s, want %s", o.Status, orderCancelled)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			_, stop := usePayPalFake()
+			defer stop()
+			inst, done := newTestInstance(t)
+			defer done()
+			putTestOrder(t, inst, "shop.myshopify.com", fixtureSubscription)
+
+			body := fixture(t, "paypal/"+tt.fixture)
+			if code := postPayPalWebhook(t, inst, body); code != http.StatusOK {
+				t.Fatalf("webhook returned %d", code)
+			}
+			tt.check(t, loadTestOrder(t, inst, fixtureSubscription))
+
+			// PayPal redelivers until it sees a 2xx, and may do so anyway.
+			// The second delivery must leave the order as the first did.
+			if code := postPayPalWebhook(t, inst, body); code != http.StatusOK {
+				t.Fatalf("redelivery returned %d", code)
+			}
+			tt.check(t, loadTestOrder(t, inst, fixtureSubscription))
+		})
+	}
+}
+
+func TestPayPalWebhookCancelledAfterPayoff(t *testing.T) {
+	_, stop := usePayPalFake()
+	defer stop()
+	inst, done := newTestInstance(t)
+	defer done()
+	o := putTestOrder(t, inst, "shop.myshopify.com", fixtureSubscription)
+	o.Status = orderCompleted
+	if err := putOrder(appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil)), o); err != nil {
+		t.Fatalf("putOrder: %s", err)
+	}
+
+	if code := postPayPalWebhook(t, inst, fixture(t, "paypal/billing_subscription_cancelled.json")); code != http.StatusOK {
+		t.Fatalf("webhook returned %d", code)
+	}
+	if got := loadTestOrder(t, inst, fixtureSubscription).Status; got != orderCompleted {
+		t.Errorf("status = %s, want %s", got, orderCompleted)
+	}
+}
+
+func TestPayPalWebhookCaptureDeniedPaidInFull(t *testing.T) {
+	_, stop := usePayPalFake()
+	defer stop()
+	inst, done := newTestInstance(t)
+	defer done()
+	// Orders paid in full are stored under the PayPal order the capture
+	// belongs to.
+	o := putTestOrder(t, inst, "shop.myshopify.com", "5O190127TN364715T")
+	o.PayInFull = true
+	o.Installments = o.Installments[:1]
+	o.recordPayment("3C679366HH908993F", "62.50", time.Now())
+	if err := putOrder(appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil)), o); err != nil {
+		t.Fatalf("putOrder: %s", err)
+	}
+
+	if code := postPayPalWebhook(t, inst, fixture(t, "paypal/payment_capture_denied.json")); code != http.StatusOK {
+		t.Fatalf("webhook returned %d", code)
+	}
+	o = loadTestOrder(t, inst, "5O190127TN364715T")
+	if o.InDunning || o.Status != orderCompleted || o.Installments[0].Status != installmentPaid || o.Installments[0].Failures != 0 {
+		t.Errorf("order after a denied capture: dunning %v, %s, installment %+v", o.InDunning, o.Status, o.Installments[0])
+	}
+	ctx := appengine.NewContext(newTestRequest(t, inst, "GET", "/", nil))
+	var event WebhookEvent
+	if err := datastore.Get(ctx, webhookEventKey(ctx, "WH-4SW78779LY2325805-07E03580SX1414828"), &event); err != nil {
+		t.Fatalf("get event: %s", err)
+	}
+	if event.OrderID != "" {
+		t.Errorf("denied capture applied to order %s", event.OrderID)
+	}
+}
+
+func TestPayPalWebhookInvalidSignature(t *testing.T) {
+	fake, stop := usePayPalFake()
+	defer stop()
+	fake.RejectWebhooks = true
+	inst, done := newTestInstance(t)
+	defer done()
+	putTestOrder(t, inst, "shop.myshopify.com", fixtureSubscription)
+
+	if code := postPayPalWebhook(t, inst, fixture(t, "paypal/payment_sale_completed.json")); code != http.StatusUnauthorized {
+		t.Errorf("webhook returned %d, want %d", code, http.StatusUnauthorized)
+	}
+	if got := loadTestOrder(t, inst, fixtureSubscription).Installments[0].Status; got != installmentScheduled {
+		t.Errorf("first installment = %s, want %s", got, installmentScheduled)
+	}
+}